@@ -0,0 +1,67 @@
+// See the LICENSE file for license details.
+
+package loadbalancer
+
+import (
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+type downtimeStats struct {
+	downSince   time.Time
+	upSince     time.Time
+	downCount   uint64
+	flapCount   uint64
+	lastDown    time.Duration
+	totalDown   time.Duration
+	longestDown time.Duration
+}
+
+// -----------------------------------------------------------------------------
+
+// markDown puts the server offline and accounts the transition
+// NOTE: The load balancer lock must be held
+func (srv *Server) markDown(now time.Time) {
+	srv.isDown = true
+	srv.lb.primaryOnlineCount -= 1
+
+	srv.downtime.downSince = now
+	srv.downtime.downCount += 1
+
+	// Failing again within a fail timeout period after recovering is considered a flap
+	if !srv.downtime.upSince.IsZero() && now.Sub(srv.downtime.upSince) < srv.opts.FailTimeout {
+		srv.downtime.flapCount += 1
+	}
+}
+
+// markUp puts the server online again and accounts how long it was offline
+// NOTE: The load balancer lock must be held
+func (srv *Server) markUp(now time.Time) {
+	srv.isDown = false
+	srv.lb.primaryOnlineCount += 1
+
+	// Start with a clean failure count and window of requests, so new failures can put it offline again
+	srv.failCounter = 0
+	srv.resetFailWindow()
+
+	if !srv.downtime.downSince.IsZero() {
+		d := now.Sub(srv.downtime.downSince)
+		srv.downtime.lastDown = d
+		srv.downtime.totalDown += d
+		if d > srv.downtime.longestDown {
+			srv.downtime.longestDown = d
+		}
+		srv.downtime.downSince = time.Time{}
+	}
+	srv.downtime.upSince = now
+}
+
+// resetDowntime clears the downtime counters but keeps tracking the current transition
+// NOTE: The load balancer lock must be held
+func (srv *Server) resetDowntime() {
+	srv.downtime = downtimeStats{
+		downSince: srv.downtime.downSince,
+		upSince:   srv.downtime.upSince,
+	}
+}
@@ -0,0 +1,54 @@
+// See the LICENSE file for license details.
+
+package loadbalancer
+
+// -----------------------------------------------------------------------------
+
+// FailureMode specifies how the unsuccessful attempts to reach a server are accounted towards MaxFails.
+type FailureMode int
+
+// -----------------------------------------------------------------------------
+
+const (
+	// WindowedFailures puts the server offline when MaxFails failures happen within a FailTimeout period. Failures
+	// after the period start a new one. This is the default mode.
+	WindowedFailures FailureMode = iota
+
+	// ConsecutiveFailures puts the server offline after MaxFails failures without a success, signaled with
+	// SetOnline, in between, regardless of the time elapsed between them.
+	ConsecutiveFailures
+
+	// SlidingRateFailures puts the server offline when MaxFails of the last FailureWindow requests failed. Successes
+	// must be signaled with SetOnline so they are accounted in the window.
+	SlidingRateFailures
+)
+
+// -----------------------------------------------------------------------------
+
+// recordOutcome stores the failure weight of a request, zero on success, in the sliding window and updates the
+// failure counter with the weights in the window
+// NOTE: The load balancer lock must be held
+func (srv *Server) recordOutcome(weight float64) {
+	if srv.failWindow == nil {
+		srv.failWindow = make([]float64, srv.opts.FailureWindow)
+	}
+	srv.failWindow[srv.failWindowNext] = weight
+	srv.failWindowNext = (srv.failWindowNext + 1) % len(srv.failWindow)
+
+	srv.failCounter = 0
+	for _, w := range srv.failWindow {
+		srv.failCounter += w
+	}
+}
+
+// resetFailWindow discards the outcomes stored in the sliding window, if any
+// NOTE: The load balancer lock must be held
+func (srv *Server) resetFailWindow() {
+	if srv.failWindow != nil {
+		for idx := range srv.failWindow {
+			srv.failWindow[idx] = 0
+		}
+		srv.failWindowNext = 0
+		srv.failCounter = 0
+	}
+}
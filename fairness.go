@@ -0,0 +1,78 @@
+// See the LICENSE file for license details.
+
+package loadbalancer
+
+// -----------------------------------------------------------------------------
+
+// ServerFairness compares the configured weight of a server with the traffic it actually received.
+type ServerFairness struct {
+	Server   *Server
+	IsBackup bool
+	Weight   int
+
+	// Fraction of the group selections the server should receive according to the weights
+	ExpectedFraction float64
+
+	// Fraction of the group selections the server received since the last ResetStats call
+	RealizedFraction float64
+
+	// Difference between the realized and the expected fractions
+	Deviation float64
+}
+
+// -----------------------------------------------------------------------------
+
+// Fairness returns, for each server, the share of the traffic it should receive and the share it received since
+// the last ResetStats call. Primary and backup servers are measured independently. Primary servers first followed
+// by the backup servers.
+func (lb *LoadBalancer) Fairness() []ServerFairness {
+	lb.mtx.Lock()
+	defer lb.mtx.Unlock()
+
+	list := make([]ServerFairness, 0, len(lb.primaryGroup.srvList)+len(lb.backupGroup.srvList))
+	list = lb.primaryGroup.fairness(list)
+	list = lb.backupGroup.fairness(list)
+	return list
+}
+
+// ResetStats resets the selection and downtime counters of all servers.
+func (lb *LoadBalancer) ResetStats() {
+	lb.mtx.Lock()
+	for _, srv := range lb.primaryGroup.srvList {
+		srv.selectCount = 0
+		srv.resetDowntime()
+	}
+	for _, srv := range lb.backupGroup.srvList {
+		srv.selectCount = 0
+	}
+	lb.mtx.Unlock()
+}
+
+// -----------------------------------------------------------------------------
+
+// NOTE: The load balancer lock must be held
+func (group *ServerGroup) fairness(list []ServerFairness) []ServerFairness {
+	totalWeight := 0
+	totalSelections := uint64(0)
+	for _, srv := range group.srvList {
+		totalWeight += srv.opts.Weight
+		totalSelections += srv.selectCount
+	}
+
+	for _, srv := range group.srvList {
+		sf := ServerFairness{
+			Server:   srv,
+			IsBackup: srv.opts.IsBackup,
+			Weight:   srv.opts.Weight,
+		}
+		if totalWeight > 0 {
+			sf.ExpectedFraction = float64(srv.opts.Weight) / float64(totalWeight)
+		}
+		if totalSelections > 0 {
+			sf.RealizedFraction = float64(srv.selectCount) / float64(totalSelections)
+		}
+		sf.Deviation = sf.RealizedFraction - sf.ExpectedFraction
+		list = append(list, sf)
+	}
+	return list
+}
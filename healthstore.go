@@ -0,0 +1,145 @@
+// See the LICENSE file for license details.
+
+package loadbalancer
+
+import (
+	"sync"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+// HealthStore shares the offline state of the servers, identified by their names, among multiple load balancers,
+// for e.g., the instances of a service, so a server detected as down by one of them is avoided by all.
+// NOTE: Implementations must be safe for concurrent use. They are called without holding the load balancer lock.
+type HealthStore interface {
+	// MarkDown marks the server as offline until the specified time. A time in the past marks it as online.
+	MarkDown(name string, until time.Time)
+
+	// IsDown returns if the server is offline and until when.
+	IsDown(name string) (bool, time.Time)
+}
+
+// MemoryHealthStore is a HealthStore that shares the state among load balancers of the same process.
+type MemoryHealthStore struct {
+	mtx     sync.RWMutex
+	downMap map[string]time.Time
+}
+
+// -----------------------------------------------------------------------------
+
+// NewMemoryHealthStore creates a new in-memory health store.
+func NewMemoryHealthStore() *MemoryHealthStore {
+	s := MemoryHealthStore{
+		mtx:     sync.RWMutex{},
+		downMap: make(map[string]time.Time),
+	}
+	return &s
+}
+
+// MarkDown marks the server as offline until the specified time.
+func (s *MemoryHealthStore) MarkDown(name string, until time.Time) {
+	s.mtx.Lock()
+	if until.After(time.Now()) {
+		s.downMap[name] = until
+	} else {
+		delete(s.downMap, name)
+	}
+	s.mtx.Unlock()
+}
+
+// IsDown returns if the server is offline and until when.
+func (s *MemoryHealthStore) IsDown(name string) (bool, time.Time) {
+	s.mtx.RLock()
+	until, ok := s.downMap[name]
+	s.mtx.RUnlock()
+	if !ok || !until.After(time.Now()) {
+		return false, time.Time{}
+	}
+	return true, until
+}
+
+// SetHealthStore sets the store used to share the offline state of the named servers with other load balancers.
+// Servers without a name are not shared. Set to nil to keep the state local, the default behavior.
+//
+// Next calls IsDown once for each named primary server online, so, to avoid a round trip to a remote store on every
+// request, the store is queried at most once per HealthStoreSyncInterval. Servers put offline by other load
+// balancers are avoided only after the next query.
+func (lb *LoadBalancer) SetHealthStore(store HealthStore) {
+	lb.mtx.Lock()
+	lb.healthStore = store
+	lb.healthSyncTime = time.Time{}
+	lb.mtx.Unlock()
+}
+
+// -----------------------------------------------------------------------------
+
+// syncHealthStore puts offline the named primary servers marked as down in the health store and returns them
+func (lb *LoadBalancer) syncHealthStore(now time.Time) []*Server {
+	// Get the servers to check
+	lb.mtx.Lock()
+	store := lb.healthStore
+	var named []*Server
+	if store != nil {
+		for _, srv := range lb.primaryGroup.srvList {
+			if len(srv.opts.Name) > 0 && srv.opts.MaxFails > 0 && !srv.isDown {
+				named = append(named, srv)
+			}
+		}
+	}
+	lb.mtx.Unlock()
+	if len(named) == 0 {
+		return nil
+	}
+
+	// Query the store without holding the lock
+	type downServer struct {
+		srv   *Server
+		until time.Time
+	}
+	downList := make([]downServer, 0)
+	for _, srv := range named {
+		if isDown, until := store.IsDown(srv.opts.Name); isDown && until.After(now) {
+			downList = append(downList, downServer{
+				srv:   srv,
+				until: until,
+			})
+		}
+	}
+	if len(downList) == 0 {
+		return nil
+	}
+
+	// Put them offline
+	notifyDown := make([]*Server, 0, len(downList))
+
+	lb.mtx.Lock()
+	for _, d := range downList {
+		if !d.srv.isDown {
+			d.srv.failCounter = float64(d.srv.opts.MaxFails)
+			d.srv.failTimestamp = d.until
+			d.srv.markDown(now)
+
+			notifyDown = append(notifyDown, d.srv)
+		}
+	}
+	lb.mtx.Unlock()
+
+	// Done
+	return notifyDown
+}
+
+// publishHealth updates the state of the server in the health store, if any
+func (srv *Server) publishHealth(until time.Time) {
+	if len(srv.opts.Name) == 0 {
+		return
+	}
+
+	srv.lb.mtx.Lock()
+	store := srv.lb.healthStore
+	srv.lb.mtx.Unlock()
+
+	if store != nil {
+		store.MarkDown(srv.opts.Name, until)
+	}
+}
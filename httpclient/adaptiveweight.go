@@ -0,0 +1,132 @@
+// See the LICENSE file for license details.
+
+package httpclient
+
+import (
+	"errors"
+	"math"
+	"sync"
+)
+
+// -----------------------------------------------------------------------------
+
+const (
+	defaultAdaptiveWeightWindow = 20
+)
+
+// -----------------------------------------------------------------------------
+
+// AdaptiveWeightOptions specifies how the weight of the sources is reduced while they return errors.
+type AdaptiveWeightOptions struct {
+	// MinWeight sets the lowest weight a source can be reduced to. Zero defaults to 1. It is capped to the
+	// configured weight of each source.
+	MinWeight int
+
+	// Tolerance sets the error rate, from 0 to 1, a source can have before its weight starts to be reduced. From
+	// there, the weight decreases proportionally until it reaches MinWeight when all the requests fail.
+	Tolerance float64
+
+	// Window sets the approximate amount of recent requests the rolling error rate of each source accounts. Zero
+	// defaults to 20.
+	Window int
+}
+
+type adaptiveWeights struct {
+	opts AdaptiveWeightOptions
+}
+
+type adaptiveWeightState struct {
+	mtx       sync.Mutex
+	errorRate float64
+	weight    int // NOTE: Zero if the configured weight is in use
+}
+
+// -----------------------------------------------------------------------------
+
+// SetAdaptiveWeights makes sources returning errors to gradually receive less traffic, by reducing their weight
+// based on their rolling error rate, and to recover their configured weight as the errors subside, without taking
+// them offline. Source weights are integers, so configure them with values big enough to give room to the
+// adjustments, for e.g., 10 or 100. Pass nil to disable it and restore the configured weights.
+func (c *HttpClient) SetAdaptiveWeights(opts *AdaptiveWeightOptions) error {
+	if opts != nil {
+		if opts.MinWeight < 0 || opts.Tolerance < 0 || opts.Tolerance >= 1 || opts.Window < 0 {
+			return errors.New("invalid parameter")
+		}
+	}
+
+	// Start from the configured weights
+	for _, src := range c.sources {
+		src.adaptive.mtx.Lock()
+		src.adaptive.errorRate = 0
+		if src.adaptive.weight != 0 {
+			src.adaptive.weight = 0
+			_ = src.srv.SetWeight(src.srv.ConfiguredWeight())
+		}
+		src.adaptive.mtx.Unlock()
+	}
+
+	if opts == nil {
+		c.adaptiveWeights = nil
+		return nil
+	}
+
+	aw := &adaptiveWeights{
+		opts: *opts,
+	}
+	if aw.opts.MinWeight == 0 {
+		aw.opts.MinWeight = 1
+	}
+	if aw.opts.Window == 0 {
+		aw.opts.Window = defaultAdaptiveWeightWindow
+	}
+	c.adaptiveWeights = aw
+
+	// Done
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+// record accounts the result of a request in the rolling error rate of the source and adjusts its weight
+func (aw *adaptiveWeights) record(src *Source, success bool) {
+	sample := float64(0)
+	if !success {
+		sample = 1
+	}
+
+	// NOTE: Read from the balancer because it can be changed, for e.g., by a traffic split
+	configured := src.srv.ConfiguredWeight()
+
+	src.adaptive.mtx.Lock()
+	defer src.adaptive.mtx.Unlock()
+
+	src.adaptive.errorRate += (sample - src.adaptive.errorRate) / float64(aw.opts.Window)
+
+	weight := aw.effectiveWeight(configured, src.adaptive.errorRate)
+	current := src.adaptive.weight
+	if current == 0 {
+		current = configured
+	}
+	if weight != current {
+		// NOTE: Changed while holding the source lock so concurrent adjustments are applied in order
+		_ = src.srv.SetWeight(weight)
+	}
+	if weight != configured {
+		src.adaptive.weight = weight
+	} else {
+		src.adaptive.weight = 0
+	}
+}
+
+func (aw *adaptiveWeights) effectiveWeight(configured int, errorRate float64) int {
+	floor := aw.opts.MinWeight
+	if floor > configured {
+		floor = configured
+	}
+	if errorRate <= aw.opts.Tolerance {
+		return configured
+	}
+
+	factor := (errorRate - aw.opts.Tolerance) / (1 - aw.opts.Tolerance)
+	return configured - int(math.Round(float64(configured-floor)*factor))
+}
@@ -0,0 +1,136 @@
+// See the LICENSE file for license details.
+
+package httpclient
+
+import (
+	"math/rand"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+// Backoff calculates the delay to wait before retrying a request.
+type Backoff interface {
+	// Next receives the zero-based number of the attempt that just finished and returns the delay to wait before
+	// the next one.
+	// NOTE: It can be called concurrently by different requests.
+	Next(attempt int) time.Duration
+}
+
+type constantBackoff struct {
+	delay time.Duration
+}
+
+type linearBackoff struct {
+	base     time.Duration
+	maxDelay time.Duration
+}
+
+type exponentialBackoff struct {
+	base     time.Duration
+	maxDelay time.Duration
+}
+
+type fibonacciBackoff struct {
+	base     time.Duration
+	maxDelay time.Duration
+}
+
+type fullJitterBackoff struct {
+	exponentialBackoff
+}
+
+// -----------------------------------------------------------------------------
+
+// ConstantBackoff returns a backoff that always waits the same delay.
+func ConstantBackoff(delay time.Duration) Backoff {
+	return &constantBackoff{
+		delay: delay,
+	}
+}
+
+// LinearBackoff returns a backoff that waits base, 2*base, 3*base and so on, up to maxDelay. A maxDelay of zero
+// means no limit.
+func LinearBackoff(base time.Duration, maxDelay time.Duration) Backoff {
+	return &linearBackoff{
+		base:     base,
+		maxDelay: maxDelay,
+	}
+}
+
+// ExponentialBackoff returns a backoff that starts at base and doubles on each retry, up to maxDelay. A maxDelay of
+// zero means no limit.
+func ExponentialBackoff(base time.Duration, maxDelay time.Duration) Backoff {
+	return &exponentialBackoff{
+		base:     base,
+		maxDelay: maxDelay,
+	}
+}
+
+// FibonacciBackoff returns a backoff that waits base multiplied by the Fibonacci sequence (1, 1, 2, 3, 5...), up to
+// maxDelay. A maxDelay of zero means no limit.
+func FibonacciBackoff(base time.Duration, maxDelay time.Duration) Backoff {
+	return &fibonacciBackoff{
+		base:     base,
+		maxDelay: maxDelay,
+	}
+}
+
+// FullJitterBackoff returns a backoff that waits a random delay between zero and the one ExponentialBackoff would
+// wait, so clients failing at the same time do not retry in lockstep.
+func FullJitterBackoff(base time.Duration, maxDelay time.Duration) Backoff {
+	return &fullJitterBackoff{
+		exponentialBackoff: exponentialBackoff{
+			base:     base,
+			maxDelay: maxDelay,
+		},
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+func (b *constantBackoff) Next(_ int) time.Duration {
+	return b.delay
+}
+
+func (b *linearBackoff) Next(attempt int) time.Duration {
+	return capDelay(b.base, int64(attempt)+1, b.maxDelay)
+}
+
+func (b *exponentialBackoff) Next(attempt int) time.Duration {
+	if attempt > 62 {
+		attempt = 62
+	}
+	return capDelay(b.base, int64(1)<<uint(attempt), b.maxDelay)
+}
+
+func (b *fibonacciBackoff) Next(attempt int) time.Duration {
+	prev, curr := int64(0), int64(1)
+	for i := 0; i < attempt && curr < 1<<62; i++ {
+		prev, curr = curr, prev+curr
+	}
+	return capDelay(b.base, curr, b.maxDelay)
+}
+
+func (b *fullJitterBackoff) Next(attempt int) time.Duration {
+	d := b.exponentialBackoff.Next(attempt)
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// capDelay returns base multiplied by factor, limited to maxDelay if not zero, avoiding overflows
+func capDelay(base time.Duration, factor int64, maxDelay time.Duration) time.Duration {
+	if base <= 0 || factor <= 0 {
+		return 0
+	}
+	limit := maxDelay
+	if limit <= 0 {
+		limit = time.Duration(1<<63 - 1)
+	}
+	if factor > int64(limit/base) {
+		return limit
+	}
+	return base * time.Duration(factor)
+}
@@ -0,0 +1,142 @@
+// See the LICENSE file for license details.
+
+package httpclient
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+const (
+	breakerBucketsCount      = 10
+	defaultBreakerMinRequest = 10
+)
+
+// -----------------------------------------------------------------------------
+
+var ErrCircuitOpen = errors.New("circuit open")
+
+// -----------------------------------------------------------------------------
+
+// CircuitBreakerOptions specifies when the client must stop sending requests to all sources.
+type CircuitBreakerOptions struct {
+	// FailureRatio sets the ratio of failed requests, from 0 to 1, that opens the circuit.
+	FailureRatio float64
+
+	// Window sets the sliding time window where the failure ratio is calculated.
+	Window time.Duration
+
+	// MinRequests sets the minimum amount of requests in the window before the ratio is evaluated. Defaults to 10.
+	MinRequests int
+
+	// Cooldown sets how long the circuit stays open. Requests made while the circuit is open fail immediately with
+	// ErrCircuitOpen. Defaults to Window.
+	Cooldown time.Duration
+}
+
+type circuitBreaker struct {
+	mtx       sync.Mutex
+	opts      CircuitBreakerOptions
+	buckets   [breakerBucketsCount]breakerBucket
+	openUntil time.Time
+}
+
+type breakerBucket struct {
+	start     time.Time
+	successes int
+	failures  int
+}
+
+// -----------------------------------------------------------------------------
+
+// SetCircuitBreaker enables a client-wide circuit breaker. When the failure ratio of all requests exceeds the
+// configured threshold, requests are short-circuited during the cooldown period instead of trying doomed servers.
+// Pass nil to disable it.
+func (c *HttpClient) SetCircuitBreaker(opts *CircuitBreakerOptions) error {
+	if opts == nil {
+		c.breaker = nil
+		return nil
+	}
+
+	if opts.FailureRatio <= 0 || opts.FailureRatio > 1 || opts.Window <= 0 || opts.MinRequests < 0 ||
+		opts.Cooldown < 0 {
+		return errors.New("invalid parameter")
+	}
+	cb := circuitBreaker{
+		mtx:  sync.Mutex{},
+		opts: *opts,
+	}
+	if cb.opts.MinRequests == 0 {
+		cb.opts.MinRequests = defaultBreakerMinRequest
+	}
+	if cb.opts.Cooldown == 0 {
+		cb.opts.Cooldown = cb.opts.Window
+	}
+	c.breaker = &cb
+
+	// Done
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+func (cb *circuitBreaker) allow() bool {
+	now := time.Now()
+
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+
+	if cb.openUntil.IsZero() {
+		return true
+	}
+	if now.Before(cb.openUntil) {
+		return false
+	}
+
+	// Cooldown elapsed, close the circuit and start with a fresh window
+	cb.openUntil = time.Time{}
+	cb.buckets = [breakerBucketsCount]breakerBucket{}
+	return true
+}
+
+func (cb *circuitBreaker) record(success bool) {
+	now := time.Now()
+
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+
+	// Add the result to the current bucket
+	bucketSize := cb.opts.Window / breakerBucketsCount
+	if bucketSize <= 0 {
+		bucketSize = 1
+	}
+	start := now.Truncate(bucketSize)
+	bucket := &cb.buckets[(start.UnixNano()/int64(bucketSize))%breakerBucketsCount]
+	if !bucket.start.Equal(start) {
+		*bucket = breakerBucket{
+			start: start,
+		}
+	}
+	if success {
+		bucket.successes += 1
+	} else {
+		bucket.failures += 1
+	}
+
+	// Calculate the failure ratio in the window
+	total := 0
+	failures := 0
+	for idx := range cb.buckets {
+		if now.Sub(cb.buckets[idx].start) < cb.opts.Window {
+			total += cb.buckets[idx].successes + cb.buckets[idx].failures
+			failures += cb.buckets[idx].failures
+		}
+	}
+	if total >= cb.opts.MinRequests && float64(failures)/float64(total) >= cb.opts.FailureRatio {
+		// Open the circuit
+		cb.openUntil = now.Add(cb.opts.Cooldown)
+	}
+}
@@ -0,0 +1,211 @@
+// See the LICENSE file for license details.
+
+package httpclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// -----------------------------------------------------------------------------
+
+// BroadcastResult contains the outcome of a broadcasted request on a single source.
+type BroadcastResult struct {
+	SourceID   int
+	BaseURL    string
+	StatusCode int   // NOTE: Zero if the request failed to complete or the source was skipped
+	Err        error // NOTE: The transport error or the one returned by the callback
+	Skipped    bool  // NOTE: True if the source was offline and the request was not sent
+}
+
+// BroadcastResults contains the outcome of a broadcasted request on each source.
+type BroadcastResults []BroadcastResult
+
+// PartialFailureError is the error returned by Broadcast when the request did not succeed on all the sources. It
+// contains the results of the sources that failed or were skipped, so the request can be sent again only to them.
+type PartialFailureError struct {
+	Failed BroadcastResults
+}
+
+// -----------------------------------------------------------------------------
+
+var ErrPartialFailure = errors.New("partial failure")
+
+// -----------------------------------------------------------------------------
+
+// Broadcast sends the request to all the sources of the request pool concurrently, instead of load-balancing it,
+// for e.g., to invalidate caches. Offline sources are skipped and reported as such. If set, the callback is called
+// once per source, concurrently, and requests are not retried. The results are returned in source order. If the
+// request failed or was skipped on any source, a PartialFailureError is returned along with the results, so the
+// failed subset can be retried with BroadcastTo.
+func (req *Request) Broadcast() (BroadcastResults, error) {
+	return req.broadcast(nil)
+}
+
+// BroadcastTo works like Broadcast but only sends the request to the sources with the given IDs, for e.g., the ones
+// that failed in a previous call. IDs not belonging to the request pool are ignored.
+func (req *Request) BroadcastTo(ids ...int) (BroadcastResults, error) {
+	targets := make(map[int]struct{}, len(ids))
+	for _, id := range ids {
+		targets[id] = struct{}{}
+	}
+	return req.broadcast(targets)
+}
+
+// OK returns true if the request was sent to the source and completed without error.
+func (r *BroadcastResult) OK() bool {
+	return !r.Skipped && r.Err == nil
+}
+
+// Failed returns the results of the sources where the request failed or was skipped.
+func (results BroadcastResults) Failed() BroadcastResults {
+	failed := make(BroadcastResults, 0)
+	for idx := range results {
+		if !results[idx].OK() {
+			failed = append(failed, results[idx])
+		}
+	}
+	return failed
+}
+
+// SourceIDs returns the IDs of the sources in the results, in the same order.
+func (results BroadcastResults) SourceIDs() []int {
+	ids := make([]int, 0, len(results))
+	for idx := range results {
+		ids = append(ids, results[idx].SourceID)
+	}
+	return ids
+}
+
+func (e *PartialFailureError) Error() string {
+	s := ErrPartialFailure.Error()
+	for idx := range e.Failed {
+		r := &e.Failed[idx]
+		if r.Skipped {
+			s += fmt.Sprintf(" [source=%v] [skipped]", r.SourceID)
+		} else {
+			s += fmt.Sprintf(" [source=%v] [err=%v]", r.SourceID, r.Err.Error())
+		}
+	}
+	return s
+}
+
+// Is makes errors.Is to match ErrPartialFailure.
+func (e *PartialFailureError) Is(target error) bool {
+	return target == ErrPartialFailure
+}
+
+// -----------------------------------------------------------------------------
+
+func (req *Request) broadcast(targets map[int]struct{}) (BroadcastResults, error) {
+	c := req.client
+
+	if _, ok := c.pools[req.pool]; !ok {
+		return nil, c.newError(nil, errUnknownPool, req.url, 0)
+	}
+
+	// Make the body replayable so each source gets its own copy
+	body := req.body
+	if body != nil {
+		if rc, ok := body.(io.ReadCloser); ok {
+			defer func() {
+				_ = rc.Close()
+			}()
+		}
+
+		switch body.(type) {
+		case *bytes.Buffer, *bytes.Reader, *strings.Reader:
+		default:
+			if req.maxBufferedBody == 0 {
+				return nil, errors.New("unsupported body reader")
+			}
+			buf, err := io.ReadAll(io.LimitReader(body, req.maxBufferedBody+1))
+			if err != nil {
+				return nil, c.newError(err, errUnableToReadBody, req.url, 0)
+			}
+			if int64(len(buf)) > req.maxBufferedBody {
+				return nil, ErrBodyTooLarge
+			}
+			body = bytes.NewReader(buf)
+		}
+	}
+
+	cb := req.callback
+	if cb == nil {
+		cb = defaultCallback
+	}
+
+	// Account the broadcast as a single request in the retry budget
+	if c.retryBudget != nil && !req.probe {
+		c.retryBudget.recordRequest()
+	}
+
+	// NOTE: Allocate all the results up front so the pointers given to the goroutines remain valid
+	results := make(BroadcastResults, 0, c.poolSourcesCount(req.pool))
+	wg := sync.WaitGroup{}
+	for _, src := range c.sources {
+		if src.pool != req.pool {
+			continue
+		}
+		if targets != nil {
+			if _, ok := targets[src.id]; !ok {
+				continue
+			}
+		}
+
+		results = append(results, BroadcastResult{
+			SourceID: src.id,
+			BaseURL:  src.baseURL,
+		})
+		result := &results[len(results)-1]
+
+		// Skip offline sources
+		if !src.IsOnline() {
+			result.Skipped = true
+			continue
+		}
+
+		// Send a single attempt copy of the request to this source
+		sub := *req
+		sub.body = body
+		sub.retryPolicy = nil
+		sub.retryDistinct = false
+		sub.singleAttempt = true
+		sub.broadcastSub = true
+		sub.session = nil
+		sub.PinSource(src.id)
+		sub.callback = func(ctx context.Context, res Response) error {
+			// Ignore retry requests, each source is only tried once
+			retry := false
+			res.retry = &retry
+
+			if res.Response != nil {
+				result.StatusCode = res.StatusCode
+			}
+			return cb(ctx, res)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			result.Err = sub.Exec()
+		}()
+	}
+	wg.Wait()
+
+	// Report the sources not reached
+	if failed := results.Failed(); len(failed) > 0 {
+		return results, &PartialFailureError{
+			Failed: failed,
+		}
+	}
+
+	// Done
+	return results, nil
+}
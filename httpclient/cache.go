@@ -0,0 +1,148 @@
+// See the LICENSE file for license details.
+
+package httpclient
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// -----------------------------------------------------------------------------
+
+const (
+	maxCachedBodySize = 8 * 1024 * 1024
+)
+
+// -----------------------------------------------------------------------------
+
+// CachedResponse is a response stored in the cache.
+type CachedResponse struct {
+	ETag       string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// CacheStore stores cached responses keyed by the full request url, which includes the source base url.
+// Implementations must be safe for concurrent use.
+type CacheStore interface {
+	Get(key string) (*CachedResponse, bool)
+	Set(key string, entry *CachedResponse)
+}
+
+type memoryCacheStore struct {
+	mtx     sync.RWMutex
+	entries map[string]*CachedResponse
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// -----------------------------------------------------------------------------
+
+// EnableCache enables caching of GET responses having an ETag header. Cached entries are revalidated sending
+// an If-None-Match header and, if the server answers with 304, the cached response is passed to the callback.
+// Pass nil to disable it.
+func (c *HttpClient) EnableCache(store CacheStore) {
+	c.cache = store
+}
+
+// NewMemoryCacheStore creates a simple unbounded in-memory cache store.
+func NewMemoryCacheStore() CacheStore {
+	return &memoryCacheStore{
+		mtx:     sync.RWMutex{},
+		entries: make(map[string]*CachedResponse),
+	}
+}
+
+// FromCache returns true if the response was served from the cache after the server answered 304.
+func (res *Response) FromCache() bool {
+	return res.fromCache
+}
+
+// -----------------------------------------------------------------------------
+
+func (s *memoryCacheStore) Get(key string) (*CachedResponse, bool) {
+	s.mtx.RLock()
+	entry, ok := s.entries[key]
+	s.mtx.RUnlock()
+	return entry, ok
+}
+
+func (s *memoryCacheStore) Set(key string, entry *CachedResponse) {
+	s.mtx.Lock()
+	s.entries[key] = entry
+	s.mtx.Unlock()
+}
+
+// -----------------------------------------------------------------------------
+
+// prepareCachedRequest adds the conditional header to cacheable requests and returns the current cached entry
+func (c *HttpClient) prepareCachedRequest(httpReq *http.Request, key string) *CachedResponse {
+	if c.cache == nil || httpReq.Method != "GET" {
+		return nil
+	}
+	entry, ok := c.cache.Get(key)
+	if !ok || entry == nil {
+		return nil
+	}
+	if len(httpReq.Header.Get("If-None-Match")) == 0 {
+		httpReq.Header.Set("If-None-Match", entry.ETag)
+	}
+	return entry
+}
+
+// processCachedResponse replaces not-modified responses with the cached one and stores new cacheable ones
+func (c *HttpClient) processCachedResponse(
+	httpReq *http.Request, res *http.Response, key string, entry *CachedResponse,
+) (*http.Response, bool) {
+	if c.cache == nil || httpReq.Method != "GET" {
+		return res, false
+	}
+
+	// Serve from the cache if not modified
+	if res.StatusCode == http.StatusNotModified && entry != nil {
+		_, _ = io.Copy(io.Discard, res.Body)
+		_ = res.Body.Close()
+
+		cachedRes := *res
+		cachedRes.StatusCode = entry.StatusCode
+		cachedRes.Status = http.StatusText(entry.StatusCode)
+		cachedRes.Header = entry.Header.Clone()
+		cachedRes.Body = io.NopCloser(bytes.NewReader(entry.Body))
+		cachedRes.ContentLength = int64(len(entry.Body))
+		return &cachedRes, true
+	}
+
+	// Store successful responses having an entity tag
+	etag := res.Header.Get("ETag")
+	if res.StatusCode != http.StatusOK || len(etag) == 0 {
+		return res, false
+	}
+	buf, err := io.ReadAll(io.LimitReader(res.Body, maxCachedBodySize+1))
+	if err != nil || len(buf) > maxCachedBodySize {
+		// Not cacheable, give back what we read
+		res.Body = &readCloser{
+			Reader: io.MultiReader(bytes.NewReader(buf), res.Body),
+			Closer: res.Body,
+		}
+		return res, false
+	}
+	c.cache.Set(key, &CachedResponse{
+		ETag:       etag,
+		StatusCode: res.StatusCode,
+		Header:     res.Header.Clone(),
+		Body:       buf,
+	})
+	res.Body = &readCloser{
+		Reader: bytes.NewReader(buf),
+		Closer: res.Body,
+	}
+
+	// Done
+	return res, false
+}
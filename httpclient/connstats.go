@@ -0,0 +1,120 @@
+// See the LICENSE file for license details.
+
+package httpclient
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+// ConnStats contains the transport-level connection counters of a source.
+type ConnStats struct {
+	NewConns      uint64
+	ReusedConns   uint64
+	DNSLookups    uint64
+	TLSHandshakes uint64
+}
+
+// NOTE: Allocated separately to keep the 64-bit counters aligned on 32-bit platforms
+type connStats struct {
+	newConns      uint64
+	reusedConns   uint64
+	dnsLookups    uint64
+	tlsHandshakes uint64
+	lastTTFB      int64
+	avgTTFB       int64
+	lastWait      int64
+	avgWait       int64
+}
+
+// -----------------------------------------------------------------------------
+
+const (
+	// avgWeight sets how much the last measurement contributes to the TTFB and wait time moving averages, as
+	// 1/avgWeight
+	avgWeight = 5
+)
+
+// -----------------------------------------------------------------------------
+
+// ConnStats returns the connection counters of the source. A high ratio of new connections over reused ones
+// indicates the connection pooling is not working for this source.
+func (src *Source) ConnStats() ConnStats {
+	return ConnStats{
+		NewConns:      atomic.LoadUint64(&src.connStats.newConns),
+		ReusedConns:   atomic.LoadUint64(&src.connStats.reusedConns),
+		DNSLookups:    atomic.LoadUint64(&src.connStats.dnsLookups),
+		TLSHandshakes: atomic.LoadUint64(&src.connStats.tlsHandshakes),
+	}
+}
+
+// TTFB returns the time to first byte, elapsed since the attempt started until the response headers begin to
+// arrive, of the last request sent to the source and its exponential moving average. Zero if not measured yet.
+func (src *Source) TTFB() (last time.Duration, avg time.Duration) {
+	last = time.Duration(atomic.LoadInt64(&src.connStats.lastTTFB))
+	avg = time.Duration(atomic.LoadInt64(&src.connStats.avgTTFB))
+	return
+}
+
+// WaitTime returns the time the last request sent to the source waited for an available server, for e.g., because
+// all of them reached their MaxConcurrent limit, and its exponential moving average. High wait times indicate the
+// pool is undersized.
+func (src *Source) WaitTime() (last time.Duration, avg time.Duration) {
+	last = time.Duration(atomic.LoadInt64(&src.connStats.lastWait))
+	avg = time.Duration(atomic.LoadInt64(&src.connStats.avgWait))
+	return
+}
+
+// -----------------------------------------------------------------------------
+
+// clientTrace returns a trace that accumulates the connection events and the TTFB of an attempt started at the
+// given time in the source stats
+func (src *Source) clientTrace(start time.Time) *httptrace.ClientTrace {
+	stats := src.connStats
+	return &httptrace.ClientTrace{
+		GotFirstResponseByte: func() {
+			stats.recordTTFB(time.Since(start))
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddUint64(&stats.reusedConns, 1)
+			} else {
+				atomic.AddUint64(&stats.newConns, 1)
+			}
+		},
+		DNSStart: func(_ httptrace.DNSStartInfo) {
+			atomic.AddUint64(&stats.dnsLookups, 1)
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				atomic.AddUint64(&stats.tlsHandshakes, 1)
+			}
+		},
+	}
+}
+
+func (stats *connStats) recordTTFB(ttfb time.Duration) {
+	recordMovingAverage(&stats.lastTTFB, &stats.avgTTFB, ttfb)
+}
+
+func (stats *connStats) recordWait(wait time.Duration) {
+	recordMovingAverage(&stats.lastWait, &stats.avgWait, wait)
+}
+
+func recordMovingAverage(last *int64, avg *int64, d time.Duration) {
+	atomic.StoreInt64(last, int64(d))
+	for {
+		oldAvg := atomic.LoadInt64(avg)
+		newAvg := int64(d)
+		if oldAvg > 0 {
+			newAvg = oldAvg + (int64(d)-oldAvg)/avgWeight
+		}
+		if atomic.CompareAndSwapInt64(avg, oldAvg, newAvg) {
+			return
+		}
+	}
+}
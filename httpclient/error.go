@@ -27,6 +27,24 @@ type Error struct {
 	err        error
 }
 
+// AttemptsError is the error returned when all sources were tried without success. It contains the errors of the
+// failed attempts.
+type AttemptsError struct {
+	Errors []error
+}
+
+// StatusError is the error returned by ExecJSON when the response status code is not 2xx.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Body       []byte
+}
+
+// -----------------------------------------------------------------------------
+
+var ErrAllSourcesTried = errors.New("all sources tried")
+var ErrUnexpectedStatus = errors.New("unexpected status code")
+
 // -----------------------------------------------------------------------------
 
 func (c *HttpClient) newError(wrappedErr error, message string, url string, statusCode int) *Error {
@@ -84,3 +102,47 @@ func (e *Error) IsNetworkError() bool {
 	}
 	return false
 }
+
+func newAttemptsError(errs []error) *AttemptsError {
+	return &AttemptsError{
+		Errors: errs,
+	}
+}
+
+func (e *AttemptsError) Error() string {
+	s := ErrAllSourcesTried.Error()
+	for _, err := range e.Errors {
+		s += " [err=" + err.Error() + "]"
+	}
+	return s
+}
+
+// Is makes errors.Is to match ErrAllSourcesTried.
+func (e *AttemptsError) Is(target error) bool {
+	return target == ErrAllSourcesTried
+}
+
+// Unwrap returns the error of the last failed attempt, if any.
+func (e *AttemptsError) Unwrap() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e.Errors[len(e.Errors)-1]
+}
+
+func newStatusError(url string, statusCode int, body []byte) *StatusError {
+	return &StatusError{
+		URL:        url,
+		StatusCode: statusCode,
+		Body:       body,
+	}
+}
+
+func (e *StatusError) Error() string {
+	return ErrUnexpectedStatus.Error() + fmt.Sprintf(" [URL=%v] [status=%v]", e.URL, e.StatusCode)
+}
+
+// Is makes errors.Is to match ErrUnexpectedStatus.
+func (e *StatusError) Is(target error) bool {
+	return target == ErrUnexpectedStatus
+}
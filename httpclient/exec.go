@@ -6,31 +6,81 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"os"
 	"strings"
+	"time"
 )
 
 // -----------------------------------------------------------------------------
 
 const (
-	errUnableToExecuteRequest = "failed to execute http request"
-	errNoAvailableServer      = "no available upstream server"
+	errUnableToExecuteRequest   = "failed to execute http request"
+	errNoAvailableServer        = "no available upstream server"
+	errUnableToReadBody         = "failed to read request body"
+	errUnknownPool              = "unknown source pool"
+	errCallbackPanicked         = "callback panicked"
+	errInvalidURL               = "invalid request url"
+	errPreflightFailed          = "preflight hook failed"
+	errUnableToOpenBodyFile     = "failed to open request body file"
+	errUnableToReadResponseBody = "failed to read response body"
+	errSigningFailed            = "failed to sign request"
+	errRetryNotDone             = "request not retried"
+	errNoResponse               = "no response received"
+)
+
+const (
+	maxDrainBodySize = 64 * 1024
+
+	serverWaitPollInterval = 10 * time.Millisecond
 )
 
 // -----------------------------------------------------------------------------
 
 func (c *HttpClient) exec(req *Request) error {
 	var httpReq *http.Request
-	var getBody func() io.ReadCloser
+	var getBody func() (io.ReadCloser, error)
 	var err error
 
+	// Fail fast if the circuit breaker is open
+	if c.breaker != nil && !c.breaker.allow() {
+		c.callEventHandler(RequestShortCircuitedEvent, 0, ErrCircuitOpen)
+		return ErrCircuitOpen
+	}
+
+	// Get the load balancer of the selected pool
+	lb, ok := c.pools[req.pool]
+	if !ok {
+		return c.newError(nil, errUnknownPool, req.url, 0)
+	}
+
+	// Account the request in the retry budget
+	// NOTE: A broadcast is accounted once and not once per source
+	if c.retryBudget != nil && !req.probe && !req.broadcastSub {
+		c.retryBudget.recordRequest()
+	}
+
 	// Define a body getter to return multiple copies of the reader to be used in retries.
-	if req.body == nil {
+	if len(req.bodyFile) > 0 {
+		// Ensure the file can be opened before selecting any server
+		f, err := os.Open(req.bodyFile)
+		if err != nil {
+			return c.newError(err, errUnableToOpenBodyFile, req.url, 0)
+		}
+		_ = f.Close()
+
+		// Open the file again on each attempt
+		getBody = func() (io.ReadCloser, error) {
+			return os.Open(req.bodyFile)
+		}
+	} else if req.body == nil {
 		// If no body, getter will return nil
-		getBody = func() io.ReadCloser {
-			return nil
+		getBody = func() (io.ReadCloser, error) {
+			return nil, nil
 		}
 	} else {
 		// Convert to a ReadCloser if just a reader
@@ -48,119 +98,340 @@ func (c *HttpClient) exec(req *Request) error {
 		switch v := req.body.(type) {
 		case *bytes.Buffer:
 			buf := v.Bytes()
-			getBody = func() io.ReadCloser {
+			getBody = func() (io.ReadCloser, error) {
 				r := bytes.NewReader(buf)
-				return io.NopCloser(r)
+				return io.NopCloser(r), nil
 			}
 
 		case *bytes.Reader:
 			snapshot := *v
-			getBody = func() io.ReadCloser {
+			getBody = func() (io.ReadCloser, error) {
 				r := snapshot
-				return io.NopCloser(&r)
+				return io.NopCloser(&r), nil
 			}
 
 		case *strings.Reader:
 			snapshot := *v
-			getBody = func() io.ReadCloser {
+			getBody = func() (io.ReadCloser, error) {
 				r := snapshot
-				return io.NopCloser(&r)
+				return io.NopCloser(&r), nil
 			}
 
 		default:
-			return errors.New("unsupported body reader")
+			if req.maxBufferedBody == 0 {
+				return errors.New("unsupported body reader")
+			}
+
+			// Buffer the body in memory so it can be replayed. Read one extra byte to detect oversized bodies.
+			buf, err := io.ReadAll(io.LimitReader(req.body, req.maxBufferedBody+1))
+			if err != nil {
+				return c.newError(err, errUnableToReadBody, req.url, 0)
+			}
+			if int64(len(buf)) > req.maxBufferedBody {
+				return ErrBodyTooLarge
+			}
+			getBody = func() (io.ReadCloser, error) {
+				r := bytes.NewReader(buf)
+				return io.NopCloser(r), nil
+			}
 		}
 	}
 
-	// Initialize retry counter
+	// Stick to the session source, if any
+	if req.session != nil && req.pinnedSourceID == 0 {
+		if id := req.session.SourceID(req.pool); id > 0 {
+			req.pinnedSourceID = id
+			req.pinFallback = true
+		}
+	}
+
+	// Establish the overall deadline, if any, shared by all attempts
+	execCtx := req.ctx
+	if req.overallDeadline > 0 {
+		var cancelExecCtx context.CancelFunc
+
+		execCtx, cancelExecCtx = context.WithTimeout(req.ctx, req.overallDeadline)
+		defer cancelExecCtx()
+	}
+
+	// Initialize retry and skipped sources counters
 	retryCounter := 0
+	skipCounter := 0
+	maxSkips := selectionCycle(lb)
+
+	// Track the sources tried if they must not be repeated
+	var tried map[int]struct{}
+	var attemptErrs []error
+	if req.retryDistinct {
+		tried = make(map[int]struct{})
+	}
+
+	// Track the source and path pairs visited if retry loops must be detected
+	var visited map[string]struct{}
+	if req.detectLoops {
+		visited = make(map[string]struct{})
+	}
+
+	// Get the retry decisions forced by tests, if any
+	forcedRetries := forcedRetriesFromContext(req.ctx)
+
+	// Give the retry policy a fresh state if it tracks the retries of each request
+	retryPolicy := req.retryPolicy
+	if scoped, ok := retryPolicy.(requestScopedPolicy); ok {
+		retryPolicy = scoped.forRequest()
+	}
 
 	// Loop
+	var selectStart time.Time
 	for {
 		var netErr net.Error
 
-		// Get next available server
-		srv := c.lb.Next()
+		// Don't select a server nor send a doomed request if the context is already done
+		if ctxErr := execCtx.Err(); ctxErr != nil {
+			return contextError(ctxErr)
+		}
+
+		// Get next available server, waiting for one if requested
+		if selectStart.IsZero() {
+			selectStart = time.Now()
+		}
+		srv, release := c.selectServer(lb, req)
+		if srv == nil && req.maxWait > 0 {
+			srv, release = c.waitServer(execCtx, lb, req, selectStart.Add(req.maxWait))
+		}
 		if srv == nil {
+			if ctxErr := execCtx.Err(); ctxErr != nil {
+				return contextError(ctxErr)
+			}
 			return c.newError(nil, errNoAvailableServer, req.url, 0)
 		}
 
 		src := srv.UserData().(*Source)
 
+		// Skip the sources already tried, if requested
+		if tried != nil {
+			if _, ok := tried[src.id]; ok {
+				release()
+				skipCounter += 1
+				if skipCounter >= maxSkips {
+					return newAttemptsError(attemptErrs)
+				}
+				continue
+			}
+		}
+
 		// Create the final url
-		url := src.baseURL + req.url
+		var url string
+		url, err = joinURL(src.baseURL, "", req.url)
+		if err != nil {
+			release()
+			return c.newError(err, errInvalidURL, req.url, 0)
+		}
 
 		// Create a new http request
-		httpReq, err = http.NewRequest(req.method, url, getBody())
+		var body io.ReadCloser
+		body, err = getBody()
+		if err != nil {
+			release()
+			return c.newError(err, errUnableToReadBody, url, 0)
+		}
+		httpReq, err = http.NewRequest(req.method, url, body)
 		if err != nil {
+			if body != nil {
+				_ = body.Close()
+			}
+			release()
 			err = c.newError(err, errUnableToExecuteRequest, url, 0)
 			src.setLastError(err)
 			return err
 		}
 
-		// Add load balancer source headers
-		httpReq.Header = src.header.Clone()
-
-		// Add request headers
-		if req.headers != nil {
-			for k, v := range req.headers {
-				vLen := len(v)
-				if vLen > 0 {
-					httpReq.Header.Set(k, v[0])
-					for vIdx := 1; vIdx < vLen; vIdx++ {
-						httpReq.Header.Add(k, v[vIdx])
+		// Add client default headers, load balancer source headers and then request headers, each one overriding the
+		// previous ones
+		httpReq.Header = c.sourceHeaders(src)
+		mergeHeaders(httpReq.Header, req.headers)
+
+		// Let the preflight hook inspect the request and decide whether to use this source
+		if c.preflightHook != nil {
+			err = c.preflightHook(src, httpReq)
+			if err != nil {
+				if httpReq.Body != nil {
+					_ = httpReq.Body.Close()
+				}
+				release()
+				if errors.Is(err, ErrSkipSource) {
+					// Avoid looping forever if all sources are skipped
+					skipCounter += 1
+					if skipCounter >= maxSkips {
+						return c.newError(nil, errNoAvailableServer, req.url, 0)
 					}
+					continue
+				}
+				return c.newError(err, errPreflightFailed, url, 0)
+			}
+
+			// The hook may have rewritten the url
+			url = httpReq.URL.String()
+		}
+
+		// Abort if the request is going back to an already visited source and path
+		if visited != nil {
+			key := visitKey(src, httpReq.URL)
+			if _, ok := visited[key]; ok {
+				if httpReq.Body != nil {
+					_ = httpReq.Body.Close()
+				}
+				release()
+				return c.newError(ErrRetryLoop, errRetryLoopDetected, url, 0)
+			}
+			visited[key] = struct{}{}
+		}
+
+		// We are going to use this source
+		skipCounter = 0
+		if tried != nil {
+			tried[src.id] = struct{}{}
+		}
+		waitTime := time.Since(selectStart)
+		selectStart = time.Time{}
+		src.connStats.recordWait(waitTime)
+
+		// Send a conditional request if we have the response cached
+		cachedEntry := c.prepareCachedRequest(httpReq, url)
+
+		// Sign the request once it is complete
+		if c.signingHook != nil {
+			if body != nil {
+				httpReq.GetBody = getBody
+			}
+			err = c.signingHook(httpReq)
+			if err != nil {
+				if httpReq.Body != nil {
+					_ = httpReq.Body.Close()
 				}
+				release()
+				return c.newError(err, errSigningFailed, url, 0)
 			}
 		}
 
 		// Create http client requester
 		client := http.Client{
-			Transport: c.transport,
+			Transport:     c.transportFor(src),
+			CheckRedirect: c.checkRedirectFunc(req),
 		}
 
 		// Build callback info
 		upstreamOffline := false
+		offlineFor := time.Duration(0)
 		retry := false
 		execResult := Response{
 			fullUrl:         url,
 			source:          src,
 			retryCount:      retryCounter,
+			waitTime:        waitTime,
 			upstreamOffline: &upstreamOffline,
+			offlineFor:      &offlineFor,
 			retry:           &retry,
 		}
 
 		// Establish a new context with the timeout
-		ctx, cancelCtx := context.WithTimeout(req.ctx, req.timeout)
+		// NOTE: Derived from the overall context so it never exceeds the overall deadline
+		ctx, cancelCtx := context.WithTimeout(execCtx, req.attemptTimeout(execCtx, retryCounter))
+
+		// Store the attempt details so middlewares and callbacks can retrieve them
+		attemptStart := time.Now()
+		ctx = contextWithAttemptInfo(ctx, &AttemptInfo{
+			Source:     src,
+			RetryCount: retryCounter,
+			StartTime:  attemptStart,
+			Tag:        req.tag,
+		})
+
+		// Track the connection events and the time to first byte of this source
+		ctx = httptrace.WithClientTrace(ctx, src.clientTrace(attemptStart))
 
 		// Execute real request
+		networkFailure := false
 		execResult.Response, err = client.Do(httpReq.WithContext(ctx))
 		if err != nil {
-			if errors.Is(err, context.DeadlineExceeded) {
+			if ctxErr := req.ctx.Err(); ctxErr != nil {
+				// The caller canceled the request, don't blame the server
+				err = contextError(ctxErr)
+			} else if errors.Is(err, context.DeadlineExceeded) {
 				// Deadline exceeded?
 				err = ErrTimeout
 			} else if errors.As(err, &netErr) && netErr.Timeout() {
 				// Network timeout?
-				srv.SetOffline()
+				srv.AddFailure(c.failureWeight(FailureTimeout, err))
+				networkFailure = true
 
 				err = ErrTimeout
 			} else if errors.Is(err, context.Canceled) {
 				// Canceled?
 				err = ErrCanceled
+			} else if errors.Is(err, ErrRedirectLoop) {
+				// The servers redirect to each other, don't count it as a network failure
+				err = c.newError(ErrRedirectLoop, errRedirectLoopDetected, url, 0)
 			} else {
 				// Other type of error
-				srv.SetOffline()
+				srv.AddFailure(c.failureWeight(FailureConnection, err))
+				networkFailure = true
 
 				err = c.newError(err, errUnableToExecuteRequest, url, 0)
 			}
 		}
 
+		// Check the response cache
+		if execResult.Response != nil {
+			execResult.Response, execResult.fromCache = c.processCachedResponse(
+				httpReq, execResult.Response, url, cachedEntry,
+			)
+		}
+
+		// Enforce the response size limit
+		if execResult.Response != nil && req.maxResponseSize > 0 {
+			execResult.Body = &limitedReadCloser{
+				rc:        execResult.Body,
+				remaining: req.maxResponseSize,
+			}
+		}
+
+		// Parse the retry delay suggested by the server, if any
+		if execResult.Response != nil {
+			execResult.retryAfter = parseRetryAfter(execResult.Response.Header.Get("Retry-After"), time.Now())
+		}
+
+		// Count unhealthy status codes as a server failure
+		if err == nil && c.isUnhealthyStatus(execResult.StatusCode) {
+			upstreamOffline = true
+		}
+
+		// Read the whole body, if requested, so trailers are available to the callback
+		slowBody := false
+		if req.needTrailers && err == nil && execResult.Response != nil {
+			var b []byte
+
+			originalBody := execResult.Body
+			b, err = execResult.readBody(req.bufferedResponseLimit())
+			_ = originalBody.Close()
+			execResult.Body = io.NopCloser(bytes.NewReader(b))
+			if err != nil {
+				slowBody = isTimeoutError(err) && req.ctx.Err() == nil
+				err = c.newError(err, errUnableToReadResponseBody, url, execResult.StatusCode)
+			}
+		}
+
 		// Set error in callback
 		execResult.err = err
 
 		// Call the callback
-		err = req.callback(ctx, execResult)
-		if err != nil {
+		var callbackPanic interface{}
+		callbackPanic, err = invokeCallback(req.callback, ctx, execResult)
+		if callbackPanic != nil {
+			// Mark the attempt as failed and don't retry
+			err = c.newError(fmt.Errorf("%w: %v", ErrCallbackPanic, callbackPanic), errCallbackPanicked, url, 0)
+			retry = false
+		} else if err != nil {
 			if errors.Is(err, context.DeadlineExceeded) {
 				err = ErrTimeout
 			} else if errors.As(err, &netErr) && netErr.Timeout() {
@@ -168,31 +439,167 @@ func (c *HttpClient) exec(req *Request) error {
 			} else if errors.Is(err, context.Canceled) {
 				err = ErrCanceled
 			}
+
+			// A timeout after the response headers arrived means the body is being streamed slowly
+			if err == ErrTimeout && execResult.Response != nil && execResult.err == nil && req.ctx.Err() == nil {
+				slowBody = true
+			}
 		}
 
-		// To avoid defer calling inside a for loop and warnings, we call it here
-		cancelCtx()
+		// Slow bodies are only counted as a server failure if the classifier says so
+		if slowBody && !networkFailure {
+			if weight := c.failureWeight(FailureSlowBody, err); weight > 0 {
+				srv.AddFailure(weight)
+				networkFailure = true
+			}
+		}
 
 		// Close the response body if one exist
+		// NOTE: The transport only reuses the connection if the body was fully read, so drain small leftovers.
+		//       All requests share the same transport, so connections to the same source are pooled.
 		if execResult.Response != nil {
+			_, _ = io.CopyN(io.Discard, execResult.Response.Body, maxDrainBodySize)
 			_ = execResult.Response.Body.Close()
 		}
 
+		// To avoid defer calling inside a for loop and warnings, we call it here
+		// NOTE: Must be called after closing the body or the connection will not be reused
+		cancelCtx()
+
+		// The request is no longer in progress
+		release()
+
 		// Set the last error (even success)
 		src.setLastError(err)
 
 		// Raise callback
-		c.raiseRequestEvent(srv, err)
+		c.raiseRequestEvent(srv, req, err)
+
+		// If the callback panicked, re-panic now the resources are released or return the error
+		if callbackPanic != nil {
+			if !c.recoverPanics {
+				panic(callbackPanic)
+			}
+			break
+		}
+
+		// Blame the server for the attempts canceled by the caller, if requested
+		if req.offlineOnCancel && errors.Is(req.ctx.Err(), context.Canceled) {
+			upstreamOffline = true
+		}
 
 		// Set server online/offline based on the callback response
-		if !upstreamOffline {
-			srv.SetOnline()
-		} else {
-			srv.SetOffline()
+		// NOTE: Network errors were already accounted using the failure classifier
+		if offlineFor > 0 {
+			srv.SetOfflineFor(offlineFor)
+		} else if !networkFailure {
+			if !upstreamOffline {
+				srv.SetOnline()
+			} else {
+				srv.SetOffline()
+			}
+		}
+
+		// Notify the first successful contact with the source
+		if err == nil && !upstreamOffline {
+			c.confirmSource(src)
+		}
+
+		// Keep the session stuck to this source while it works
+		if req.session != nil && !errors.Is(err, ErrCanceled) {
+			req.session.update(src, err == nil && !upstreamOffline)
+		}
+
+		// Remember if the callback asked for a retry, it may have skipped processing the response
+		callbackRetry := retry
+
+		// Fail over on the status codes set for the request while there are sources not tried yet
+		if !retry && err == nil && req.isRetryStatus(execResult.StatusCode) &&
+			retryCounter+1 < c.poolSourcesCount(req.pool) {
+			retry = true
+		}
+
+		// If the callback did not ask for a retry, consult the retry policy
+		retryDelay := time.Duration(0)
+		if !retry && retryPolicy != nil {
+			retry, retryDelay = retryPolicy.ShouldRetry(retryCounter, execResult.Response, err)
+		}
+
+		// Apply the decisions forced through the context, if any
+		if retryCounter < len(forcedRetries) {
+			retry = forcedRetries[retryCounter]
+		}
+
+		// Requests sent once per source, like the broadcasted ones, are never retried
+		if req.singleAttempt {
+			retry = false
 		}
 
 		// Should we retry on next server?
 		if !retry {
+			if callbackRetry {
+				err = c.abandonedRetryError(err, &execResult, nil)
+			}
+			break
+		}
+
+		// Stop immediately if the caller canceled the request
+		if ctxErr := req.ctx.Err(); ctxErr != nil {
+			err = contextError(ctxErr)
+			break
+		}
+
+		// Stop retrying if the overall deadline was exceeded
+		if req.overallDeadline > 0 && errors.Is(execCtx.Err(), context.DeadlineExceeded) {
+			err = ErrTimeout
+			break
+		}
+
+		// Give up if all the sources were tried and they must not be repeated
+		if tried != nil {
+			if err != nil {
+				attemptErrs = append(attemptErrs, err)
+			} else if execResult.err != nil {
+				attemptErrs = append(attemptErrs, execResult.err)
+			}
+			if len(tried) >= c.poolSourcesCount(req.pool) {
+				err = newAttemptsError(attemptErrs)
+				break
+			}
+		}
+
+		// Stop retrying if the retry budget is exhausted
+		if c.retryBudget != nil && !req.probe && !c.retryBudget.allowRetry() {
+			c.callEventHandler(RequestRetryThrottledEvent, src.ID(), ErrRetryBudgetExhausted)
+			if callbackRetry {
+				err = c.abandonedRetryError(err, &execResult, ErrRetryBudgetExhausted)
+			}
+			break
+		}
+
+		// Notify we are abandoning this server and retrying on the next one
+		c.raiseRetryEvent(srv, req, err)
+
+		// Honor the delay requested by the server on throttling or unavailability responses
+		if execResult.retryAfter > retryDelay && isThrottlingStatus(execResult.StatusCode) {
+			retryDelay = execResult.retryAfter
+		}
+
+		// Consult the backoff schedule, if any
+		if req.backoff != nil {
+			if d := req.backoff.Next(retryCounter); d > retryDelay {
+				retryDelay = d
+			}
+		}
+
+		// A preferred source is only tried once
+		if req.pinFallback {
+			req.pinnedSourceID = 0
+		}
+
+		// Wait before the next attempt
+		err = waitWithContext(execCtx, retryDelay)
+		if err != nil {
 			break
 		}
 
@@ -203,3 +610,19 @@ func (c *HttpClient) exec(req *Request) error {
 	// Done
 	return err
 }
+
+// abandonedRetryError returns the error of an attempt the callback asked to retry, but was not retried, so it is not
+// reported as a success because the callback did not process the response
+func (c *HttpClient) abandonedRetryError(err error, res *Response, cause error) error {
+	if err != nil {
+		return err
+	}
+	if res.err != nil {
+		return res.err
+	}
+	statusCode := 0
+	if res.Response != nil {
+		statusCode = res.StatusCode
+	}
+	return c.newError(cause, errRetryNotDone, res.fullUrl, statusCode)
+}
@@ -0,0 +1,164 @@
+// See the LICENSE file for license details.
+
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+const (
+	defaultHealthCheckTimeout = 5 * time.Second
+)
+
+// -----------------------------------------------------------------------------
+
+// HealthCheckOptions specifies how sources are actively probed.
+type HealthCheckOptions struct {
+	// Path is the resource to request on each source. Defaults to the root path.
+	Path string
+
+	// Interval sets the time between probes while the source is online.
+	Interval time.Duration
+
+	// OfflineInterval sets the time between probes while the source is offline, so a known dead backend is not
+	// hammered. Defaults to four times Interval. Once the source recovers, probes continue at the normal Interval.
+	OfflineInterval time.Duration
+
+	// OfflineMultiplier makes the time between probes of an offline source to grow exponentially, starting at
+	// OfflineInterval and being multiplied by this factor after each failed probe, for e.g., 1s, 2s, 4s and so on
+	// with a factor of 2. It is reset once the source recovers. Values of 1 or less, the default, keep it constant.
+	OfflineMultiplier float64
+
+	// MaxOfflineInterval limits the time between probes of an offline source when OfflineMultiplier is set. Zero
+	// means no limit.
+	MaxOfflineInterval time.Duration
+
+	// Timeout sets the maximum time a probe can take. Defaults to 5 seconds.
+	Timeout time.Duration
+}
+
+// -----------------------------------------------------------------------------
+
+// StartHealthCheck starts actively probing all sources. A successful probe (2xx status code) puts the source back
+// online and a failed one counts as a source failure. Probes are stopped by calling Close.
+func (c *HttpClient) StartHealthCheck(opts HealthCheckOptions) error {
+	if opts.Interval <= 0 || opts.OfflineInterval < 0 || opts.OfflineMultiplier < 0 || opts.MaxOfflineInterval < 0 ||
+		opts.Timeout < 0 {
+		return errors.New("invalid parameter")
+	}
+	if len(opts.Path) == 0 {
+		opts.Path = "/"
+	}
+	if opts.OfflineInterval == 0 {
+		opts.OfflineInterval = 4 * opts.Interval
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultHealthCheckTimeout
+	}
+
+	if c.healthCheckOpts != nil {
+		return errors.New("health check already started")
+	}
+	c.healthCheckOpts = &opts
+
+	// Start a checker for each source
+	for _, src := range c.sources {
+		c.startSourceHealthCheck(src)
+	}
+
+	// Done
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+func (c *HttpClient) startSourceHealthCheck(src *Source) {
+	opts := *c.healthCheckOpts
+
+	c.bgWg.Add(1)
+	go func() {
+		defer c.bgWg.Done()
+
+		failedProbes := 0
+		for {
+			// Offline sources are probed less frequently
+			interval := opts.Interval
+			isOffline := !src.IsOnline()
+			if isOffline {
+				interval = opts.offlineInterval(failedProbes)
+			} else {
+				failedProbes = 0
+			}
+
+			timer := time.NewTimer(interval)
+			select {
+			case <-c.stopCh:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			if c.probeSource(src, opts) {
+				src.srv.SetOnline()
+				c.confirmSource(src)
+			} else {
+				src.srv.SetOffline()
+
+				// Back off while the source remains offline
+				if isOffline {
+					failedProbes += 1
+				}
+			}
+		}
+	}()
+}
+
+// offlineInterval returns the time to wait before probing an offline source after the given number of failed probes
+func (opts *HealthCheckOptions) offlineInterval(failedProbes int) time.Duration {
+	d := float64(opts.OfflineInterval)
+	if opts.OfflineMultiplier > 1 {
+		d *= math.Pow(opts.OfflineMultiplier, float64(failedProbes))
+	}
+	if opts.MaxOfflineInterval > 0 && d > float64(opts.MaxOfflineInterval) {
+		return opts.MaxOfflineInterval
+	}
+	if d >= math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(d)
+}
+
+func (c *HttpClient) probeSource(src *Source, opts HealthCheckOptions) bool {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancelCtx()
+
+	url, err := joinURL(src.baseURL, "", opts.Path)
+	if err != nil {
+		return false
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return false
+	}
+	httpReq.Header = c.sourceHeaders(src)
+
+	client := http.Client{
+		Transport: c.transportFor(src),
+	}
+	res, err := client.Do(httpReq)
+	if err != nil {
+		return false
+	}
+	_, _ = io.Copy(io.Discard, res.Body)
+	_ = res.Body.Close()
+
+	// Done
+	return res.StatusCode >= 200 && res.StatusCode < 300
+}
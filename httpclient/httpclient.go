@@ -3,10 +3,11 @@
 package httpclient
 
 import (
+	"encoding/json"
 	"errors"
 	"net/http"
 	"regexp"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/mxmauro/go-loadbalancer/v2"
@@ -14,26 +15,73 @@ import (
 
 // -----------------------------------------------------------------------------
 
+const (
+	defaultPool = ""
+)
+
 const (
 	ServerUpEvent int = iota + 1
 	ServerDownEvent
 	RequestSucceededEvent
 	RequestFailedEvent
+	RequestRetryEvent
+	RequestShortCircuitedEvent
+	SourceConfirmedEvent
+	RequestRetryThrottledEvent
+)
+
+// FailureKind classifies the network errors that count as a server failure.
+type FailureKind int
+
+const (
+	// FailureTimeout is a network timeout while connecting or waiting for the server response.
+	FailureTimeout FailureKind = iota + 1
+
+	// FailureConnection is any other network error like a refused or reset connection.
+	FailureConnection
+
+	// FailureSlowBody is a timeout while reading the response body after the headers were received, for e.g., a
+	// server streaming a large body slowly. Unlike the others, it is not counted by default.
+	FailureSlowBody
 )
 
 // -----------------------------------------------------------------------------
 
 var ErrCanceled = errors.New("canceled")
 var ErrTimeout = errors.New("timeout")
+var ErrBodyTooLarge = errors.New("body too large")
+var ErrResponseTooLarge = errors.New("response too large")
+var ErrCallbackPanic = errors.New("callback panic")
+var ErrSkipSource = errors.New("skip source")
+var ErrEmptyBody = errors.New("empty body")
 
 // -----------------------------------------------------------------------------
 
 // HttpClient is a load-balancer http client requester object.
 type HttpClient struct {
-	lb            *loadbalancer.LoadBalancer
-	transport    *http.Transport
-	sources      []*Source
-	eventHandler EventHandler
+	lb              *loadbalancer.LoadBalancer
+	pools           map[string]*loadbalancer.LoadBalancer
+	transportMtx    sync.RWMutex
+	transport       *http.Transport
+	sources         []*Source
+	defaultHeader   http.Header
+	eventHandler    EventHandler
+	preflightHook   PreflightHook
+	signingHook     SigningHook
+	classifier      FailureClassifier
+	healthStore     loadbalancer.HealthStore
+	comparator      loadbalancer.Comparator
+	unhealthyStatus map[int]struct{}
+	healthCheckOpts *HealthCheckOptions
+	breaker         *circuitBreaker
+	retryBudget     *retryBudget
+	adaptiveWeights *adaptiveWeights
+	cache           CacheStore
+	recoverPanics   bool
+	defaultTimeout  time.Duration
+	stopCh          chan struct{}
+	closeOnce       sync.Once
+	bgWg            sync.WaitGroup
 }
 
 // SourceState indicates the state of a server.
@@ -42,10 +90,63 @@ type SourceState struct {
 	IsOnline  bool
 	LastError error
 	IsBackup  bool
+	Pool      string
+
+	// Most recent errors, oldest first
+	Errors []ErrorRecord
+
+	// Indicates if the source was successfully contacted at least once
+	IsConfirmed bool
+
+	// Request counters keyed by the tag set with Request.Tag
+	TagStats map[string]TagStats
+
+	// Transport-level connection counters
+	ConnStats ConnStats
+
+	// Time to first byte of the last request and its moving average
+	TTFB    time.Duration
+	AvgTTFB time.Duration
+
+	// Time the last request waited for an available server and its moving average
+	WaitTime    time.Duration
+	AvgWaitTime time.Duration
+
+	// Current weight, lower than the configured one while adaptive weights reduce it
+	Weight int
+
+	// Number of requests in progress on this source at the time the state was retrieved
+	InFlight int
+}
+
+// DownSourceInfo contains the details of an offline source.
+type DownSourceInfo struct {
+	ID          int
+	BaseURL     string
+	Pool        string
+	LastError   error
+	FailCounter float64
+
+	// Time when the source will be considered online again
+	RecoveryTime time.Time
+
+	// Remaining time until recovery. Zero if it is already due and will be put online on the next selection
+	RecoveryIn time.Duration
 }
 
 type EventHandler func(eventType int, sourceId int, err error)
 
+// FailureClassifier returns how much a network error of the given kind counts towards the MaxFails of the source.
+// Zero means the error is not counted.
+type FailureClassifier func(kind FailureKind, err error) float64
+
+// SigningHook is a handler called right before each attempt is sent, once all the headers and the body are set, to
+// sign the request. The request body can be read with the GetBody function of the request.
+type SigningHook func(req *http.Request) error
+
+// PreflightHook is a handler called once a source is selected and before the request is sent to it.
+type PreflightHook func(src *Source, req *http.Request) error
+
 // -----------------------------------------------------------------------------
 
 // Create creates a load-balanced http client requester object.
@@ -63,18 +164,81 @@ func Create() *HttpClient {
 // CreateWithTransport creates a load-balanced http client requester object that uses the specified transport.
 func CreateWithTransport(transport *http.Transport) *HttpClient {
 	c := HttpClient{
-		lb:        loadbalancer.Create(),
-		transport: transport.Clone(),
-		sources:   make([]*Source, 0),
+		lb:             loadbalancer.Create(),
+		transportMtx:   sync.RWMutex{},
+		transport:      transport.Clone(),
+		pools:          make(map[string]*loadbalancer.LoadBalancer),
+		sources:        make([]*Source, 0),
+		defaultTimeout: defaultTimeout,
+		stopCh:         make(chan struct{}),
+		closeOnce:      sync.Once{},
+		bgWg:           sync.WaitGroup{},
 	}
 	c.lb.SetEventHandler(c.balancerEventHandler)
+	c.pools[defaultPool] = c.lb
 
 	// Done
 	return &c
 }
 
+// Clone creates a new client with the same sources, headers, hooks and policies but using the specified transport.
+// The balancing state is not shared, so all sources start online, and the circuit breaker starts closed. Background
+// tasks like health checks are not started on the new client. If a cache store was set, it is shared.
+func (c *HttpClient) Clone(transport *http.Transport) *HttpClient {
+	nc := CreateWithTransport(transport)
+	nc.defaultHeader = c.defaultHeader.Clone()
+	nc.eventHandler = c.eventHandler
+	nc.preflightHook = c.preflightHook
+	nc.signingHook = c.signingHook
+	nc.classifier = c.classifier
+	nc.SetHealthStore(c.healthStore)
+	nc.comparator = c.comparator
+	if nc.comparator != nil {
+		nc.lb.SetComparator(nc.comparator)
+	}
+	nc.unhealthyStatus = c.unhealthyStatus
+	nc.cache = c.cache
+	nc.recoverPanics = c.recoverPanics
+	nc.defaultTimeout = c.defaultTimeout
+	if c.breaker != nil {
+		opts := c.breaker.opts
+		_ = nc.SetCircuitBreaker(&opts)
+	}
+	if c.retryBudget != nil {
+		opts := c.retryBudget.opts
+		_ = nc.SetRetryBudget(&opts)
+	}
+	if c.adaptiveWeights != nil {
+		opts := c.adaptiveWeights.opts
+		_ = nc.SetAdaptiveWeights(&opts)
+	}
+
+	// Add the same sources, in order, so they keep their IDs
+	for _, src := range c.sources {
+		_ = nc.AddSourceToPool(src.pool, src.baseURL, src.headers(), src.opts)
+
+		src.proxyMtx.Lock()
+		proxyURL := src.proxyURL
+		src.proxyMtx.Unlock()
+		if proxyURL != nil {
+			_ = nc.SetSourceProxy(src.id, proxyURL)
+		}
+	}
+
+	// Done
+	return nc
+}
+
 // AddSource adds a new source to the load-balanced http client object.
 func (c *HttpClient) AddSource(baseURL string, header http.Header, opts loadbalancer.ServerOptions) error {
+	return c.AddSourceToPool(defaultPool, baseURL, header, opts)
+}
+
+// AddSourceToPool adds a new source to the specified pool of the load-balanced http client object. Each pool is
+// balanced independently but all of them share the same transport. The pool is created if it does not exist.
+func (c *HttpClient) AddSourceToPool(
+	pool string, baseURL string, header http.Header, opts loadbalancer.ServerOptions,
+) error {
 	// Check base url
 	match, _ := regexp.MatchString(`https?://([^:/?#]+)(:\d+)?/?$`, baseURL)
 	if !match {
@@ -82,24 +246,156 @@ func (c *HttpClient) AddSource(baseURL string, header http.Header, opts loadbala
 	}
 
 	// Remove trailing slash
-	baseURL = strings.TrimSuffix(baseURL, "/")
+	baseURL = normalizeBaseURL(baseURL)
+
+	// Reject duplicated sources in the same pool because they would skew the load distribution
+	for _, src := range c.sources {
+		if src.pool == pool && src.baseURL == baseURL {
+			return errors.New("duplicate base url")
+		}
+	}
 
 	// Add source to list
-	src := newSource(len(c.sources) + 1, baseURL, header, opts.IsBackup)
+	src := newSource(len(c.sources)+1, baseURL, header, opts, pool)
 	c.sources = append(c.sources, src)
 
+	// Get the pool load balancer, creating it if needed
+	lb, ok := c.pools[pool]
+	if !ok {
+		lb = loadbalancer.Create()
+		lb.SetEventHandler(c.balancerEventHandler)
+		lb.SetHealthStore(c.healthStore)
+		if c.comparator != nil {
+			lb.SetComparator(c.comparator)
+		}
+	}
+
+	// Identify the server by its base url if no name was given
+	if len(opts.Name) == 0 {
+		opts.Name = baseURL
+	}
+
 	// Add source to the load balancer
-	err := c.lb.Add(opts, src)
+	err := lb.Add(opts, src)
 	if err != nil {
 		// On error, remove the source from the source list
-		c.sources = c.sources[0:len(c.sources)-1]
+		c.sources = c.sources[0 : len(c.sources)-1]
 		return err
 	}
 
+	// Register the new pool only once it has a source, so a failed addition does not leave an empty one
+	if !ok {
+		c.pools[pool] = lb
+	}
+
+	// Keep a reference to the balancer server backing this source
+	servers := lb.Servers()
+	for _, srv := range servers {
+		if srv.UserData() == src {
+			src.srv = srv
+			break
+		}
+	}
+
+	// Start probing it if health checks are running
+	if c.healthCheckOpts != nil {
+		c.startSourceHealthCheck(src)
+	}
+
 	// Done
 	return nil
 }
 
+// StartIdleConnPurge starts a background task that periodically closes the idle connections of the transports, so
+// connections to ephemeral or no longer used backends do not pile up. The task is stopped by calling Close.
+func (c *HttpClient) StartIdleConnPurge(interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("invalid parameter")
+	}
+
+	c.bgWg.Add(1)
+	go func() {
+		defer c.bgWg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.stopCh:
+				return
+			case <-ticker.C:
+				c.closeIdleConnections()
+			}
+		}
+	}()
+
+	// Done
+	return nil
+}
+
+// StartRecoveryCheck starts a background task that periodically puts online again the sources whose offline period
+// expired, so ServerUpEvent is raised even if there is no traffic. The task is stopped by calling Close.
+func (c *HttpClient) StartRecoveryCheck(interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("invalid parameter")
+	}
+
+	c.bgWg.Add(1)
+	go func() {
+		defer c.bgWg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.stopCh:
+				return
+			case <-ticker.C:
+				for _, lb := range c.pools {
+					lb.Recover()
+				}
+			}
+		}
+	}()
+
+	// Done
+	return nil
+}
+
+// Close stops all background tasks like health checks and idle connection purging. The client can still be used to
+// make requests.
+func (c *HttpClient) Close() {
+	c.closeOnce.Do(func() {
+		close(c.stopCh)
+	})
+	c.bgWg.Wait()
+}
+
+// SetRecoverCallbackPanics sets how panics inside execution callbacks are handled. In all cases, the response body
+// is closed and the attempt is marked as failed. Then, by default, the panic is propagated to the Exec caller. If
+// enabled, Exec returns an error wrapping ErrCallbackPanic instead.
+func (c *HttpClient) SetRecoverCallbackPanics(enable bool) {
+	c.recoverPanics = enable
+}
+
+// Balancer returns the load balancer backing the default pool, for e.g., to take snapshots, subscribe to health
+// updates or change weights directly. See PoolBalancer.
+func (c *HttpClient) Balancer() *loadbalancer.LoadBalancer {
+	return c.lb
+}
+
+// PoolBalancer returns the load balancer backing the specified pool or nil if the pool does not exist.
+//
+// The balancer is shared with the client, so changes apply to the requests in progress, for e.g., a server put
+// offline is not used by the next attempts but the current ones are not interrupted, and the client keeps updating
+// the state of the servers as requests complete. Servers must only be added with AddSource or AddSourceToPool
+// because the client expects the user data of each server to be its source.
+func (c *HttpClient) PoolBalancer(pool string) *loadbalancer.LoadBalancer {
+	return c.pools[pool]
+}
+
 // SourcesCount retrieves the number of sources
 func (c *HttpClient) SourcesCount() int {
 	return len(c.sources)
@@ -110,22 +406,238 @@ func (c *HttpClient) SourceState(index int) *SourceState {
 	if index < 0 || index >= len(c.sources) {
 		return nil
 	}
-	ss := SourceState{
-		BaseURL:   c.sources[index].BaseURL(),
-		IsOnline:  c.sources[index].IsOnline(),
-		LastError: c.sources[index].Err(),
-		IsBackup:  c.sources[index].IsBackup(),
-	}
+	ss := c.sources[index].state()
 	return &ss
 }
 
+// AllSourceStates retrieves the details of all sources, in index order, and the number of online ones. The online
+// status of the sources of each pool is taken from a single balancer snapshot, so counts add up even if servers
+// change their status meanwhile.
+func (c *HttpClient) AllSourceStates() ([]SourceState, int) {
+	// Take a snapshot of each pool
+	online := make(map[*loadbalancer.Server]bool, len(c.sources))
+	for _, lb := range c.pools {
+		snap := lb.Snapshot()
+		for _, ss := range snap.Servers {
+			online[ss.Server] = ss.IsOnline
+		}
+	}
+
+	// Build the source states
+	states := make([]SourceState, 0, len(c.sources))
+	onlineCount := 0
+	for _, src := range c.sources {
+		ss := src.state()
+		ss.IsOnline = online[src.srv]
+		if ss.IsOnline {
+			onlineCount += 1
+		}
+		states = append(states, ss)
+	}
+
+	// Done
+	return states, onlineCount
+}
+
+// DownSources retrieves the details of the offline sources, in index order.
+func (c *HttpClient) DownSources() []DownSourceInfo {
+	now := time.Now()
+
+	// Take a snapshot of each pool
+	down := make(map[*loadbalancer.Server]loadbalancer.ServerSnapshot)
+	for _, lb := range c.pools {
+		snap := lb.Snapshot()
+		for _, ss := range snap.Servers {
+			if !ss.IsOnline {
+				down[ss.Server] = ss
+			}
+		}
+	}
+
+	list := make([]DownSourceInfo, 0, len(down))
+	for _, src := range c.sources {
+		ss, ok := down[src.srv]
+		if !ok {
+			continue
+		}
+		info := DownSourceInfo{
+			ID:           src.id,
+			BaseURL:      src.baseURL,
+			Pool:         src.pool,
+			LastError:    src.Err(),
+			FailCounter:  ss.FailCounter,
+			RecoveryTime: ss.RecoveryTime,
+		}
+		if d := ss.RecoveryTime.Sub(now); d > 0 {
+			info.RecoveryIn = d
+		}
+		list = append(list, info)
+	}
+
+	// Done
+	return list
+}
+
 // SourceStateByID retrieves source details for the given source ID
 func (c *HttpClient) SourceStateByID(id int) *SourceState {
 	// Actually the ID is the index plus one
 	return c.SourceState(id - 1)
 }
 
-// SetEventHandler sets a new notification handler callback
+// SourceByURL retrieves source details for the given base url or nil if not found
+func (c *HttpClient) SourceByURL(baseURL string) *SourceState {
+	baseURL = normalizeBaseURL(baseURL)
+	for index, src := range c.sources {
+		if src.baseURL == baseURL {
+			return c.SourceState(index)
+		}
+	}
+	return nil
+}
+
+// ResetErrorHistory removes the recorded errors of all sources.
+func (c *HttpClient) ResetErrorHistory() {
+	for _, src := range c.sources {
+		src.ResetErrorHistory()
+	}
+}
+
+// SetEventHandler sets a new notification handler callback. The handler is called synchronously from the request
+// path, so keep it fast. Panics inside the handler are recovered and ignored.
 func (c *HttpClient) SetEventHandler(handler EventHandler) {
 	c.eventHandler = handler
 }
+
+// SetHealthStore sets the store used to share the offline state of the sources with other clients, for e.g.,
+// running in other instances of the service. Sources are identified by the ServerOptions.Name, which defaults to
+// their base url. Set to nil to keep the state local, the default behavior.
+func (c *HttpClient) SetHealthStore(store loadbalancer.HealthStore) {
+	c.healthStore = store
+	for _, lb := range c.pools {
+		lb.SetHealthStore(store)
+	}
+}
+
+// ExportState returns, encoded as JSON, the online/offline state and failure counters of the sources of all pools,
+// so it can be restored with ImportState, for e.g., after a restart. Sources are identified by their pool and the
+// ServerOptions.Name, which defaults to their base url.
+func (c *HttpClient) ExportState() []byte {
+	state := make(map[string]json.RawMessage, len(c.pools))
+	for pool, lb := range c.pools {
+		state[pool] = lb.ExportState()
+	}
+
+	// NOTE: Marshalling this structure cannot fail
+	b, _ := json.Marshal(state)
+	return b
+}
+
+// ImportState restores the state exported with ExportState. Unknown pools and sources are ignored.
+func (c *HttpClient) ImportState(data []byte) error {
+	var state map[string]json.RawMessage
+
+	err := json.Unmarshal(data, &state)
+	if err != nil {
+		return errors.New("invalid state")
+	}
+	for pool, poolState := range state {
+		if lb, ok := c.pools[pool]; ok {
+			err = lb.ImportState(poolState)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Done
+	return nil
+}
+
+// SetSourceComparator makes the sources to be selected with the ComparatorStrategy, picking, on each request, the
+// online source the less function prefers, for e.g., the one with the lowest ErrorRate, TTFB or InFlight. Pass nil
+// to go back to the weighted round-robin selection.
+// NOTE: The function is called while holding the load balancer lock, so it can only use the Source methods.
+func (c *HttpClient) SetSourceComparator(less func(a, b *Source) bool) {
+	c.comparator = nil
+	if less != nil {
+		c.comparator = func(a, b *loadbalancer.ServerSnapshot) bool {
+			return less(a.Server.UserData().(*Source), b.Server.UserData().(*Source))
+		}
+	}
+	for _, lb := range c.pools {
+		lb.SetComparator(c.comparator)
+	}
+}
+
+// SetFailureClassifier sets the handler that decides how much each network error counts towards the MaxFails of
+// a source, so, for e.g., timeouts on a flaky network don't put a healthy server offline prematurely. By default,
+// every network error counts as a full failure, except slow bodies, which are not counted. Set to nil to restore
+// the default behavior.
+// NOTE: Calling Response.SetOffline after a network error does not account another failure.
+func (c *HttpClient) SetFailureClassifier(classifier FailureClassifier) {
+	c.classifier = classifier
+}
+
+// SetPreflightHook sets a handler that is called after a source is selected and before the request is sent to it.
+// The hook can modify the request or return ErrSkipSource to select the next available source instead. Any other
+// error aborts the execution. Skipped sources are not counted as failed and don't consume retries.
+func (c *HttpClient) SetPreflightHook(hook PreflightHook) {
+	c.preflightHook = hook
+}
+
+// SetSigningHook sets a handler that signs each outgoing request, for e.g., to implement AWS SigV4 or HMAC schemes.
+// It runs on every attempt, after the preflight hook, so retries are signed again with a fresh timestamp. An error
+// aborts the execution.
+func (c *HttpClient) SetSigningHook(hook SigningHook) {
+	c.signingHook = hook
+}
+
+// SetTransport replaces the transport used by future requests. Useful, for e.g., to rotate client certificates
+// without recreating the client. Requests already in progress keep using the previous transport until they finish.
+func (c *HttpClient) SetTransport(transport *http.Transport) {
+	transport = transport.Clone()
+
+	c.transportMtx.Lock()
+	oldTransport := c.transport
+	c.transport = transport
+	c.transportMtx.Unlock()
+
+	// Release the idle connections of the previous transport. Active connections are not affected.
+	oldTransport.CloseIdleConnections()
+}
+
+// SetUnhealthyStatus sets the list of response status codes that are automatically counted as a server failure,
+// as if the callback had called Response.SetOffline. Call it without parameters to disable.
+func (c *HttpClient) SetUnhealthyStatus(codes ...int) {
+	unhealthyStatus := make(map[int]struct{}, len(codes))
+	for _, code := range codes {
+		unhealthyStatus[code] = struct{}{}
+	}
+	c.unhealthyStatus = unhealthyStatus
+}
+
+// SetSourceHeader sets the value of a header added to the requests sent to the source with the given ID. See
+// Source.SetHeader.
+func (c *HttpClient) SetSourceHeader(id int, key string, value string) error {
+	if id < 1 || id > len(c.sources) {
+		return errors.New("invalid source id")
+	}
+	c.sources[id-1].SetHeader(key, value)
+	return nil
+}
+
+// SetDefaultTimeout sets the timeout of the requests created afterwards by NewRequest. It can be overridden per
+// request with Request.Timeout. Defaults to 20 seconds.
+func (c *HttpClient) SetDefaultTimeout(d time.Duration) error {
+	if d <= 0 {
+		return errors.New("invalid parameter")
+	}
+	c.defaultTimeout = d
+	return nil
+}
+
+// SetDefaultHeaders sets the headers added to every request, like User-Agent or Accept. Source and request headers
+// with the same name override them.
+func (c *HttpClient) SetDefaultHeaders(header http.Header) {
+	c.defaultHeader = header.Clone()
+}
@@ -3,19 +3,28 @@
 package httpclient_test
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/mxmauro/go-loadbalancer/v2"
 	"github.com/mxmauro/go-loadbalancer/v2/httpclient"
+	"github.com/mxmauro/go-loadbalancer/v2/httpclient/httpclienttest"
 )
 
 // -----------------------------------------------------------------------------
@@ -201,6 +210,3162 @@ func TestHttpClientPostRetry(t *testing.T) {
 	}
 }
 
+func TestHttpClientSourceFromContext(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	err := hc.NewRequest(context.Background(), "/test").
+		Method("GET").
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			src := httpclient.SourceFromContext(ctx)
+			if src == nil {
+				return errors.New("source not found in context")
+			}
+			if src.ID() != res.SourceID() {
+				return errors.New("source mismatch")
+			}
+
+			// Done
+			return nil
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestHttpClientUnhealthyStatus(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	hc.SetUnhealthyStatus(http.StatusServiceUnavailable)
+
+	// Make the first server fail
+	server1.SetOffline(true)
+
+	err := hc.NewRequest(context.Background(), "/test").
+		Method("GET").
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			if res.StatusCode != http.StatusServiceUnavailable {
+				return fmt.Errorf("unexpected status code %v", res.StatusCode)
+			}
+
+			// Done
+			return nil
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// The first server must be offline now without the callback marking it
+	if hc.SourceState(0).IsOnline {
+		t.Fatal("expected source 1 to be offline")
+	}
+}
+
+func TestHttpClientHealthCheck(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	err := hc.StartHealthCheck(httpclient.HealthCheckOptions{
+		Path:            "/test",
+		Interval:        20 * time.Millisecond,
+		OfflineInterval: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer hc.Close()
+
+	// Make the first server fail and wait until the health check detects it
+	server1.SetOffline(true)
+	waitSourceOnlineState(t, hc, 0, false)
+
+	// Recover it and wait until the health check puts it online again
+	server1.SetOffline(false)
+	waitSourceOnlineState(t, hc, 0, true)
+}
+
+func TestHttpClientHealthCheckRequest(t *testing.T) {
+	probed := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case probed <- r.URL.Path + " " + r.Header.Get("User-Agent") + " " + r.Header.Get("X-Source"):
+		default:
+		}
+	}))
+	defer srv.Close()
+
+	hc := httpclient.Create()
+	hc.SetDefaultHeaders(http.Header{
+		"User-Agent": []string{"test-agent"},
+	})
+	err := hc.AddSource(srv.URL+"/", http.Header{
+		"X-Source": []string{"one"},
+	}, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	err = hc.StartHealthCheck(httpclient.HealthCheckOptions{
+		Path:     "health",
+		Interval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer hc.Close()
+
+	// The probe url is built like the one of regular requests and carries the same headers
+	select {
+	case probe := <-probed:
+		if probe != "/health test-agent one" {
+			t.Fatalf("unexpected probe [probe=%v]", probe)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the source was not probed")
+	}
+}
+
+func TestHttpClientBufferedBody(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	// A body reader that cannot be cloned must be buffered to be sent on each retry
+	err := hc.NewRequest(context.Background(), "/bodytest").
+		Method("POST").
+		Body(io.MultiReader(strings.NewReader("this is a "), strings.NewReader("sample body"))).
+		MaxBufferedBody(1024).
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			if res.StatusCode != 200 {
+				return fmt.Errorf("unexpected status code %v", res.StatusCode)
+			}
+			if res.RetryCount() == 0 {
+				res.RetryOnNextServer()
+				return nil
+			}
+
+			m := make(map[string]interface{})
+			err := json.NewDecoder(res.Body).Decode(&m)
+			if err != nil {
+				return err
+			}
+			if body, _ := m["received-body"].(string); body != "this is a sample body" {
+				return errors.New("received-body mismatch")
+			}
+
+			// Done
+			return nil
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Bodies larger than the limit must be rejected
+	err = hc.NewRequest(context.Background(), "/bodytest").
+		Method("POST").
+		Body(io.MultiReader(strings.NewReader("this is a sample body"))).
+		MaxBufferedBody(4).
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			return nil
+		}).
+		Exec()
+	if !errors.Is(err, httpclient.ErrBodyTooLarge) {
+		t.Fatalf("expected body too large error [err=%v]", err)
+	}
+}
+
+func TestHttpClientRetryEvent(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	retriedSources := make([]int, 0)
+	hc.SetEventHandler(func(eventType int, sourceId int, err error) {
+		if eventType == httpclient.RequestRetryEvent {
+			retriedSources = append(retriedSources, sourceId)
+		}
+	})
+
+	// Retry once on the next server
+	err := hc.NewRequest(context.Background(), "/test").
+		Method("GET").
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			if res.RetryCount() == 0 {
+				res.RetryOnNextServer()
+			}
+
+			// Done
+			return nil
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(retriedSources) != 1 || retriedSources[0] != 1 {
+		t.Fatalf("unexpected retry events %v", retriedSources)
+	}
+}
+
+func TestHttpClientOverallDeadline(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	// Retry forever but each attempt takes some time, so the overall deadline must be hit
+	err := hc.NewRequest(context.Background(), "/test").
+		Method("GET").
+		OverallDeadline(300 * time.Millisecond).
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			time.Sleep(50 * time.Millisecond)
+
+			// Retry on the next available server
+			res.RetryOnNextServer()
+
+			// Done
+			return nil
+		}).
+		Exec()
+	if !errors.Is(err, httpclient.ErrTimeout) {
+		t.Fatalf("expected timeout error [err=%v]", err)
+	}
+}
+
+func TestHttpClientPools(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	// Add a dedicated pool with the second server only
+	err := hc.AddSourceToPool("reads", server2.URL(), nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to pool [err=%v]", err.Error())
+	}
+
+	for idx := 0; idx < 3; idx++ {
+		err = hc.NewRequest(context.Background(), "/test").
+			Method("GET").
+			Pool("reads").
+			Callback(func (ctx context.Context, res httpclient.Response) error {
+				if res.Header.Get("x-server") != "server2" {
+					return errors.New("expected server to be `server2`")
+				}
+
+				// Done
+				return nil
+			}).
+			Exec()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// A failed addition must not create the pool
+	err = hc.AddSourceToPool("writes", server1.URL(), nil, loadbalancer.ServerOptions{
+		Weight: -1,
+	})
+	if err == nil {
+		t.Fatal("expected an error on invalid source options")
+	}
+	if hc.PoolBalancer("writes") != nil {
+		t.Fatal("the pool must not exist after a failed addition")
+	}
+
+	// Unknown pools must fail
+	err = hc.NewRequest(context.Background(), "/test").
+		Pool("writes").
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			return nil
+		}).
+		Exec()
+	if err == nil {
+		t.Fatal("expected an error on unknown pool")
+	}
+
+	// Sources of other pools cannot be pinned
+	err = hc.NewRequest(context.Background(), "/test").
+		Pool("reads").
+		PinSource(1).
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			return nil
+		}).
+		Exec()
+	if err == nil || err.Error() != "invalid source id" {
+		t.Fatalf("expected an invalid source id error [err=%v]", err)
+	}
+}
+
+func TestHttpClientRetryAfter(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	// Make the first server fail, it will ask to retry after one second
+	server1.SetOffline(true)
+
+	attempts := 0
+	err := hc.NewRequest(context.Background(), "/test").
+		Method("GET").
+		OverallDeadline(300 * time.Millisecond).
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			attempts += 1
+			if res.StatusCode != http.StatusServiceUnavailable {
+				return fmt.Errorf("unexpected status code %v", res.StatusCode)
+			}
+			if res.RetryAfter() != time.Second {
+				return fmt.Errorf("unexpected retry after %v", res.RetryAfter())
+			}
+
+			// Retry on the next available server
+			res.RetryOnNextServer()
+
+			// Done
+			return nil
+		}).
+		Exec()
+
+	// The retry delay must be interrupted by the overall deadline
+	if !errors.Is(err, httpclient.ErrTimeout) {
+		t.Fatalf("expected timeout error [err=%v]", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("unexpected number of attempts %v", attempts)
+	}
+}
+
+func TestHttpClientSourceByURL(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	ss := hc.SourceByURL(server2.URL() + "/")
+	if ss == nil || ss.BaseURL != server2.URL() {
+		t.Fatal("expected to find source 2")
+	}
+	if hc.SourceByURL("http://unknown.test-network") != nil {
+		t.Fatal("unexpected source found")
+	}
+}
+
+func TestHttpClientDo(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	hc.SetUnhealthyStatus(http.StatusServiceUnavailable)
+
+	// Make the first server fail, so the request is retried on the second one
+	server1.SetOffline(true)
+
+	body, res, err := hc.NewRequest(context.Background(), "/bodytest").
+		Method("POST").
+		BodyBytes([]byte("this is a sample body")).
+		Do()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("unexpected status code %v", res.StatusCode)
+	}
+	if res.Header.Get("x-server") != "server2" {
+		t.Fatal("expected server to be `server2`")
+	}
+
+	m := make(map[string]interface{})
+	err = json.Unmarshal(body, &m)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if b, _ := m["received-body"].(string); b != "this is a sample body" {
+		t.Fatal("received-body mismatch")
+	}
+}
+
+func TestHttpClientConnectionReuse(t *testing.T) {
+	server := createMockTimestampServer("server1")
+	defer server.Destroy()
+
+	hc := httpclient.Create()
+	err := hc.AddSource(server.URL(), nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	// Do sequential requests without reading the response body
+	reused := make([]bool, 0)
+	for idx := 0; idx < 3; idx++ {
+		ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				reused = append(reused, info.Reused)
+			},
+		})
+		err = hc.NewRequest(ctx, "/test").
+			Method("GET").
+			Callback(func (ctx context.Context, res httpclient.Response) error {
+				return res.Err()
+			}).
+			Exec()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// Only the first request must establish a new connection
+	if len(reused) != 3 || reused[0] || !reused[1] || !reused[2] {
+		t.Fatalf("unexpected connection reuse %v", reused)
+	}
+}
+
+func TestHttpClientDuplicateSource(t *testing.T) {
+	hc := httpclient.Create()
+
+	err := hc.AddSource("http://host", nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	// After normalization, this is the same base url
+	err = hc.AddSource("http://host/", nil, loadbalancer.ServerOptions{})
+	if err == nil {
+		t.Fatal("expected duplicate source to be rejected")
+	}
+	if hc.SourcesCount() != 1 {
+		t.Fatalf("unexpected sources count %v", hc.SourcesCount())
+	}
+}
+
+func TestHttpClientCopyTo(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	var buf bytes.Buffer
+	err := hc.NewRequest(context.Background(), "/bodytest").
+		Method("POST").
+		BodyBytes([]byte("this is a sample body")).
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			if res.Err() != nil {
+				return res.Err()
+			}
+			n, err := res.CopyTo(&buf)
+			if err != nil {
+				return err
+			}
+			if n != int64(buf.Len()) {
+				return errors.New("copied size mismatch")
+			}
+
+			// Done
+			return nil
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(buf.String(), "this is a sample body") {
+		t.Fatal("received-body mismatch")
+	}
+}
+
+func TestHttpClientCircuitBreaker(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	err := hc.SetCircuitBreaker(&httpclient.CircuitBreakerOptions{
+		FailureRatio: 0.5,
+		Window:       time.Minute,
+		MinRequests:  4,
+		Cooldown:     100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	shortCircuited := int32(0)
+	hc.SetEventHandler(func(eventType int, sourceId int, err error) {
+		if eventType == httpclient.RequestShortCircuitedEvent {
+			atomic.AddInt32(&shortCircuited, 1)
+		}
+	})
+
+	doRequest := func(fail bool) error {
+		return hc.NewRequest(context.Background(), "/test").
+			Method("GET").
+			Callback(func (ctx context.Context, res httpclient.Response) error {
+				if fail {
+					return errors.New("simulated failure")
+				}
+				return nil
+			}).
+			Exec()
+	}
+
+	// Make enough requests fail to open the circuit
+	for idx := 0; idx < 4; idx++ {
+		_ = doRequest(true)
+	}
+	err = doRequest(false)
+	if !errors.Is(err, httpclient.ErrCircuitOpen) {
+		t.Fatalf("expected circuit open error [err=%v]", err)
+	}
+	if atomic.LoadInt32(&shortCircuited) != 1 {
+		t.Fatal("expected a short-circuited event")
+	}
+
+	// After the cooldown, requests must go through again
+	time.Sleep(150 * time.Millisecond)
+	err = doRequest(false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestHttpClientRetryPolicy(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	// Make the first server fail, it will ask to retry after one second
+	server1.SetOffline(true)
+
+	attempts := 0
+	err := hc.NewRequest(context.Background(), "/test").
+		Method("GET").
+		RetryPolicy(httpclient.RetryOn5xx(3, 10 * time.Millisecond)).
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			attempts += 1
+			if res.Err() != nil {
+				return res.Err()
+			}
+			if res.StatusCode == 200 && res.Header.Get("x-server") != "server2" {
+				return errors.New("expected server to be `server2`")
+			}
+
+			// Done
+			return nil
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if attempts != 2 {
+		t.Fatalf("unexpected number of attempts %v", attempts)
+	}
+}
+
+func TestHttpClientPinSource(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	// All requests must go to the second server
+	for idx := 0; idx < 3; idx++ {
+		err := hc.NewRequest(context.Background(), "/test").
+			Method("GET").
+			PinSource(2).
+			Callback(func (ctx context.Context, res httpclient.Response) error {
+				if res.Header.Get("x-server") != "server2" {
+					return errors.New("expected server to be `server2`")
+				}
+
+				// Done
+				return nil
+			}).
+			Exec()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// Unknown sources must fail
+	err := hc.NewRequest(context.Background(), "/test").
+		PinSource(10).
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			return nil
+		}).
+		Exec()
+	if err == nil {
+		t.Fatal("expected an error on unknown source")
+	}
+}
+
+func TestHttpClientWarmup(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	err := hc.AddSource("http://127.0.0.1:1", nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	// Only the unreachable source must fail
+	errs := hc.Warmup(context.Background())
+	if len(errs) != 1 || errs[3] == nil {
+		t.Fatalf("unexpected warmup errors %v", errs)
+	}
+}
+
+func TestHttpClientWarmupRequest(t *testing.T) {
+	received := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Method + " " + r.URL.Path + " " + r.Header.Get("User-Agent") + " " + r.Header.Get("X-Source")
+	}))
+	defer srv.Close()
+
+	hc := httpclient.Create()
+	hc.SetDefaultHeaders(http.Header{
+		"User-Agent": []string{"test-agent"},
+	})
+	err := hc.AddSource(srv.URL+"/", http.Header{
+		"X-Source": []string{"one"},
+	}, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	// The warmup request carries the same headers as regular requests
+	errs := hc.Warmup(context.Background())
+	if len(errs) != 0 {
+		t.Fatalf("unexpected warmup errors %v", errs)
+	}
+	if received != "HEAD / test-agent one" {
+		t.Fatalf("unexpected warmup request [request=%v]", received)
+	}
+}
+
+func TestHttpClientCallbackPanic(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	doRequest := func() error {
+		return hc.NewRequest(context.Background(), "/test").
+			Method("GET").
+			Callback(func (ctx context.Context, res httpclient.Response) error {
+				panic("buggy callback")
+			}).
+			Exec()
+	}
+
+	// By default, the panic must be propagated
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatal("expected a panic")
+			}
+		}()
+		_ = doRequest()
+	}()
+
+	// Converted to an error if recovery is enabled
+	hc.SetRecoverCallbackPanics(true)
+	err := doRequest()
+	if !errors.Is(err, httpclient.ErrCallbackPanic) {
+		t.Fatalf("expected callback panic error [err=%v]", err)
+	}
+}
+
+func TestHttpClientCache(t *testing.T) {
+	// Create a mock server that supports entity tags
+	requests := int32(0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("cached content"))
+	}))
+	defer srv.Close()
+
+	hc := httpclient.Create()
+	err := hc.AddSource(srv.URL, nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+	hc.EnableCache(httpclient.NewMemoryCacheStore())
+
+	for idx := 0; idx < 2; idx++ {
+		err = hc.NewRequest(context.Background(), "/test").
+			Method("GET").
+			Callback(func (ctx context.Context, res httpclient.Response) error {
+				if res.Err() != nil {
+					return res.Err()
+				}
+				if res.StatusCode != 200 {
+					return fmt.Errorf("unexpected status code %v", res.StatusCode)
+				}
+				if res.FromCache() != (idx == 1) {
+					return errors.New("unexpected cache status")
+				}
+				b, err := io.ReadAll(res.Body)
+				if err != nil {
+					return err
+				}
+				if string(b) != "cached content" {
+					return errors.New("body mismatch")
+				}
+
+				// Done
+				return nil
+			}).
+			Exec()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if atomic.LoadInt32(&requests) != 2 {
+		t.Fatal("unexpected number of requests")
+	}
+}
+
+func TestHttpClientAllSourceStates(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	// Put the first server offline
+	err := hc.NewRequest(context.Background(), "/test").
+		Method("GET").
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			res.SetOffline()
+			return nil
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	states, onlineCount := hc.AllSourceStates()
+	if len(states) != 2 || onlineCount != 1 {
+		t.Fatalf("unexpected states [count=%v] [online=%v]", len(states), onlineCount)
+	}
+	if states[0].IsOnline || !states[1].IsOnline {
+		t.Fatal("unexpected online states")
+	}
+}
+
+func TestHttpClientDefaultHeaders(t *testing.T) {
+	// Create a mock server that echoes some headers
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-user-agent", r.Header.Get("User-Agent"))
+		w.Header().Set("x-accept", r.Header.Get("Accept"))
+		w.Header().Set("x-source", r.Header.Get("x-source"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	hc := httpclient.Create()
+	err := hc.AddSource(srv.URL, http.Header{
+		"X-Source": []string{"source"},
+		"Accept":   []string{"text/plain"},
+	}, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+	hc.SetDefaultHeaders(http.Header{
+		"User-Agent": []string{"test-agent"},
+		"Accept":     []string{"application/json"},
+		"X-Source":   []string{"default"},
+	})
+
+	err = hc.NewRequest(context.Background(), "/test").
+		Method("GET").
+		Headers(http.Header{
+			"Accept": []string{"text/html"},
+		}).
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			if res.Err() != nil {
+				return res.Err()
+			}
+			if res.Header.Get("x-user-agent") != "test-agent" {
+				return errors.New("default header not sent")
+			}
+			if res.Header.Get("x-source") != "source" {
+				return errors.New("source header did not override the default one")
+			}
+			if res.Header.Get("x-accept") != "text/html" {
+				return errors.New("request header did not override the others")
+			}
+
+			// Done
+			return nil
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestHttpClientPreflightHook(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	// Skip the first server
+	skipped := 0
+	hc.SetPreflightHook(func(src *httpclient.Source, req *http.Request) error {
+		if src.ID() == 1 {
+			skipped += 1
+			return httpclient.ErrSkipSource
+		}
+		return nil
+	})
+
+	for idx := 0; idx < 2; idx++ {
+		err := hc.NewRequest(context.Background(), "/test").
+			Method("GET").
+			Callback(func (ctx context.Context, res httpclient.Response) error {
+				if res.Err() != nil {
+					return res.Err()
+				}
+				if res.Header.Get("x-server") != "server2" {
+					return errors.New("expected server to be `server2`")
+				}
+				if res.RetryCount() != 0 {
+					return errors.New("skipped sources must not count as retries")
+				}
+
+				// Done
+				return nil
+			}).
+			Exec()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if skipped == 0 {
+		t.Fatal("the first server was never selected")
+	}
+	if !hc.SourceState(0).IsOnline {
+		t.Fatal("skipped server must remain online")
+	}
+
+	// Skipping all sources must fail
+	hc.SetPreflightHook(func(src *httpclient.Source, req *http.Request) error {
+		return httpclient.ErrSkipSource
+	})
+	err := hc.NewRequest(context.Background(), "/test").
+		Method("GET").
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			return errors.New("callback must not be called")
+		}).
+		Exec()
+	if err == nil {
+		t.Fatal("expected an error when all sources are skipped")
+	}
+}
+
+func TestHttpClientFlakyUpstream(t *testing.T) {
+	// Create fake upstreams, the first one failing every other request
+	upstream1 := httpclienttest.NewUpstream("upstream1")
+	defer upstream1.Close()
+	upstream1.SetFailurePattern(httpclienttest.FailEveryOther(), http.StatusBadGateway)
+	upstream2 := httpclienttest.NewUpstream("upstream2")
+	defer upstream2.Close()
+
+	hc := httpclient.Create()
+	for _, u := range []*httpclienttest.Upstream{upstream1, upstream2} {
+		err := hc.AddSource(u.URL(), nil, loadbalancer.ServerOptions{})
+		if err != nil {
+			t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+		}
+	}
+	hc.SetUnhealthyStatus(http.StatusBadGateway)
+
+	for idx := 0; idx < 4; idx++ {
+		_, res, err := hc.NewRequest(context.Background(), "/test").Method("GET").Do()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code %v", res.StatusCode)
+		}
+	}
+
+	// Requests 1 and 4 failed on the first upstream and were retried on the second one
+	if upstream1.Requests() != 3 || upstream2.Requests() != 3 {
+		t.Fatalf("unexpected traffic [upstream1=%v] [upstream2=%v]", upstream1.Requests(), upstream2.Requests())
+	}
+}
+
+func TestHttpClientBodyFile(t *testing.T) {
+	// Create a mock server that echoes the request body
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(b)
+	}))
+	defer srv.Close()
+
+	hc := httpclient.Create()
+	err := hc.AddSource(srv.URL, nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	filename := filepath.Join(t.TempDir(), "body.txt")
+	err = os.WriteFile(filename, []byte("file content"), 0600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// The file must be sent again on retries
+	err = hc.NewRequest(context.Background(), "/test").
+		Method("POST").
+		BodyFile(filename).
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			if res.Err() != nil {
+				return res.Err()
+			}
+			b, err := io.ReadAll(res.Body)
+			if err != nil {
+				return err
+			}
+			if string(b) != "file content" {
+				return errors.New("body mismatch")
+			}
+			if res.RetryCount() == 0 {
+				res.RetryOnNextServer()
+			}
+
+			// Done
+			return nil
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Missing files must fail before sending anything
+	err = hc.NewRequest(context.Background(), "/test").
+		Method("POST").
+		BodyFile(filename + ".missing").
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			return errors.New("callback must not be called")
+		}).
+		Exec()
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected a file not found error [err=%v]", err)
+	}
+}
+
+func TestHttpClientCancelBetweenAttempts(t *testing.T) {
+	// Create fake upstreams
+	upstream1 := httpclienttest.NewUpstream("upstream1")
+	defer upstream1.Close()
+	upstream2 := httpclienttest.NewUpstream("upstream2")
+	defer upstream2.Close()
+
+	hc := httpclient.Create()
+	for _, u := range []*httpclienttest.Upstream{upstream1, upstream2} {
+		err := hc.AddSource(u.URL(), nil, loadbalancer.ServerOptions{})
+		if err != nil {
+			t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+		}
+	}
+
+	// Cancel the request after the first attempt and ask for a retry
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := hc.NewRequest(ctx, "/test").
+		Method("GET").
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			cancel()
+			res.RetryOnNextServer()
+			return nil
+		}).
+		Exec()
+	if !errors.Is(err, httpclient.ErrCanceled) {
+		t.Fatalf("expected cancellation error [err=%v]", err)
+	}
+
+	// No other server must be tried
+	if upstream1.Requests() != 1 || upstream2.Requests() != 0 {
+		t.Fatalf("unexpected traffic [upstream1=%v] [upstream2=%v]", upstream1.Requests(), upstream2.Requests())
+	}
+	if !hc.SourceState(0).IsOnline {
+		t.Fatal("canceled requests must not affect the server status")
+	}
+}
+
+func TestHttpClientSession(t *testing.T) {
+	// Create fake upstreams
+	upstream1 := httpclienttest.NewUpstream("upstream1")
+	defer upstream1.Close()
+	upstream2 := httpclienttest.NewUpstream("upstream2")
+	defer upstream2.Close()
+
+	hc := httpclient.Create()
+	for _, u := range []*httpclienttest.Upstream{upstream1, upstream2} {
+		err := hc.AddSource(u.URL(), nil, loadbalancer.ServerOptions{
+			MaxFails:    1,
+			FailTimeout: 10 * time.Second,
+		})
+		if err != nil {
+			t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+		}
+	}
+	hc.SetUnhealthyStatus(http.StatusServiceUnavailable)
+
+	session := hc.NewSession()
+	doRequests := func(expectedUpstream string) {
+		for idx := 0; idx < 3; idx++ {
+			_, res, err := session.NewRequest(context.Background(), "/test").Method("GET").Do()
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if res.Header.Get(httpclienttest.UpstreamHeader) != expectedUpstream {
+				t.Fatalf("expected upstream to be `%v`", expectedUpstream)
+			}
+		}
+	}
+
+	// All the session requests must go to the first upstream
+	doRequests("upstream1")
+	if session.SourceID("") != 1 {
+		t.Fatal("unexpected session source")
+	}
+
+	// Once it fails, the session must move to the other upstream and stay there
+	upstream1.SetOffline(true)
+	doRequests("upstream2")
+	if session.SourceID("") != 2 {
+		t.Fatal("unexpected session source")
+	}
+}
+
+func TestHttpClientErrorHistory(t *testing.T) {
+	upstream := httpclienttest.NewUpstream("upstream")
+	defer upstream.Close()
+
+	hc := httpclient.Create()
+	err := hc.AddSource(upstream.URL(), nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	// Fail more requests than the history can hold
+	for idx := 0; idx < 20; idx++ {
+		_ = hc.NewRequest(context.Background(), "/test").
+			Method("GET").
+			Callback(func (ctx context.Context, res httpclient.Response) error {
+				return fmt.Errorf("error #%v", idx)
+			}).
+			Exec()
+	}
+
+	history := hc.SourceState(0).Errors
+	if len(history) != 16 {
+		t.Fatalf("unexpected history length %v", len(history))
+	}
+	if history[0].Err.Error() != "error #4" || history[15].Err.Error() != "error #19" {
+		t.Fatal("unexpected history order")
+	}
+
+	hc.ResetErrorHistory()
+	if len(hc.SourceState(0).Errors) != 0 {
+		t.Fatal("history not reset")
+	}
+}
+
+func TestHttpClientFailureClassifier(t *testing.T) {
+	hc := httpclient.Create()
+	err := hc.AddSource("http://127.0.0.1:1", nil, loadbalancer.ServerOptions{
+		MaxFails:    2,
+		FailTimeout: 10 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	// Refused connections count as half a failure
+	hc.SetFailureClassifier(func(kind httpclient.FailureKind, err error) float64 {
+		if kind == httpclient.FailureConnection {
+			return 0.5
+		}
+		return 1
+	})
+
+	for idx := 0; idx < 4; idx++ {
+		if !hc.SourceState(0).IsOnline {
+			t.Fatalf("source went offline too early [attempt=%v]", idx)
+		}
+		_ = hc.NewRequest(context.Background(), "/test").
+			Method("GET").
+			Callback(func (ctx context.Context, res httpclient.Response) error {
+				if res.Err() != nil {
+					res.SetOffline()
+				}
+				return res.Err()
+			}).
+			Exec()
+	}
+	if hc.SourceState(0).IsOnline {
+		t.Fatal("source must be offline")
+	}
+}
+
+func TestHttpClientNeedTrailers(t *testing.T) {
+	// Create a mock server that sends trailers
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("content"))
+		w.Header().Set("X-Checksum", "abc")
+	}))
+	defer srv.Close()
+
+	hc := httpclient.Create()
+	err := hc.AddSource(srv.URL, nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	err = hc.NewRequest(context.Background(), "/test").
+		Method("GET").
+		NeedTrailers(true).
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			if res.Err() != nil {
+				return res.Err()
+			}
+			if res.Trailer.Get("X-Checksum") != "abc" {
+				return errors.New("trailer not available")
+			}
+			b, err := io.ReadAll(res.Body)
+			if err != nil {
+				return err
+			}
+			if string(b) != "content" {
+				return errors.New("body mismatch")
+			}
+
+			// Done
+			return nil
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestHttpClientClone(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	// Put the first server offline in the original client
+	err := hc.NewRequest(context.Background(), "/test").
+		Method("GET").
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			res.SetOffline()
+			return nil
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	cloned := hc.Clone(http.DefaultTransport.(*http.Transport))
+	if cloned.SourcesCount() != 2 {
+		t.Fatal("sources not cloned")
+	}
+	if hc.SourceState(0).IsOnline || !cloned.SourceState(0).IsOnline {
+		t.Fatal("the clone must not share the balancing state")
+	}
+
+	// The source headers must be cloned too
+	err = cloned.NewRequest(context.Background(), "/test").
+		Method("GET").
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			if res.Err() != nil {
+				return res.Err()
+			}
+			if res.Header.Get("x-server") != "server1" {
+				return errors.New("expected server to be `server1`")
+			}
+
+			// Done
+			return nil
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestHttpClientSourceProxy(t *testing.T) {
+	// Create a mock proxy that replies on behalf of the backend
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-proxied-host", r.URL.Host)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	hc := httpclient.Create()
+	err := hc.AddSource("http://backend.invalid", nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+	err = hc.SetSourceProxy(1, proxyURL)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, res, err := hc.NewRequest(context.Background(), "/test").Method("GET").Do()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.Header.Get("x-proxied-host") != "backend.invalid" {
+		t.Fatal("request not sent through the proxy")
+	}
+
+	// Unknown sources must fail
+	if hc.SetSourceProxy(2, proxyURL) == nil {
+		t.Fatal("expected an error on unknown source")
+	}
+}
+
+func TestHttpClientSourceConfirmed(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	confirmed := make(map[int]int)
+	hc.SetEventHandler(func(eventType int, sourceId int, err error) {
+		if eventType == httpclient.SourceConfirmedEvent {
+			confirmed[sourceId] += 1
+		}
+	})
+	if hc.SourceState(0).IsConfirmed {
+		t.Fatal("sources must start unconfirmed")
+	}
+
+	// The event must be raised only once per source
+	for idx := 0; idx < 4; idx++ {
+		_, _, err := hc.NewRequest(context.Background(), "/test").Method("GET").Do()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if confirmed[1] != 1 || confirmed[2] != 1 {
+		t.Fatalf("unexpected confirmation events %v", confirmed)
+	}
+	if !hc.SourceState(0).IsConfirmed || !hc.SourceState(1).IsConfirmed {
+		t.Fatal("sources must be confirmed")
+	}
+}
+
+func TestHttpClientRetryDistinct(t *testing.T) {
+	// Create fake upstreams, the first one with a higher weight
+	upstreams := make([]*httpclienttest.Upstream, 0)
+	hc := httpclient.Create()
+	for idx := 1; idx <= 3; idx++ {
+		u := httpclienttest.NewUpstream(fmt.Sprintf("upstream%v", idx))
+		defer u.Close()
+		upstreams = append(upstreams, u)
+
+		weight := 1
+		if idx == 1 {
+			weight = 3
+		}
+		err := hc.AddSource(u.URL(), nil, loadbalancer.ServerOptions{
+			Weight: weight,
+		})
+		if err != nil {
+			t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+		}
+	}
+
+	// Always ask for a retry
+	err := hc.NewRequest(context.Background(), "/test").
+		Method("POST").
+		RetryDistinct(true).
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			res.RetryOnNextServer()
+			return fmt.Errorf("failed on %v", res.Header.Get(httpclienttest.UpstreamHeader))
+		}).
+		Exec()
+	if !errors.Is(err, httpclient.ErrAllSourcesTried) {
+		t.Fatalf("expected all sources tried error [err=%v]", err)
+	}
+	var attemptsErr *httpclient.AttemptsError
+	if !errors.As(err, &attemptsErr) || len(attemptsErr.Errors) != 3 {
+		t.Fatal("expected the errors of all the attempts")
+	}
+
+	// Each upstream must be tried once
+	for _, u := range upstreams {
+		if u.Requests() != 1 {
+			t.Fatalf("unexpected traffic [upstream=%v] [requests=%v]", u.Name(), u.Requests())
+		}
+	}
+}
+
+func TestHttpClientRecoveryCheck(t *testing.T) {
+	upstream := httpclienttest.NewUpstream("upstream")
+	defer upstream.Close()
+
+	hc := httpclient.Create()
+	defer hc.Close()
+	err := hc.AddSource(upstream.URL(), nil, loadbalancer.ServerOptions{
+		MaxFails:    1,
+		FailTimeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+	err = hc.StartRecoveryCheck(10 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = hc.NewRequest(context.Background(), "/test").
+		Method("GET").
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			res.SetOffline()
+			return nil
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if hc.SourceState(0).IsOnline {
+		t.Fatal("source must be offline")
+	}
+
+	// The source must recover without sending requests
+	waitSourceOnlineState(t, hc, 0, true)
+}
+
+func TestHttpClientIdleConnPurge(t *testing.T) {
+	var newConns, closedConns int32
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			atomic.AddInt32(&newConns, 1)
+		case http.StateClosed:
+			atomic.AddInt32(&closedConns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	hc := httpclient.Create()
+	err := hc.AddSource(srv.URL, nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+	err = hc.StartIdleConnPurge(20 * time.Millisecond)
+	if err != nil {
+		t.Fatalf("unable to start idle connection purge [err=%v]", err)
+	}
+
+	exec := func() {
+		err := hc.NewRequest(context.Background(), "/test").
+			Method("GET").
+			Callback(func (ctx context.Context, res httpclient.Response) error {
+				_, err := io.ReadAll(res.Body)
+				return err
+			}).
+			Exec()
+		if err != nil {
+			t.Fatalf("unexpected error [err=%v]", err)
+		}
+	}
+	waitClosedConns := func(expected int32) {
+		deadline := time.Now().Add(time.Second)
+		for atomic.LoadInt32(&closedConns) != expected {
+			if time.Now().After(deadline) {
+				t.Fatalf("unexpected closed connections [count=%v] [expected=%v]", atomic.LoadInt32(&closedConns), expected)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// The idle connection must be closed by the purge, so the next request opens a new one
+	exec()
+	waitClosedConns(1)
+	exec()
+	if atomic.LoadInt32(&newConns) != 2 {
+		t.Fatalf("idle connection was reused [count=%v]", atomic.LoadInt32(&newConns))
+	}
+	waitClosedConns(2)
+
+	// Close must stop the purge
+	doneCh := make(chan struct{})
+	go func() {
+		hc.Close()
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second):
+		t.Fatal("close did not stop the idle connection purge")
+	}
+	exec()
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadInt32(&closedConns) != 2 {
+		t.Fatalf("idle connection purged after close [count=%v]", atomic.LoadInt32(&closedConns))
+	}
+}
+
+func TestHttpClientDownSources(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	if len(hc.DownSources()) != 0 {
+		t.Fatal("all sources must be online")
+	}
+
+	// Put the first server offline
+	err := hc.NewRequest(context.Background(), "/test").
+		Method("GET").
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			res.SetOffline()
+			return errors.New("simulated error")
+		}).
+		Exec()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	down := hc.DownSources()
+	if len(down) != 1 || down[0].ID != 1 || down[0].BaseURL != server1.URL() {
+		t.Fatalf("unexpected down sources %v", down)
+	}
+	if down[0].LastError == nil || down[0].FailCounter != 1 {
+		t.Fatal("unexpected failure details")
+	}
+	if down[0].RecoveryIn <= 0 || down[0].RecoveryIn > 10*time.Second {
+		t.Fatalf("unexpected recovery eta %v", down[0].RecoveryIn)
+	}
+}
+
+func TestHttpClientMaxResponseBytes(t *testing.T) {
+	upstream := httpclienttest.NewUpstream("upstream")
+	defer upstream.Close()
+	upstream.SetResponse(http.StatusOK, bytes.Repeat([]byte("x"), 100))
+
+	hc := httpclient.Create()
+	err := hc.AddSource(upstream.URL(), nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	// Streaming reads must be limited
+	err = hc.NewRequest(context.Background(), "/test").
+		Method("GET").
+		MaxResponseBytes(10).
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			if res.Err() != nil {
+				return res.Err()
+			}
+			_, err := io.ReadAll(res.Body)
+			return err
+		}).
+		Exec()
+	if !errors.Is(err, httpclient.ErrResponseTooLarge) {
+		t.Fatalf("expected response too large error [err=%v]", err)
+	}
+
+	// And buffered ones too
+	_, _, err = hc.NewRequest(context.Background(), "/test").Method("GET").MaxResponseBytes(99).Do()
+	if !errors.Is(err, httpclient.ErrResponseTooLarge) {
+		t.Fatalf("expected response too large error [err=%v]", err)
+	}
+	body, _, err := hc.NewRequest(context.Background(), "/test").Method("GET").MaxResponseBytes(100).Do()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(body) != 100 {
+		t.Fatal("body mismatch")
+	}
+}
+
+func TestHttpClientBroadcast(t *testing.T) {
+	upstreams := make([]*httpclienttest.Upstream, 0)
+	hc := httpclient.Create()
+	for idx := 1; idx <= 3; idx++ {
+		u := httpclienttest.NewUpstream(fmt.Sprintf("upstream%v", idx))
+		defer u.Close()
+		upstreams = append(upstreams, u)
+
+		err := hc.AddSource(u.URL(), nil, loadbalancer.ServerOptions{
+			MaxFails:    1,
+			FailTimeout: time.Minute,
+		})
+		if err != nil {
+			t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+		}
+	}
+	upstreams[1].SetResponse(http.StatusInternalServerError, nil)
+
+	// Put the third source offline for a while
+	err := hc.NewRequest(context.Background(), "/test").
+		PinSource(3).
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			res.SetOfflineFor(200 * time.Millisecond)
+			return nil
+		}).
+		Exec()
+	if err != nil {
+		t.Fatalf("unable to execute request [err=%v]", err)
+	}
+	upstreams[2].ResetRequests()
+
+	results, err := hc.NewRequest(context.Background(), "/invalidate").
+		Method("POST").
+		BodyBytes([]byte("key")).
+		Broadcast()
+	if !errors.Is(err, httpclient.ErrPartialFailure) {
+		t.Fatalf("expected a partial failure error [err=%v]", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("unexpected results count [count=%v]", len(results))
+	}
+	if results[0].Skipped || results[0].Err != nil || results[0].StatusCode != http.StatusOK {
+		t.Fatalf("unexpected result for the first source [result=%+v]", results[0])
+	}
+	if results[1].Skipped || results[1].StatusCode != http.StatusInternalServerError {
+		t.Fatalf("unexpected result for the second source [result=%+v]", results[1])
+	}
+	if !results[2].Skipped {
+		t.Fatal("expected the offline source to be skipped")
+	}
+
+	// Each online upstream must receive the request exactly once
+	for idx, u := range upstreams {
+		expected := 1
+		if idx == 2 {
+			expected = 0
+		}
+		if u.Requests() != expected {
+			t.Fatalf("unexpected traffic [upstream=%v] [requests=%v]", u.Name(), u.Requests())
+		}
+	}
+
+	// Retry only on the source not reached once it is back
+	var partialErr *httpclient.PartialFailureError
+	if !errors.As(err, &partialErr) {
+		t.Fatalf("expected a partial failure error [err=%v]", err)
+	}
+	failedIDs := partialErr.Failed.SourceIDs()
+	if len(failedIDs) != 1 || failedIDs[0] != 3 {
+		t.Fatalf("unexpected failed sources [ids=%v]", failedIDs)
+	}
+	err = hc.StartRecoveryCheck(10 * time.Millisecond)
+	if err != nil {
+		t.Fatalf("unable to start recovery check [err=%v]", err)
+	}
+	defer hc.Close()
+	time.Sleep(300 * time.Millisecond)
+	results, err = hc.NewRequest(context.Background(), "/invalidate").
+		Method("POST").
+		BodyBytes([]byte("key")).
+		BroadcastTo(failedIDs...)
+	if err != nil {
+		t.Fatalf("unable to broadcast request [err=%v]", err)
+	}
+	if len(results) != 1 || !results[0].OK() || upstreams[2].Requests() != 1 || upstreams[0].Requests() != 1 {
+		t.Fatalf("unexpected retry results [results=%+v]", results)
+	}
+}
+
+func TestHttpClientBackoff(t *testing.T) {
+	// Check the built-in schedules
+	base := 10 * time.Millisecond
+	checks := []struct {
+		backoff  httpclient.Backoff
+		expected []time.Duration
+	}{
+		{httpclient.ConstantBackoff(base), []time.Duration{base, base, base}},
+		{httpclient.LinearBackoff(base, 25*time.Millisecond), []time.Duration{base, 2 * base, 25 * time.Millisecond}},
+		{httpclient.ExponentialBackoff(base, 0), []time.Duration{base, 2 * base, 4 * base, 8 * base}},
+		{httpclient.FibonacciBackoff(base, 0), []time.Duration{base, base, 2 * base, 3 * base, 5 * base}},
+	}
+	for _, check := range checks {
+		for attempt, expected := range check.expected {
+			if d := check.backoff.Next(attempt); d != expected {
+				t.Fatalf("unexpected backoff delay [attempt=%v] [delay=%v] [expected=%v]", attempt, d, expected)
+			}
+		}
+	}
+	jitter := httpclient.FullJitterBackoff(base, 0)
+	for attempt := 0; attempt < 5; attempt++ {
+		if d := jitter.Next(attempt); d < 0 || d > base<<uint(attempt) {
+			t.Fatalf("unexpected jitter delay [attempt=%v] [delay=%v]", attempt, d)
+		}
+	}
+
+	upstream := httpclienttest.NewUpstream("upstream")
+	defer upstream.Close()
+
+	hc := httpclient.Create()
+	err := hc.AddSource(upstream.URL(), nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	// A long backoff must be interrupted by the overall deadline
+	start := time.Now()
+	err = hc.NewRequest(context.Background(), "/test").
+		WithBackoff(httpclient.ConstantBackoff(time.Minute)).
+		OverallDeadline(100 * time.Millisecond).
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			res.RetryOnNextServer()
+			return nil
+		}).
+		Exec()
+	if !errors.Is(err, httpclient.ErrTimeout) {
+		t.Fatalf("expected timeout error [err=%v]", err)
+	}
+	if time.Since(start) > 5*time.Second || upstream.Requests() != 1 {
+		t.Fatalf("the backoff was not interrupted [requests=%v]", upstream.Requests())
+	}
+}
+
+func TestHttpClientTagStats(t *testing.T) {
+	hc := httpclient.Create()
+	for idx := 1; idx <= 2; idx++ {
+		u := httpclienttest.NewUpstream(fmt.Sprintf("upstream%v", idx))
+		defer u.Close()
+
+		err := hc.AddSource(u.URL(), nil, loadbalancer.ServerOptions{})
+		if err != nil {
+			t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+		}
+	}
+
+	// Retry the first attempt on the next source
+	err := hc.NewRequest(context.Background(), "/orders").
+		Tag("orders").
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			if info := httpclient.AttemptInfoFromContext(ctx); info == nil || info.Tag != "orders" {
+				return errors.New("tag not found in attempt info")
+			}
+			if res.RetryCount() == 0 {
+				res.RetryOnNextServer()
+			}
+			return nil
+		}).
+		Exec()
+	if err != nil {
+		t.Fatalf("unable to execute request [err=%v]", err)
+	}
+
+	stats := hc.SourceStateByID(1).TagStats
+	if stats["orders"].Retried != 1 || stats["orders"].Succeeded != 1 {
+		t.Fatalf("unexpected stats for the first source [stats=%+v]", stats)
+	}
+	stats = hc.SourceStateByID(2).TagStats
+	if stats["orders"].Retried != 0 || stats["orders"].Succeeded != 1 {
+		t.Fatalf("unexpected stats for the second source [stats=%+v]", stats)
+	}
+
+	hc.ResetTagStats()
+	if len(hc.SourceStateByID(1).TagStats) != 0 {
+		t.Fatal("expected tag stats to be cleared")
+	}
+}
+
+func TestHttpClientExecJSON(t *testing.T) {
+	type Item struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+
+	upstream := httpclienttest.NewUpstream("upstream")
+	defer upstream.Close()
+	upstream.SetResponse(http.StatusOK, []byte(`{"name":"widget","count":3}`))
+
+	hc := httpclient.Create()
+	err := hc.AddSource(upstream.URL(), nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	item, err := httpclient.ExecJSON[Item](hc.NewRequest(context.Background(), "/items/1"))
+	if err != nil {
+		t.Fatalf("unable to execute request [err=%v]", err)
+	}
+	if item.Name != "widget" || item.Count != 3 {
+		t.Fatalf("unexpected decoded value [item=%+v]", item)
+	}
+
+	// Non 2xx responses must return the status and body
+	upstream.SetResponse(http.StatusNotFound, []byte("not found"))
+	_, err = httpclient.ExecJSON[Item](hc.NewRequest(context.Background(), "/items/2"))
+	var statusErr *httpclient.StatusError
+	if !errors.As(err, &statusErr) || !errors.Is(err, httpclient.ErrUnexpectedStatus) {
+		t.Fatalf("expected a status error [err=%v]", err)
+	}
+	if statusErr.StatusCode != http.StatusNotFound || string(statusErr.Body) != "not found" {
+		t.Fatalf("unexpected status error details [status=%v] [body=%v]", statusErr.StatusCode, string(statusErr.Body))
+	}
+}
+
+func TestHttpClientConnStats(t *testing.T) {
+	upstream := httpclienttest.NewUpstream("upstream")
+	defer upstream.Close()
+
+	hc := httpclient.Create()
+	err := hc.AddSource(upstream.URL(), nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	for idx := 0; idx < 3; idx++ {
+		_, _, err = hc.NewRequest(context.Background(), "/test").Do()
+		if err != nil {
+			t.Fatalf("unable to execute request [err=%v]", err)
+		}
+	}
+
+	// The first request opens the connection and the rest must reuse it
+	stats := hc.SourceStateByID(1).ConnStats
+	if stats.NewConns != 1 || stats.ReusedConns != 2 {
+		t.Fatalf("unexpected connection stats [stats=%+v]", stats)
+	}
+}
+
+func TestHttpClientRetryOnRedirect(t *testing.T) {
+	// Create a maintenance page host and a backend redirecting to it
+	maintenance := httpclienttest.NewUpstream("maintenance")
+	defer maintenance.Close()
+	redirecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, maintenance.URL()+"/maintenance", http.StatusFound)
+	}))
+	defer redirecting.Close()
+	healthy := httpclienttest.NewUpstream("healthy")
+	defer healthy.Close()
+
+	hc := httpclient.Create()
+	for _, baseURL := range []string{redirecting.URL, healthy.URL()} {
+		err := hc.AddSource(baseURL, nil, loadbalancer.ServerOptions{})
+		if err != nil {
+			t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+		}
+	}
+
+	statusCodes := make([]int, 0)
+	err := hc.NewRequest(context.Background(), "/test").
+		RetryOnStatus(http.StatusFound).
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			statusCodes = append(statusCodes, res.StatusCode)
+			return res.Err()
+		}).
+		Exec()
+	if err != nil {
+		t.Fatalf("unable to execute request [err=%v]", err)
+	}
+
+	// The redirect must not be followed and the request must fail over to the healthy backend
+	if len(statusCodes) != 2 || statusCodes[0] != http.StatusFound || statusCodes[1] != http.StatusOK {
+		t.Fatalf("unexpected attempts [status=%v]", statusCodes)
+	}
+	if maintenance.Requests() != 0 || healthy.Requests() != 1 {
+		t.Fatalf("unexpected traffic [maintenance=%v] [healthy=%v]", maintenance.Requests(), healthy.Requests())
+	}
+}
+
+func TestHttpClientExportState(t *testing.T) {
+	upstream := httpclienttest.NewUpstream("upstream")
+	defer upstream.Close()
+
+	create := func() *httpclient.HttpClient {
+		hc := httpclient.Create()
+		err := hc.AddSource(upstream.URL(), nil, loadbalancer.ServerOptions{
+			MaxFails:    1,
+			FailTimeout: time.Minute,
+		})
+		if err != nil {
+			t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+		}
+		return hc
+	}
+
+	// Put the source offline
+	hc := create()
+	_ = hc.NewRequest(context.Background(), "/test").
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			res.SetOffline()
+			return nil
+		}).
+		Exec()
+
+	// A new client must restore it as offline
+	restored := create()
+	err := restored.ImportState(hc.ExportState())
+	if err != nil {
+		t.Fatalf("unable to import state [err=%v]", err)
+	}
+	if restored.SourceStateByID(1).IsOnline {
+		t.Fatal("expected the source to be restored as offline")
+	}
+}
+
+func TestHttpClientSetSourceHeader(t *testing.T) {
+	var lastKey atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastKey.Store(r.Header.Get("X-Api-Key"))
+	}))
+	defer srv.Close()
+
+	hc := httpclient.Create()
+	err := hc.AddSource(srv.URL, http.Header{"X-Api-Key": []string{"key1"}}, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	// Rotate the key while requests are in progress
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for idx := 0; idx < 20; idx++ {
+			_, _, _ = hc.NewRequest(context.Background(), "/test").Do()
+		}
+	}()
+	for idx := 0; idx < 20; idx++ {
+		err = hc.SetSourceHeader(1, "X-Api-Key", fmt.Sprintf("key%v", idx+2))
+		if err != nil {
+			t.Fatalf("unable to set source header [err=%v]", err)
+		}
+	}
+	<-done
+
+	_, _, err = hc.NewRequest(context.Background(), "/test").Do()
+	if err != nil {
+		t.Fatalf("unable to execute request [err=%v]", err)
+	}
+	if lastKey.Load() != "key21" {
+		t.Fatalf("unexpected api key [key=%v]", lastKey.Load())
+	}
+
+	if hc.SetSourceHeader(2, "X-Api-Key", "key") == nil {
+		t.Fatal("expected an invalid source id error")
+	}
+}
+
+func TestHttpClientTimeoutFunc(t *testing.T) {
+	upstream := httpclienttest.NewUpstream("upstream")
+	defer upstream.Close()
+	upstream.SetLatency(200 * time.Millisecond)
+
+	hc := httpclient.Create()
+	err := hc.AddSource(upstream.URL(), nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	// Give each attempt an eighth of the remaining budget
+	attempts := make([]int, 0)
+	remainingList := make([]time.Duration, 0)
+	err = hc.NewRequest(context.Background(), "/test").
+		OverallDeadline(time.Second).
+		TimeoutFunc(func(attempt int, remaining time.Duration) time.Duration {
+			attempts = append(attempts, attempt)
+			remainingList = append(remainingList, remaining)
+			return remaining / 8
+		}).
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			if res.RetryCount() == 0 {
+				res.RetryOnNextServer()
+			}
+			return res.Err()
+		}).
+		Exec()
+	if !errors.Is(err, httpclient.ErrTimeout) {
+		t.Fatalf("expected timeout error [err=%v]", err)
+	}
+	if len(attempts) != 2 || attempts[0] != 0 || attempts[1] != 1 {
+		t.Fatalf("unexpected attempts [attempts=%v]", attempts)
+	}
+	if remainingList[0] <= 0 || remainingList[0] > time.Second || remainingList[1] >= remainingList[0] {
+		t.Fatalf("unexpected remaining times [remaining=%v]", remainingList)
+	}
+}
+
+func TestHttpClientSlowBody(t *testing.T) {
+	// Create a server sending the headers immediately and the body slowly
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+		_, _ = w.Write([]byte("body"))
+	}))
+	defer srv.Close()
+
+	hc := httpclient.Create()
+	err := hc.AddSource(srv.URL, nil, loadbalancer.ServerOptions{
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	execute := func() error {
+		return hc.NewRequest(context.Background(), "/test").
+			Timeout(100 * time.Millisecond).
+			Callback(func (ctx context.Context, res httpclient.Response) error {
+				if res.Err() != nil {
+					return res.Err()
+				}
+				_, err := io.ReadAll(res.Body)
+				return err
+			}).
+			Exec()
+	}
+
+	// By default, a slow body must not put the source offline
+	err = execute()
+	if !errors.Is(err, httpclient.ErrTimeout) {
+		t.Fatalf("expected timeout error [err=%v]", err)
+	}
+	state := hc.SourceStateByID(1)
+	if !state.IsOnline {
+		t.Fatal("the source must remain online")
+	}
+	if state.TTFB <= 0 || state.TTFB >= 100*time.Millisecond || state.AvgTTFB != state.TTFB {
+		t.Fatalf("unexpected ttfb [ttfb=%v] [avg=%v]", state.TTFB, state.AvgTTFB)
+	}
+
+	// Unless the classifier counts them
+	hc.SetFailureClassifier(func(kind httpclient.FailureKind, err error) float64 {
+		if kind == httpclient.FailureSlowBody {
+			return 1
+		}
+		return 0
+	})
+	_ = execute()
+	if hc.SourceStateByID(1).IsOnline {
+		t.Fatal("the source must be offline")
+	}
+}
+
+func TestHttpClientCanceledContext(t *testing.T) {
+	upstream := httpclienttest.NewUpstream("upstream")
+	defer upstream.Close()
+
+	hc := httpclient.Create()
+	err := hc.AddSource(upstream.URL(), nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	callbackCalled := false
+	err = hc.NewRequest(ctx, "/test").
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			callbackCalled = true
+			return nil
+		}).
+		Exec()
+	if !errors.Is(err, httpclient.ErrCanceled) {
+		t.Fatalf("expected canceled error [err=%v]", err)
+	}
+	if callbackCalled || upstream.Requests() != 0 {
+		t.Fatal("no attempt must be made with a canceled context")
+	}
+	if hc.SourceStateByID(1).LastError != nil {
+		t.Fatal("the source must not be blamed")
+	}
+}
+
+func TestHttpClientOfflineOnCancel(t *testing.T) {
+	upstream := httpclienttest.NewUpstream("upstream")
+	defer upstream.Close()
+	upstream.SetLatency(200 * time.Millisecond)
+
+	hc := httpclient.Create()
+	err := hc.AddSource(upstream.URL(), nil, loadbalancer.ServerOptions{
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	execute := func(offlineOnCancel bool) error {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+		}()
+
+		_, _, err := hc.NewRequest(ctx, "/slow").
+			OfflineOnCancel(offlineOnCancel).
+			Do()
+		return err
+	}
+
+	// By default, the source is not blamed
+	err = execute(false)
+	if !errors.Is(err, httpclient.ErrCanceled) {
+		t.Fatalf("expected canceled error [err=%v]", err)
+	}
+	if !hc.SourceStateByID(1).IsOnline {
+		t.Fatal("the source must remain online")
+	}
+
+	// Unless requested
+	err = execute(true)
+	if !errors.Is(err, httpclient.ErrCanceled) {
+		t.Fatalf("expected canceled error [err=%v]", err)
+	}
+	if hc.SourceStateByID(1).IsOnline {
+		t.Fatal("the source must be offline")
+	}
+}
+
+func TestHttpClientNilCallback(t *testing.T) {
+	hc := httpclient.Create()
+	hc.SetUnhealthyStatus(http.StatusServiceUnavailable)
+	upstreams := make([]*httpclienttest.Upstream, 0)
+	for idx := 1; idx <= 2; idx++ {
+		u := httpclienttest.NewUpstream(fmt.Sprintf("upstream%v", idx))
+		defer u.Close()
+		upstreams = append(upstreams, u)
+
+		err := hc.AddSource(u.URL(), nil, loadbalancer.ServerOptions{
+			MaxFails:    1,
+			FailTimeout: time.Minute,
+		})
+		if err != nil {
+			t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+		}
+	}
+	upstreams[0].SetOffline(true)
+
+	// The request is sent and the unhealthy source put offline
+	err := hc.NewRequest(context.Background(), "/notify").Method("POST").Exec()
+	if err != nil {
+		t.Fatalf("unable to execute request [err=%v]", err)
+	}
+	if upstreams[0].Requests() != 1 || hc.SourceStateByID(1).IsOnline {
+		t.Fatal("expected the unhealthy source to be put offline")
+	}
+	err = hc.NewRequest(context.Background(), "/notify").Method("POST").Exec()
+	if err != nil {
+		t.Fatalf("unable to execute request [err=%v]", err)
+	}
+	if upstreams[1].Requests() != 1 {
+		t.Fatal("expected the request to be sent to the online source")
+	}
+
+	// Failures are returned
+	upstreams[1].Close()
+	err = hc.NewRequest(context.Background(), "/notify").Method("POST").Exec()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestHttpClientSigningHook(t *testing.T) {
+	signatures := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signatures <- r.Header.Get("X-Signature")
+	}))
+	defer srv.Close()
+
+	hc := httpclient.Create()
+	err := hc.AddSource(srv.URL, nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	// Sign the body and a per attempt counter
+	counter := 0
+	hc.SetSigningHook(func(req *http.Request) error {
+		body, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		b, _ := io.ReadAll(body)
+		counter += 1
+		req.Header.Set("X-Signature", fmt.Sprintf("%v:%v", string(b), counter))
+		return nil
+	})
+
+	err = hc.NewRequest(context.Background(), "/test").
+		Method("POST").
+		BodyBytes([]byte("payload")).
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			if res.RetryCount() == 0 {
+				res.RetryOnNextServer()
+			}
+			return res.Err()
+		}).
+		Exec()
+	if err != nil {
+		t.Fatalf("unable to execute request [err=%v]", err)
+	}
+	for idx := 1; idx <= 2; idx++ {
+		if sig := <-signatures; sig != fmt.Sprintf("payload:%v", idx) {
+			t.Fatalf("unexpected signature [attempt=%v] [signature=%v]", idx, sig)
+		}
+	}
+
+	// A signing error must abort the request
+	hc.SetSigningHook(func(req *http.Request) error {
+		return errors.New("no credentials")
+	})
+	_, _, err = hc.NewRequest(context.Background(), "/test").Do()
+	if err == nil {
+		t.Fatal("expected signing error")
+	}
+}
+
+func TestHttpClientDecodeJSON(t *testing.T) {
+	upstream := httpclienttest.NewUpstream("upstream")
+	defer upstream.Close()
+
+	hc := httpclient.Create()
+	err := hc.AddSource(upstream.URL(), nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	decode := func(v interface{}) error {
+		return hc.NewRequest(context.Background(), "/test").
+			Callback(func (ctx context.Context, res httpclient.Response) error {
+				if res.Err() != nil {
+					return res.Err()
+				}
+				return res.DecodeJSON(v)
+			}).
+			Exec()
+	}
+
+	var value map[string]int
+
+	upstream.SetResponse(http.StatusOK, []byte(`{"count":1}`))
+	err = decode(&value)
+	if err != nil || value["count"] != 1 {
+		t.Fatalf("unable to decode body [err=%v] [value=%v]", err, value)
+	}
+
+	// Empty bodies must be reported as such
+	value = nil
+	upstream.SetResponse(http.StatusNoContent, nil)
+	err = decode(&value)
+	if !errors.Is(err, httpclient.ErrEmptyBody) || value != nil {
+		t.Fatalf("expected empty body error [err=%v]", err)
+	}
+
+	// Malformed ones must not
+	upstream.SetResponse(http.StatusOK, []byte(`{"count":`))
+	err = decode(&value)
+	if err == nil || errors.Is(err, httpclient.ErrEmptyBody) {
+		t.Fatalf("expected decode error [err=%v]", err)
+	}
+
+	// Neither failed requests
+	down := httpclienttest.NewUpstream("down")
+	downURL := down.URL()
+	down.Close()
+
+	hc2 := httpclient.Create()
+	err = hc2.AddSource(downURL, nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+	var requestErr error
+	err = hc2.NewRequest(context.Background(), "/test").
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			requestErr = res.Err()
+			return res.DecodeJSON(&value)
+		}).
+		Exec()
+	if requestErr == nil || errors.Is(err, httpclient.ErrEmptyBody) || !errors.Is(err, requestErr) {
+		t.Fatalf("expected the request error [err=%v]", err)
+	}
+}
+
+func TestHttpClientSourceComparator(t *testing.T) {
+	upstreams := make([]*httpclienttest.Upstream, 0)
+	hc := httpclient.Create()
+	for idx := 1; idx <= 3; idx++ {
+		u := httpclienttest.NewUpstream(fmt.Sprintf("upstream%v", idx))
+		defer u.Close()
+		upstreams = append(upstreams, u)
+
+		err := hc.AddSource(u.URL(), nil, loadbalancer.ServerOptions{})
+		if err != nil {
+			t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+		}
+	}
+
+	// Make the first upstream fail once so it has the highest error rate
+	_ = hc.NewRequest(context.Background(), "/test").
+		PinSource(1).
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			return errors.New("failed")
+		}).
+		Exec()
+	upstreams[0].ResetRequests()
+
+	// Prefer the lowest error rate and, on ties, the highest source id
+	hc.SetSourceComparator(func(a, b *httpclient.Source) bool {
+		if a.ErrorRate() != b.ErrorRate() {
+			return a.ErrorRate() < b.ErrorRate()
+		}
+		return a.ID() > b.ID()
+	})
+	for idx := 0; idx < 3; idx++ {
+		_, _, err := hc.NewRequest(context.Background(), "/test").Do()
+		if err != nil {
+			t.Fatalf("unable to execute request [err=%v]", err)
+		}
+	}
+	if upstreams[0].Requests() != 0 || upstreams[1].Requests() != 0 || upstreams[2].Requests() != 3 {
+		t.Fatalf("unexpected traffic [requests=%v/%v/%v]", upstreams[0].Requests(), upstreams[1].Requests(),
+			upstreams[2].Requests())
+	}
+}
+
+func TestHttpClientRetryBudget(t *testing.T) {
+	hc := httpclient.Create()
+	for idx := 1; idx <= 2; idx++ {
+		u := httpclienttest.NewUpstream(fmt.Sprintf("upstream%v", idx))
+		defer u.Close()
+
+		err := hc.AddSource(u.URL(), nil, loadbalancer.ServerOptions{})
+		if err != nil {
+			t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+		}
+	}
+	err := hc.SetRetryBudget(&httpclient.RetryBudgetOptions{
+		Ratio:      0,
+		Window:     time.Minute,
+		MinRetries: 1,
+	})
+	if err != nil {
+		t.Fatalf("unable to set retry budget [err=%v]", err)
+	}
+
+	throttledEvents := int32(0)
+	hc.SetEventHandler(func(eventType int, sourceId int, err error) {
+		if eventType == httpclient.RequestRetryThrottledEvent {
+			atomic.AddInt32(&throttledEvents, 1)
+		}
+	})
+
+	execute := func() error {
+		return hc.NewRequest(context.Background(), "/test").
+			Callback(func (ctx context.Context, res httpclient.Response) error {
+				if res.RetryCount() == 0 {
+					res.RetryOnNextServer()
+					return errors.New("first attempt failed")
+				}
+				return nil
+			}).
+			Exec()
+	}
+
+	// The first request can retry
+	err = execute()
+	if err != nil {
+		t.Fatalf("unable to execute request [err=%v]", err)
+	}
+
+	// The budget is exhausted for the second one
+	err = execute()
+	if err == nil || err.Error() != "first attempt failed" {
+		t.Fatalf("expected the error of the first attempt [err=%v]", err)
+	}
+	if atomic.LoadInt32(&throttledEvents) != 1 {
+		t.Fatal("expected a retry throttled event")
+	}
+	state, ok := hc.RetryBudgetState()
+	if !ok || state.Requests != 2 || state.Retries != 1 || !state.Exhausted {
+		t.Fatalf("unexpected retry budget state [state=%+v]", state)
+	}
+}
+
+func TestHttpClientRetryBudgetExhaustedCallbackRetry(t *testing.T) {
+	hc := httpclient.Create()
+	for idx := 1; idx <= 2; idx++ {
+		u := httpclienttest.NewUpstream(fmt.Sprintf("upstream%v", idx))
+		defer u.Close()
+		u.SetResponse(http.StatusInternalServerError, nil)
+
+		err := hc.AddSource(u.URL(), nil, loadbalancer.ServerOptions{})
+		if err != nil {
+			t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+		}
+	}
+	hc.SetUnhealthyStatus(http.StatusInternalServerError)
+	err := hc.SetRetryBudget(&httpclient.RetryBudgetOptions{
+		Ratio:  0,
+		Window: time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("unable to set retry budget [err=%v]", err)
+	}
+
+	// A throttled retry requested by the callback must not be reported as a success
+	err = hc.NewRequest(context.Background(), "/test").
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			res.RetryOnNextServer()
+			return nil
+		}).
+		Exec()
+	var httpErr *httpclient.Error
+	if !errors.Is(err, httpclient.ErrRetryBudgetExhausted) || !errors.As(err, &httpErr) {
+		t.Fatalf("expected a retry budget exhausted error [err=%v]", err)
+	}
+	if httpErr.StatusCode() != http.StatusInternalServerError {
+		t.Fatalf("unexpected status code [status=%v]", httpErr.StatusCode())
+	}
+
+	// Do must fail instead of returning a nil response
+	_, res, err := hc.NewRequest(context.Background(), "/test").Do()
+	if err == nil || res != nil {
+		t.Fatalf("expected an error [err=%v]", err)
+	}
+}
+
+func TestHttpClientForcedRetries(t *testing.T) {
+	hc := httpclient.Create()
+	for idx := 1; idx <= 2; idx++ {
+		u := httpclienttest.NewUpstream(fmt.Sprintf("upstream%v", idx))
+		defer u.Close()
+
+		err := hc.AddSource(u.URL(), nil, loadbalancer.ServerOptions{})
+		if err != nil {
+			t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+		}
+	}
+
+	execute := func(ctx context.Context, distinct bool) (int, error) {
+		attempts := 0
+		err := hc.NewRequest(ctx, "/test").
+			RetryPolicy(httpclient.NoRetry()).
+			RetryDistinct(distinct).
+			Callback(func (ctx context.Context, res httpclient.Response) error {
+				attempts += 1
+				return nil
+			}).
+			Exec()
+		return attempts, err
+	}
+
+	// Successful attempts are retried as instructed
+	attempts, err := execute(httpclient.WithForcedRetries(context.Background(), true, true, false), false)
+	if err != nil {
+		t.Fatalf("unable to execute request [err=%v]", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("unexpected number of attempts [attempts=%v]", attempts)
+	}
+
+	// The rest of the retry rules still apply
+	attempts, err = execute(httpclient.WithForcedRetries(context.Background(), true, true, true), true)
+	if err == nil {
+		t.Fatal("expected an error after trying all the sources")
+	}
+	if attempts != 2 {
+		t.Fatalf("unexpected number of attempts [attempts=%v]", attempts)
+	}
+
+	// Suppressing a retry requested by the callback must not be reported as a success
+	err = hc.NewRequest(httpclient.WithForcedRetries(context.Background(), false), "/test").
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			res.RetryOnNextServer()
+			return nil
+		}).
+		Exec()
+	if err == nil {
+		t.Fatal("expected an error after suppressing the retry")
+	}
+}
+
+func TestHttpClientAdaptiveWeights(t *testing.T) {
+	hc := httpclient.Create()
+	upstreams := make([]*httpclienttest.Upstream, 0)
+	for idx := 1; idx <= 2; idx++ {
+		u := httpclienttest.NewUpstream(fmt.Sprintf("upstream%v", idx))
+		defer u.Close()
+		upstreams = append(upstreams, u)
+
+		err := hc.AddSource(u.URL(), nil, loadbalancer.ServerOptions{
+			Weight: 10,
+		})
+		if err != nil {
+			t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+		}
+	}
+	err := hc.SetAdaptiveWeights(&httpclient.AdaptiveWeightOptions{
+		MinWeight: 2,
+		Window:    5,
+	})
+	if err != nil {
+		t.Fatalf("unable to set adaptive weights [err=%v]", err)
+	}
+
+	execute := func(count int) {
+		for i := 0; i < count; i++ {
+			_ = hc.NewRequest(context.Background(), "/test").
+				Callback(func (ctx context.Context, res httpclient.Response) error {
+					if res.StatusCode >= 500 {
+						return errors.New("server error")
+					}
+					return nil
+				}).
+				Exec()
+		}
+	}
+
+	// The failing source loses weight but stays online
+	upstreams[0].SetFailurePattern(func(_ int) bool {
+		return true
+	}, http.StatusInternalServerError)
+	execute(100)
+	ss := hc.SourceStateByID(1)
+	if !ss.IsOnline || ss.Weight != 2 {
+		t.Fatalf("unexpected failing source state [online=%v] [weight=%v]", ss.IsOnline, ss.Weight)
+	}
+	if ss = hc.SourceStateByID(2); ss.Weight != 10 {
+		t.Fatalf("unexpected healthy source weight [weight=%v]", ss.Weight)
+	}
+
+	// And recovers it once the errors subside
+	upstreams[0].SetFailurePattern(nil, 0)
+	execute(200)
+	if ss = hc.SourceStateByID(1); ss.Weight != 10 {
+		t.Fatalf("unexpected recovered source weight [weight=%v]", ss.Weight)
+	}
+
+	// The weights set by a traffic split must be restored after the errors subside
+	servers := hc.Balancer().Servers()
+	err = hc.Balancer().SetTrafficSplit(map[*loadbalancer.Server]float64{
+		servers[0]: 75,
+		servers[1]: 25,
+	})
+	if err != nil {
+		t.Fatalf("unable to set traffic split [err=%v]", err)
+	}
+	upstreams[0].SetFailurePattern(func(_ int) bool {
+		return true
+	}, http.StatusInternalServerError)
+	execute(100)
+	if ss = hc.SourceStateByID(1); ss.Weight != 2 {
+		t.Fatalf("unexpected failing source weight [weight=%v]", ss.Weight)
+	}
+	upstreams[0].SetFailurePattern(nil, 0)
+	execute(200)
+	if ss = hc.SourceStateByID(1); ss.Weight != 3 {
+		t.Fatalf("unexpected recovered source weight [weight=%v]", ss.Weight)
+	}
+	if ss = hc.SourceStateByID(2); ss.Weight != 1 {
+		t.Fatalf("unexpected healthy source weight [weight=%v]", ss.Weight)
+	}
+}
+
+func TestHttpClientProbe(t *testing.T) {
+	u := httpclienttest.NewUpstream("upstream1")
+	defer u.Close()
+	u.SetFailurePattern(httpclienttest.FailFirst(5), http.StatusInternalServerError)
+
+	hc := httpclient.Create()
+	err := hc.AddSource(u.URL(), nil, loadbalancer.ServerOptions{
+		Weight:      10,
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+	err = hc.SetAdaptiveWeights(&httpclient.AdaptiveWeightOptions{
+		Window: 1,
+	})
+	if err != nil {
+		t.Fatalf("unable to set adaptive weights [err=%v]", err)
+	}
+
+	probe := func(setOffline bool) {
+		_ = hc.NewRequest(context.Background(), "/health").
+			Probe(true).
+			Callback(func (ctx context.Context, res httpclient.Response) error {
+				if setOffline {
+					res.SetOffline()
+				}
+				if res.StatusCode >= 500 {
+					return errors.New("server error")
+				}
+				return nil
+			}).
+			Exec()
+	}
+
+	// Failed probes are not accounted
+	for i := 0; i < 4; i++ {
+		probe(false)
+	}
+	ss := hc.SourceStateByID(1)
+	if len(ss.TagStats) != 0 || ss.Weight != 10 {
+		t.Fatalf("unexpected source state after probes [stats=%v] [weight=%v]", ss.TagStats, ss.Weight)
+	}
+
+	// But they can still put the source offline
+	probe(true)
+	if ss = hc.SourceStateByID(1); ss.IsOnline {
+		t.Fatal("expected the source to be offline")
+	}
+}
+
+func TestHttpClientProbeBreaker(t *testing.T) {
+	u := httpclienttest.NewUpstream("upstream1")
+	defer u.Close()
+	u.SetFailurePattern(func(_ int) bool {
+		return true
+	}, http.StatusInternalServerError)
+
+	hc := httpclient.Create()
+	err := hc.AddSource(u.URL(), nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+	err = hc.SetCircuitBreaker(&httpclient.CircuitBreakerOptions{
+		FailureRatio: 0.5,
+		Window:       time.Minute,
+		MinRequests:  2,
+	})
+	if err != nil {
+		t.Fatalf("unable to set circuit breaker [err=%v]", err)
+	}
+
+	// Failed probes must not trip the breaker
+	for i := 0; i < 5; i++ {
+		_ = hc.NewRequest(context.Background(), "/health").
+			Probe(true).
+			Callback(func (ctx context.Context, res httpclient.Response) error {
+				return errors.New("server error")
+			}).
+			Exec()
+	}
+	err = hc.NewRequest(context.Background(), "/test").Exec()
+	if errors.Is(err, httpclient.ErrCircuitOpen) {
+		t.Fatalf("unexpected open circuit after probes [err=%v]", err)
+	}
+	if u.Requests() != 6 {
+		t.Fatalf("unexpected requests count [count=%v]", u.Requests())
+	}
+}
+
+func TestHttpClientRoundTripper(t *testing.T) {
+	hc := httpclient.Create()
+	hc.SetUnhealthyStatus(http.StatusServiceUnavailable)
+	upstreams := make([]*httpclienttest.Upstream, 0)
+	for idx := 1; idx <= 2; idx++ {
+		u := httpclienttest.NewUpstream(fmt.Sprintf("upstream%v", idx))
+		defer u.Close()
+		upstreams = append(upstreams, u)
+
+		err := hc.AddSource(u.URL(), nil, loadbalancer.ServerOptions{
+			MaxFails:    1,
+			FailTimeout: time.Minute,
+		})
+		if err != nil {
+			t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+		}
+	}
+	upstreams[0].SetOffline(true)
+	upstreams[1].SetResponse(http.StatusOK, []byte("hello"))
+
+	client := http.Client{
+		Transport: hc.RoundTripper(),
+	}
+	for i := 0; i < 4; i++ {
+		res, err := client.Post("http://api.invalid/test?q=1", "text/plain", strings.NewReader("body"))
+		if err != nil {
+			t.Fatalf("unable to execute request [err=%v]", err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		if res.StatusCode != http.StatusOK || string(body) != "hello" {
+			t.Fatalf("unexpected response [status=%v] [body=%v]", res.StatusCode, string(body))
+		}
+		if res.Header.Get(httpclienttest.UpstreamHeader) != "upstream2" {
+			t.Fatalf("unexpected upstream [name=%v]", res.Header.Get(httpclienttest.UpstreamHeader))
+		}
+	}
+}
+
+func TestHttpClientMaxWait(t *testing.T) {
+	u := httpclienttest.NewUpstream("upstream1")
+	defer u.Close()
+	u.SetLatency(150 * time.Millisecond)
+
+	hc := httpclient.Create()
+	err := hc.AddSource(u.URL(), nil, loadbalancer.ServerOptions{
+		MaxConcurrent: 1,
+	})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	// Keep the only slot busy
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, _, _ = hc.NewRequest(context.Background(), "/slow").Do()
+	}()
+	defer wg.Wait()
+	time.Sleep(30 * time.Millisecond)
+
+	// Without waiting, the request fails immediately
+	_, _, err = hc.NewRequest(context.Background(), "/test").Do()
+	if err == nil {
+		t.Fatal("expected no available server error")
+	}
+
+	// Otherwise, it waits for the slot to be released
+	waitTime := time.Duration(0)
+	err = hc.NewRequest(context.Background(), "/test").
+		MaxWait(time.Second).
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			waitTime = res.WaitTime()
+			return res.Err()
+		}).
+		Exec()
+	if err != nil {
+		t.Fatalf("unable to execute request [err=%v]", err)
+	}
+	if waitTime < 50*time.Millisecond {
+		t.Fatalf("unexpected wait time [wait=%v]", waitTime)
+	}
+	if ss := hc.SourceStateByID(1); ss.WaitTime != waitTime || ss.AvgWaitTime <= 0 {
+		t.Fatalf("unexpected wait time stats [last=%v] [avg=%v]", ss.WaitTime, ss.AvgWaitTime)
+	}
+}
+
+func TestHttpClientInFlightState(t *testing.T) {
+	u := httpclienttest.NewUpstream("upstream1")
+	defer u.Close()
+	u.SetLatency(100 * time.Millisecond)
+
+	hc := httpclient.Create()
+	err := hc.AddSource(u.URL(), nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, _ = hc.NewRequest(context.Background(), "/slow").Do()
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if ss := hc.SourceStateByID(1); ss.InFlight != 2 {
+		t.Fatalf("unexpected in-flight requests [count=%v]", ss.InFlight)
+	}
+
+	wg.Wait()
+	if ss := hc.SourceStateByID(1); ss.InFlight != 0 {
+		t.Fatalf("unexpected in-flight requests after completion [count=%v]", ss.InFlight)
+	}
+}
+
+func TestHttpClientRedirectLoop(t *testing.T) {
+	// Create two servers redirecting to each other
+	var otherURL [2]string
+	servers := make([]*httptest.Server, 0)
+	for idx := 0; idx < 2; idx++ {
+		other := 1 - idx
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, otherURL[other]+r.URL.Path, http.StatusFound)
+		}))
+		defer srv.Close()
+		servers = append(servers, srv)
+	}
+	otherURL[0] = servers[0].URL
+	otherURL[1] = servers[1].URL
+
+	hc := httpclient.Create()
+	err := hc.AddSource(servers[0].URL, nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	err = hc.NewRequest(context.Background(), "/test").Exec()
+	if !errors.Is(err, httpclient.ErrRedirectLoop) {
+		t.Fatalf("expected a redirect loop error [err=%v]", err)
+	}
+}
+
+func TestHttpClientRetryLoop(t *testing.T) {
+	hc := httpclient.Create()
+	for idx := 1; idx <= 2; idx++ {
+		u := httpclienttest.NewUpstream(fmt.Sprintf("upstream%v", idx))
+		defer u.Close()
+
+		err := hc.AddSource(u.URL(), nil, loadbalancer.ServerOptions{})
+		if err != nil {
+			t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+		}
+	}
+
+	// Keep retrying, bouncing between both sources
+	attempts := 0
+	ctx := httpclient.WithForcedRetries(context.Background(), true, true, true, true)
+	err := hc.NewRequest(ctx, "/test").
+		DetectRetryLoops(true).
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			attempts += 1
+			return nil
+		}).
+		Exec()
+	if !errors.Is(err, httpclient.ErrRetryLoop) {
+		t.Fatalf("expected a retry loop error [err=%v]", err)
+	}
+	if attempts != 2 {
+		t.Fatalf("unexpected number of attempts [attempts=%v]", attempts)
+	}
+}
+
+func TestHttpClientValidate(t *testing.T) {
+	u := httpclienttest.NewUpstream("upstream")
+	defer u.Close()
+
+	down := httpclienttest.NewUpstream("down")
+	downURL := down.URL()
+	down.Close()
+
+	hc := httpclient.Create()
+	err := hc.AddSource(u.URL(), nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	// A valid configuration passes
+	err = hc.Validate(context.Background(), true)
+	if err != nil {
+		t.Fatalf("unexpected validation error [err=%v]", err)
+	}
+
+	// Add the same server written differently and an unreachable source reusing a name
+	err = hc.AddSource(strings.Replace(u.URL(), "127.0.0.1", "localhost", 1), nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+	err = hc.AddSource(strings.Replace(u.URL(), "127.0.0.1", "LOCALHOST", 1), nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+	err = hc.AddSource(downURL, nil, loadbalancer.ServerOptions{
+		Name: u.URL(),
+	})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	// Without the reachability check, only the configuration problems are reported
+	err = hc.Validate(context.Background(), false)
+	var validationErr *httpclient.ValidationError
+	if !errors.As(err, &validationErr) || !errors.Is(err, httpclient.ErrInvalidConfig) {
+		t.Fatalf("expected a validation error [err=%v]", err)
+	}
+	if len(validationErr.Errors) != 2 {
+		t.Fatalf("unexpected number of problems [err=%v]", err)
+	}
+
+	// With it, the unreachable source is reported too
+	err = hc.Validate(context.Background(), true)
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("expected a validation error [err=%v]", err)
+	}
+	if len(validationErr.Errors) != 3 {
+		t.Fatalf("unexpected number of problems [err=%v]", err)
+	}
+
+	// The same backend can be used in different pools
+	hc = httpclient.Create()
+	for _, pool := range []string{"a", "b"} {
+		err = hc.AddSourceToPool(pool, u.URL(), nil, loadbalancer.ServerOptions{})
+		if err != nil {
+			t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+		}
+	}
+	err = hc.Validate(context.Background(), true)
+	if err != nil {
+		t.Fatalf("unexpected validation error [err=%v]", err)
+	}
+}
+
+func TestHttpClientForceBackup(t *testing.T) {
+	hc := httpclient.Create()
+	primary := httpclienttest.NewUpstream("primary")
+	defer primary.Close()
+	err := hc.AddSource(primary.URL(), nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	execute := func(req *httpclient.Request) (bool, error) {
+		isBackup := false
+		err := req.
+			Callback(func (ctx context.Context, res httpclient.Response) error {
+				isBackup = res.SourceIsBackup()
+				return nil
+			}).
+			Exec()
+		return isBackup, err
+	}
+
+	// Without backups, forced requests fail and preferred ones use the primary source
+	_, err = execute(hc.NewRequest(context.Background(), "/test").ForceBackup())
+	if err == nil {
+		t.Fatal("expected an error without backup sources")
+	}
+	isBackup, err := execute(hc.NewRequest(context.Background(), "/test").PreferBackup())
+	if err != nil {
+		t.Fatalf("unable to execute request [err=%v]", err)
+	}
+	if isBackup {
+		t.Fatal("unexpected backup source")
+	}
+
+	backup := httpclienttest.NewUpstream("backup")
+	defer backup.Close()
+	err = hc.AddSource(backup.URL(), nil, loadbalancer.ServerOptions{
+		IsBackup: true,
+	})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	// The backup source is used while the primary one is online
+	isBackup, err = execute(hc.NewRequest(context.Background(), "/test").ForceBackup())
+	if err != nil {
+		t.Fatalf("unable to execute request [err=%v]", err)
+	}
+	if !isBackup || backup.Requests() != 1 {
+		t.Fatal("the request was not sent to the backup source")
+	}
+	if !hc.SourceStateByID(1).IsOnline {
+		t.Fatal("the primary source should remain online")
+	}
+}
+
+func TestHttpClientSetDefaultTimeout(t *testing.T) {
+	u := httpclienttest.NewUpstream("upstream")
+	defer u.Close()
+	u.SetLatency(200 * time.Millisecond)
+
+	hc := httpclient.Create()
+	err := hc.AddSource(u.URL(), nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	if hc.SetDefaultTimeout(0) == nil {
+		t.Fatal("expected an error with a zero timeout")
+	}
+	err = hc.SetDefaultTimeout(50 * time.Millisecond)
+	if err != nil {
+		t.Fatalf("unable to set the default timeout [err=%v]", err)
+	}
+
+	// New requests use the default timeout
+	err = hc.NewRequest(context.Background(), "/test").RetryPolicy(httpclient.NoRetry()).Exec()
+	if !errors.Is(err, httpclient.ErrTimeout) {
+		t.Fatalf("expected a timeout error [err=%v]", err)
+	}
+
+	// But it can be overridden
+	err = hc.NewRequest(context.Background(), "/test").Timeout(time.Second).Exec()
+	if err != nil {
+		t.Fatalf("unable to execute request [err=%v]", err)
+	}
+}
+
+func TestHttpClientExecAsync(t *testing.T) {
+	hc := httpclient.Create()
+	upstreams := make([]*httpclienttest.Upstream, 0)
+	for idx := 1; idx <= 2; idx++ {
+		u := httpclienttest.NewUpstream(fmt.Sprintf("upstream%v", idx))
+		defer u.Close()
+		u.SetLatency(100 * time.Millisecond)
+		upstreams = append(upstreams, u)
+
+		err := hc.AddSource(u.URL(), nil, loadbalancer.ServerOptions{})
+		if err != nil {
+			t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+		}
+	}
+
+	// Issue several requests in parallel
+	start := time.Now()
+	results := make([]<-chan error, 0)
+	for idx := 0; idx < 4; idx++ {
+		results = append(results, hc.NewRequest(context.Background(), "/test").ExecAsync())
+	}
+	for _, ch := range results {
+		if err := <-ch; err != nil {
+			t.Fatalf("unable to execute request [err=%v]", err)
+		}
+		if _, ok := <-ch; ok {
+			t.Fatal("the channel was not closed")
+		}
+	}
+	if elapsed := time.Since(start); elapsed >= 400*time.Millisecond {
+		t.Fatalf("requests were not executed in parallel [elapsed=%v]", elapsed)
+	}
+	if upstreams[0].Requests()+upstreams[1].Requests() != 4 {
+		t.Fatal("unexpected number of requests")
+	}
+
+	// Canceling the context aborts the request
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := hc.NewRequest(ctx, "/test").ExecAsync()
+	cancel()
+	if err := <-ch; !errors.Is(err, httpclient.ErrCanceled) {
+		t.Fatalf("expected a canceled error [err=%v]", err)
+	}
+}
+
+func TestHttpClientRetryByClass(t *testing.T) {
+	u := httpclienttest.NewUpstream("upstream")
+	defer u.Close()
+
+	down := httpclienttest.NewUpstream("down")
+	downURL := down.URL()
+	down.Close()
+
+	hc := httpclient.Create()
+	err := hc.AddSource(u.URL(), nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+	err = hc.AddSourceToPool("down", downURL, nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	policy := httpclient.RetryByClass(httpclient.ClassRetryLimits{
+		Network:     3,
+		ServerError: 2,
+		Status: map[int]int{
+			http.StatusTooManyRequests: 1,
+		},
+	})
+	execute := func(pool string, statusCode int) (int, error) {
+		u.ResetRequests()
+		u.SetFailurePattern(httpclienttest.FailFirst(10), statusCode)
+
+		attempts := 0
+		err := hc.NewRequest(context.Background(), "/test").
+			Pool(pool).
+			RetryPolicy(policy).
+			Callback(func (ctx context.Context, res httpclient.Response) error {
+				attempts += 1
+				return res.Err()
+			}).
+			Exec()
+		return attempts, err
+	}
+
+	tests := []struct {
+		pool       string
+		statusCode int
+		attempts   int
+	}{
+		{"", http.StatusInternalServerError, 3},
+		{"", http.StatusNotFound, 1},
+		{"", http.StatusTooManyRequests, 2},
+		{"down", 0, 4},
+	}
+	for _, test := range tests {
+		attempts, _ := execute(test.pool, test.statusCode)
+		if attempts != test.attempts {
+			t.Fatalf("unexpected number of attempts [status=%v] [attempts=%v]", test.statusCode, attempts)
+		}
+	}
+
+	// The state of each request is independent
+	attempts, _ := execute("", http.StatusInternalServerError)
+	if attempts != 3 {
+		t.Fatalf("unexpected number of attempts [attempts=%v]", attempts)
+	}
+}
+
+func TestHttpClientBalancer(t *testing.T) {
+	hc := httpclient.Create()
+	for idx := 1; idx <= 2; idx++ {
+		u := httpclienttest.NewUpstream(fmt.Sprintf("upstream%v", idx))
+		defer u.Close()
+
+		err := hc.AddSource(u.URL(), nil, loadbalancer.ServerOptions{
+			MaxFails:    1,
+			FailTimeout: time.Minute,
+		})
+		if err != nil {
+			t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+		}
+	}
+
+	lb := hc.Balancer()
+	if lb == nil || lb != hc.PoolBalancer("") {
+		t.Fatal("unexpected default pool load balancer")
+	}
+	if hc.PoolBalancer("unknown") != nil {
+		t.Fatal("unexpected load balancer for an unknown pool")
+	}
+	if len(lb.Snapshot().Servers) != 2 {
+		t.Fatal("unexpected number of servers")
+	}
+
+	// Changes made through the balancer are seen by the client
+	lb.Servers()[0].SetOfflineFor(time.Minute)
+	if hc.SourceStateByID(1).IsOnline {
+		t.Fatal("the source should be offline")
+	}
+	for idx := 0; idx < 3; idx++ {
+		sourceID := 0
+		err := hc.NewRequest(context.Background(), "/test").
+			Callback(func (ctx context.Context, res httpclient.Response) error {
+				sourceID = res.SourceID()
+				return nil
+			}).
+			Exec()
+		if err != nil {
+			t.Fatalf("unable to execute request [err=%v]", err)
+		}
+		if sourceID != 2 {
+			t.Fatalf("unexpected source [id=%v]", sourceID)
+		}
+	}
+}
+
+func TestHttpClientBroadcastRetryStatus(t *testing.T) {
+	upstreams := make([]*httpclienttest.Upstream, 0)
+	hc := httpclient.Create()
+	for idx := 1; idx <= 2; idx++ {
+		u := httpclienttest.NewUpstream(fmt.Sprintf("upstream%v", idx))
+		defer u.Close()
+		u.SetResponse(http.StatusBadGateway, nil)
+		upstreams = append(upstreams, u)
+
+		err := hc.AddSource(u.URL(), nil, loadbalancer.ServerOptions{})
+		if err != nil {
+			t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+		}
+	}
+	err := hc.SetRetryBudget(&httpclient.RetryBudgetOptions{
+		Ratio:  0.5,
+		Window: time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("unable to set retry budget [err=%v]", err)
+	}
+
+	// The retry status codes must not make a source to receive the request twice
+	results, err := hc.NewRequest(context.Background(), "/invalidate").
+		RetryOnStatus(http.StatusBadGateway).
+		WithBackoff(httpclient.ConstantBackoff(time.Millisecond)).
+		Broadcast()
+	if err != nil {
+		t.Fatalf("unexpected error [err=%v]", err)
+	}
+	for idx, u := range upstreams {
+		if results[idx].StatusCode != http.StatusBadGateway {
+			t.Fatalf("unexpected result [result=%+v]", results[idx])
+		}
+		if u.Requests() != 1 {
+			t.Fatalf("unexpected number of requests [upstream=%v] [requests=%v]", u.Name(), u.Requests())
+		}
+	}
+
+	// And the broadcast is accounted as a single request in the retry budget
+	state, ok := hc.RetryBudgetState()
+	if !ok || state.Requests != 1 || state.Retries != 0 {
+		t.Fatalf("unexpected retry budget state [state=%+v]", state)
+	}
+}
+
+func TestHttpClientSetTransport(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	// Replace the transport and check requests still go through
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 10
+	hc.SetTransport(transport)
+
+	for idx := 0; idx < 2; idx++ {
+		err := hc.NewRequest(context.Background(), "/test").
+			Method("GET").
+			Callback(func (ctx context.Context, res httpclient.Response) error {
+				if res.Err() != nil {
+					return res.Err()
+				}
+				if res.StatusCode != 200 {
+					return fmt.Errorf("unexpected status code %v", res.StatusCode)
+				}
+
+				// Done
+				return nil
+			}).
+			Exec()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+}
+
 // -----------------------------------------------------------------------------
 
 func createTestEnvironment(t *testing.T) (*MockServer, *MockServer, *httpclient.HttpClient) {
@@ -243,6 +3408,16 @@ func createTestEnvironment(t *testing.T) (*MockServer, *MockServer, *httpclient.
 	return server1, server2, hc
 }
 
+func waitSourceOnlineState(t *testing.T, hc *httpclient.HttpClient, index int, online bool) {
+	for start := time.Now(); time.Since(start) < 2*time.Second; {
+		if hc.SourceState(index).IsOnline == online {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("source %v online state did not change to %v", index+1, online)
+}
+
 func createMockTimestampServer(serverName string) *MockServer {
 	ms := MockServer{}
 
@@ -251,6 +3426,7 @@ func createMockTimestampServer(serverName string) *MockServer {
 		w.Header().Set("x-server", serverName)
 
 		if atomic.LoadInt32(&ms.simulateDown) != 0 {
+			w.Header().Set("Retry-After", "1")
 			w.WriteHeader(http.StatusServiceUnavailable)
 			_, _ = w.Write([]byte("service unavailable"))
 			return
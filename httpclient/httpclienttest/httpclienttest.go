@@ -0,0 +1,159 @@
+// See the LICENSE file for license details.
+
+// Package httpclienttest provides a configurable fake upstream server to write failover tests of load-balanced
+// http clients.
+package httpclienttest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+// UpstreamHeader is the response header that contains the name of the upstream that served the request.
+const UpstreamHeader = "X-Upstream"
+
+// -----------------------------------------------------------------------------
+
+// Upstream is a fake upstream server.
+type Upstream struct {
+	srv        *httptest.Server
+	name       string
+	mtx        sync.Mutex
+	statusCode int
+	body       []byte
+	latency    time.Duration
+	offline    bool
+	pattern    FailurePattern
+	failStatus int
+	requests   int
+}
+
+// FailurePattern decides if the request with the given zero-based index must fail.
+type FailurePattern func(reqIndex int) bool
+
+// -----------------------------------------------------------------------------
+
+// NewUpstream creates and starts a new fake upstream server that, by default, replies all requests with a 200
+// status code.
+func NewUpstream(name string) *Upstream {
+	u := &Upstream{
+		name:       name,
+		mtx:        sync.Mutex{},
+		statusCode: http.StatusOK,
+		failStatus: http.StatusInternalServerError,
+	}
+	u.srv = httptest.NewServer(http.HandlerFunc(u.serveHTTP))
+	return u
+}
+
+// FailFirst returns a failure pattern that fails the first n requests.
+func FailFirst(n int) FailurePattern {
+	return func(reqIndex int) bool {
+		return reqIndex < n
+	}
+}
+
+// FailEveryOther returns a failure pattern that fails one of each two requests, starting with the first one.
+func FailEveryOther() FailurePattern {
+	return func(reqIndex int) bool {
+		return reqIndex%2 == 0
+	}
+}
+
+// Close stops the upstream server.
+func (u *Upstream) Close() {
+	u.srv.Close()
+}
+
+// URL returns the base url of the upstream server.
+func (u *Upstream) URL() string {
+	return u.srv.URL
+}
+
+// Name returns the name of the upstream server sent in the UpstreamHeader response header.
+func (u *Upstream) Name() string {
+	return u.name
+}
+
+// SetResponse sets the status code and body sent by requests that don't fail.
+func (u *Upstream) SetResponse(statusCode int, body []byte) {
+	u.mtx.Lock()
+	u.statusCode = statusCode
+	u.body = body
+	u.mtx.Unlock()
+}
+
+// SetLatency sets the time to wait before replying each request.
+func (u *Upstream) SetLatency(latency time.Duration) {
+	u.mtx.Lock()
+	u.latency = latency
+	u.mtx.Unlock()
+}
+
+// SetFailurePattern sets the pattern used to decide which requests fail and the status code they return. Use a
+// nil pattern to disable failures.
+func (u *Upstream) SetFailurePattern(pattern FailurePattern, statusCode int) {
+	u.mtx.Lock()
+	u.pattern = pattern
+	u.failStatus = statusCode
+	u.mtx.Unlock()
+}
+
+// SetOffline simulates the upstream is down by replying all requests with a 503 status code.
+func (u *Upstream) SetOffline(offline bool) {
+	u.mtx.Lock()
+	u.offline = offline
+	u.mtx.Unlock()
+}
+
+// Requests returns the number of requests received since the upstream was created or the counter reset.
+func (u *Upstream) Requests() int {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	return u.requests
+}
+
+// ResetRequests resets the received requests counter. It also restarts the failure pattern.
+func (u *Upstream) ResetRequests() {
+	u.mtx.Lock()
+	u.requests = 0
+	u.mtx.Unlock()
+}
+
+func (u *Upstream) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	// Get the reply settings
+	u.mtx.Lock()
+	reqIndex := u.requests
+	u.requests += 1
+	statusCode := u.statusCode
+	body := u.body
+	if u.offline {
+		statusCode = http.StatusServiceUnavailable
+		body = nil
+	} else if u.pattern != nil && u.pattern(reqIndex) {
+		statusCode = u.failStatus
+		body = nil
+	}
+	latency := u.latency
+	u.mtx.Unlock()
+
+	// Inject latency
+	if latency > 0 {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(latency):
+		}
+	}
+
+	// Send the response
+	w.Header().Set(UpstreamHeader, u.name)
+	w.WriteHeader(statusCode)
+	if len(body) > 0 {
+		_, _ = w.Write(body)
+	}
+}
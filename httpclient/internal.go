@@ -3,7 +3,16 @@
 package httpclient
 
 import (
+	"context"
 	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mxmauro/go-loadbalancer/v2"
 )
@@ -21,25 +30,342 @@ func (c *HttpClient) balancerEventHandler(eventType int, srv *loadbalancer.Serve
 	switch eventType {
 	case loadbalancer.ServerUpEvent:
 		src.setOnlineStatus(true)
-		if c.eventHandler != nil {
-			c.eventHandler(ServerUpEvent, src.ID(), nil)
-		}
+		c.callEventHandler(ServerUpEvent, src.ID(), nil)
 
 	case loadbalancer.ServerDownEvent:
 		src.setOnlineStatus(false)
-		if c.eventHandler != nil {
-			c.eventHandler(ServerDownEvent, src.ID(), errServerDown)
-		}
+		c.callEventHandler(ServerDownEvent, src.ID(), errServerDown)
 	}
 }
 
-func (c *HttpClient) raiseRequestEvent(srv *loadbalancer.Server, err error) {
-	if c.eventHandler != nil {
-		src := srv.UserData().(*Source)
+func (c *HttpClient) raiseRequestEvent(srv *loadbalancer.Server, req *Request, err error) {
+	src := srv.UserData().(*Source)
+
+	// Probes are not accounted in the source stats
+	if !req.probe {
 		if err == nil {
-			c.eventHandler(RequestSucceededEvent, src.ID(), nil)
+			src.recordTagStat(req.tag, tagStatSucceeded)
 		} else {
-			c.eventHandler(RequestFailedEvent, src.ID(), err)
+			src.recordTagStat(req.tag, tagStatFailed)
+		}
+	}
+
+	// Track the result in the circuit breaker
+	if c.breaker != nil && !req.probe {
+		c.breaker.record(err == nil)
+	}
+
+	// Adjust the source weight to its error rate
+	if c.adaptiveWeights != nil && !req.probe {
+		c.adaptiveWeights.record(src, err == nil)
+	}
+	if err == nil {
+		c.callEventHandler(RequestSucceededEvent, src.ID(), nil)
+	} else {
+		c.callEventHandler(RequestFailedEvent, src.ID(), err)
+	}
+}
+
+func (c *HttpClient) raiseRetryEvent(srv *loadbalancer.Server, req *Request, err error) {
+	src := srv.UserData().(*Source)
+	if !req.probe {
+		src.recordTagStat(req.tag, tagStatRetried)
+	}
+	c.callEventHandler(RequestRetryEvent, src.ID(), err)
+}
+
+// confirmSource raises the SourceConfirmedEvent the first time the source is successfully contacted
+func (c *HttpClient) confirmSource(src *Source) {
+	if atomic.CompareAndSwapInt32(&src.confirmed, 0, 1) {
+		c.callEventHandler(SourceConfirmedEvent, src.ID(), nil)
+	}
+}
+
+func (c *HttpClient) callEventHandler(eventType int, sourceId int, err error) {
+	if c.eventHandler != nil {
+		// A buggy handler must not break the request path
+		defer func() {
+			_ = recover()
+		}()
+
+		c.eventHandler(eventType, sourceId, err)
+	}
+}
+
+// failureWeight returns how much a network error counts towards MaxFails
+func (c *HttpClient) failureWeight(kind FailureKind, err error) float64 {
+	if c.classifier == nil {
+		if kind == FailureSlowBody {
+			return 0
+		}
+		return 1
+	}
+	return c.classifier(kind, err)
+}
+
+func (req *Request) isRetryStatus(statusCode int) bool {
+	_, ok := req.retryStatus[statusCode]
+	return ok
+}
+
+// checkRedirectFunc returns the redirect policy that stops following redirects whose status code triggers a fail
+// over, so the response is handed to the caller, and the ones going back to an already visited url
+func (c *HttpClient) checkRedirectFunc(req *Request) func(*http.Request, []*http.Request) error {
+	return func(redirectReq *http.Request, via []*http.Request) error {
+		if redirectReq.Response != nil {
+			statusCode := redirectReq.Response.StatusCode
+			if req.isRetryStatus(statusCode) || c.isUnhealthyStatus(statusCode) {
+				return http.ErrUseLastResponse
+			}
+		}
+
+		// Stop if the servers redirect to each other
+		if isRedirectLoop(redirectReq, via) {
+			return ErrRedirectLoop
+		}
+
+		// Apply the default policy
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+}
+
+func (c *HttpClient) isUnhealthyStatus(statusCode int) bool {
+	_, ok := c.unhealthyStatus[statusCode]
+	return ok
+}
+
+// selectServer returns the server to use for the next request attempt, with a concurrency slot reserved, and the
+// function to release it
+func (c *HttpClient) selectServer(lb *loadbalancer.LoadBalancer, req *Request) (*loadbalancer.Server, func()) {
+	var srv *loadbalancer.Server
+	var release func()
+
+	if req.pinnedSourceID > 0 {
+		src := c.sources[req.pinnedSourceID-1]
+		if src.IsOnline() {
+			src.srv.BeginRequest()
+			srv, release = src.srv, src.srv.EndRequest
+		} else if !req.pinFallback {
+			return nil, func() {}
+		}
+	}
+	if srv == nil && req.backupOnly {
+		srv, release = lb.AcquireBackup()
+		if srv == nil && !req.backupFallback {
+			return nil, release
+		}
+	}
+	if srv == nil {
+		srv, release = lb.Acquire()
+		if srv == nil {
+			return nil, release
+		}
+	}
+
+	// Track the requests in progress on the source too, so they can be read without the balancer lock
+	src := srv.UserData().(*Source)
+	atomic.AddInt32(&src.inFlight, 1)
+	once := sync.Once{}
+	return srv, func() {
+		once.Do(func() {
+			atomic.AddInt32(&src.inFlight, -1)
+			release()
+		})
+	}
+}
+
+// waitServer polls the balancer until a server is available, the deadline is reached or the context is done
+func (c *HttpClient) waitServer(
+	ctx context.Context, lb *loadbalancer.LoadBalancer, req *Request, deadline time.Time,
+) (*loadbalancer.Server, func()) {
+	for {
+		toWait := time.Until(deadline)
+		if toWait <= 0 {
+			return nil, func() {}
+		}
+		if toWait > serverWaitPollInterval {
+			toWait = serverWaitPollInterval
+		}
+		if waitWithContext(ctx, toWait) != nil {
+			return nil, func() {}
+		}
+
+		srv, release := c.selectServer(lb, req)
+		if srv != nil {
+			return srv, release
+		}
+	}
+}
+
+// selectionCycle returns the number of round-robin selections needed to visit all the servers of the balancer
+func selectionCycle(lb *loadbalancer.LoadBalancer) int {
+	total := 0
+	for _, srv := range lb.Servers() {
+		total += srv.Weight()
+	}
+	return total
+}
+
+func (c *HttpClient) poolSourcesCount(pool string) int {
+	count := 0
+	for _, src := range c.sources {
+		if src.pool == pool {
+			count += 1
+		}
+	}
+	return count
+}
+
+func (c *HttpClient) getTransport() *http.Transport {
+	c.transportMtx.RLock()
+	transport := c.transport
+	c.transportMtx.RUnlock()
+	return transport
+}
+
+func normalizeBaseURL(baseURL string) string {
+	return strings.TrimSuffix(baseURL, "/")
+}
+
+// joinURL builds the url of a resource located at the base url and an optional path prefix. The resource can
+// contain a query string and a fragment but not a scheme or host. Already escaped characters are preserved.
+func joinURL(base string, prefix string, resource string) (string, error) {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	if len(baseURL.Scheme) == 0 || len(baseURL.Host) == 0 {
+		return "", errors.New("invalid base url")
+	}
+
+	resURL, err := url.Parse(resource)
+	if err != nil {
+		return "", err
+	}
+	if len(resURL.Scheme) > 0 || len(resURL.Host) > 0 || len(resURL.Opaque) > 0 || resURL.User != nil {
+		return "", errors.New("invalid resource")
+	}
+
+	// Join the paths ensuring a single slash between them
+	escapedPath := strings.TrimSuffix(baseURL.EscapedPath(), "/")
+	prefix = strings.Trim(prefix, "/")
+	if len(prefix) > 0 {
+		escapedPath += "/" + prefix
+	}
+	resPath := resURL.EscapedPath()
+	if len(resPath) > 0 {
+		escapedPath += "/" + strings.TrimPrefix(resPath, "/")
+	}
+	unescapedPath, err := url.PathUnescape(escapedPath)
+	if err != nil {
+		return "", err
+	}
+
+	// Build the final url
+	u := url.URL{
+		Scheme:      baseURL.Scheme,
+		User:        baseURL.User,
+		Host:        baseURL.Host,
+		Path:        unescapedPath,
+		RawPath:     escapedPath,
+		RawQuery:    resURL.RawQuery,
+		ForceQuery:  resURL.ForceQuery,
+		Fragment:    resURL.Fragment,
+		RawFragment: resURL.RawFragment,
+	}
+	return u.String(), nil
+}
+
+// invokeCallback calls the execution callback and returns the panic value if it panicked
+func invokeCallback(cb ExecCallback, ctx context.Context, res Response) (panicValue interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicValue = r
+		}
+	}()
+
+	err = cb(ctx, res)
+	return
+}
+
+// parseRetryAfter parses a Retry-After header value which can be expressed in seconds or as an http date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if len(value) == 0 {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs <= 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+func isThrottlingStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable
+}
+
+// waitWithContext waits for the specified delay or until the context is done
+func waitWithContext(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+		return contextError(ctx.Err())
+
+	case <-timer.C:
+	}
+
+	// Done
+	return nil
+}
+
+// isTimeoutError returns true if the error is a deadline or network timeout
+func isTimeoutError(err error) bool {
+	var netErr net.Error
+
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// contextError converts the error of a done context into ours
+func contextError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	return ErrCanceled
+}
+
+// sourceHeaders returns the client default headers overridden by the ones of the source, as sent on every request
+func (c *HttpClient) sourceHeaders(src *Source) http.Header {
+	header := c.defaultHeader.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	mergeHeaders(header, src.headers())
+	return header
+}
+
+func mergeHeaders(dest http.Header, src http.Header) {
+	for k, v := range src {
+		vLen := len(v)
+		if vLen > 0 {
+			dest.Set(k, v[0])
+			for vIdx := 1; vIdx < vLen; vIdx++ {
+				dest.Add(k, v[vIdx])
+			}
 		}
 	}
 }
@@ -0,0 +1,56 @@
+// See the LICENSE file for license details.
+
+package httpclient
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// -----------------------------------------------------------------------------
+
+const (
+	errUnableToDecodeResponse = "failed to decode response body"
+)
+
+// -----------------------------------------------------------------------------
+
+// ExecJSON runs the request, like Do, and decodes the JSON body of a 2xx response into a value of type T. Non 2xx
+// responses return a StatusError with the status code and body. An empty body returns the zero value of T. The
+// Accept header is set to application/json unless the request already has one.
+func ExecJSON[T any](req *Request) (T, error) {
+	var result T
+
+	if len(req.headers.Get("Accept")) == 0 {
+		headers := req.headers.Clone()
+		if headers == nil {
+			headers = make(http.Header)
+		}
+		headers.Set("Accept", "application/json")
+		req.headers = headers
+	}
+
+	body, res, err := req.Do()
+	if err != nil {
+		return result, err
+	}
+
+	url := ""
+	if res.Request != nil && res.Request.URL != nil {
+		url = res.Request.URL.String()
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return result, newStatusError(url, res.StatusCode, body)
+	}
+
+	if len(body) > 0 {
+		err = json.Unmarshal(body, &result)
+		if err != nil {
+			return result, req.client.newError(err, errUnableToDecodeResponse, url, res.StatusCode)
+		}
+	}
+
+	// Done
+	return result, nil
+}
@@ -0,0 +1,55 @@
+// See the LICENSE file for license details.
+
+package httpclient
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// -----------------------------------------------------------------------------
+
+const (
+	errRedirectLoopDetected = "redirect loop detected"
+	errRetryLoopDetected    = "retry loop detected"
+)
+
+// -----------------------------------------------------------------------------
+
+var ErrRedirectLoop = errors.New("redirect loop")
+var ErrRetryLoop = errors.New("retry loop")
+
+// -----------------------------------------------------------------------------
+
+// DetectRetryLoops makes Exec to return ErrRetryLoop instead of retrying if the next attempt would be sent to a
+// source and path already tried by this request, for e.g., when failover retries keep bouncing between the same
+// servers. Redirect loops are always detected and reported with ErrRedirectLoop.
+func (req *Request) DetectRetryLoops(detect bool) *Request {
+	req.detectLoops = detect
+	return req
+}
+
+// -----------------------------------------------------------------------------
+
+// visitKey returns the key that identifies the source and path of an attempt
+func visitKey(src *Source, u *url.URL) string {
+	return strconv.Itoa(src.id) + " " + u.RequestURI()
+}
+
+// isRedirectLoop returns true if the redirect target was already visited in the same redirect chain
+func isRedirectLoop(redirectReq *http.Request, via []*http.Request) bool {
+	target := redirectKey(redirectReq.URL)
+	for _, r := range via {
+		if redirectKey(r.URL) == target {
+			return true
+		}
+	}
+	return false
+}
+
+// redirectKey returns the key that identifies the server and path of a redirect hop
+func redirectKey(u *url.URL) string {
+	return u.Scheme + "://" + u.Host + u.RequestURI()
+}
@@ -0,0 +1,81 @@
+// See the LICENSE file for license details.
+
+package httpclient
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+// -----------------------------------------------------------------------------
+
+// SetSourceProxy makes requests sent to the source with the given ID to use the specified proxy url instead of the
+// one set in the client transport. Pass nil to restore the client transport settings. Sources with a proxy use
+// their own copy of the client transport, so their connections are pooled separately.
+func (c *HttpClient) SetSourceProxy(id int, proxyURL *url.URL) error {
+	if id < 1 || id > len(c.sources) {
+		return errors.New("invalid source id")
+	}
+	if proxyURL != nil && (len(proxyURL.Scheme) == 0 || len(proxyURL.Host) == 0) {
+		return errors.New("invalid proxy url")
+	}
+
+	src := c.sources[id-1]
+
+	src.proxyMtx.Lock()
+	oldTransport := src.proxyTransport
+	if proxyURL != nil {
+		u := *proxyURL
+		src.proxyURL = &u
+	} else {
+		src.proxyURL = nil
+	}
+	src.proxyTransport = nil
+	src.proxyBase = nil
+	src.proxyMtx.Unlock()
+
+	// Release the idle connections of the previous transport
+	if oldTransport != nil {
+		oldTransport.CloseIdleConnections()
+	}
+
+	// Done
+	return nil
+}
+
+// transportFor returns the transport to use to access the specified source
+func (c *HttpClient) transportFor(src *Source) *http.Transport {
+	base := c.getTransport()
+
+	src.proxyMtx.Lock()
+	defer src.proxyMtx.Unlock()
+
+	if src.proxyURL == nil {
+		return base
+	}
+
+	// Derive the source transport from the client one, rebuilding it if the client transport was replaced
+	if src.proxyBase != base {
+		if src.proxyTransport != nil {
+			src.proxyTransport.CloseIdleConnections()
+		}
+		t := base.Clone()
+		t.Proxy = http.ProxyURL(src.proxyURL)
+		src.proxyTransport = t
+		src.proxyBase = base
+	}
+	return src.proxyTransport
+}
+
+// closeIdleConnections closes the idle connections of the client transport and of the per-source ones
+func (c *HttpClient) closeIdleConnections() {
+	c.getTransport().CloseIdleConnections()
+	for _, src := range c.sources {
+		src.proxyMtx.Lock()
+		if src.proxyTransport != nil {
+			src.proxyTransport.CloseIdleConnections()
+		}
+		src.proxyMtx.Unlock()
+	}
+}
@@ -15,20 +15,49 @@ import (
 
 const (
 	defaultTimeout = 20 * time.Second
+
+	defaultMaxDoResponseBody = 32 * 1024 * 1024
 )
 
 // -----------------------------------------------------------------------------
 
+// TimeoutFunc calculates the timeout of an attempt given its zero-based number and the time remaining until the
+// overall deadline, set with OverallDeadline or by the request context, or zero if there is no deadline.
+type TimeoutFunc func(attempt int, remaining time.Duration) time.Duration
+
 // Request represents a load-balanced http client request object.
 type Request struct {
-	method  string
-	url     string
-	headers http.Header
-	body    io.Reader
-	ctx context.Context
-	timeout time.Duration
-	callback ExecCallback
-	client  *HttpClient
+	method          string
+	url             string
+	headers         http.Header
+	body            io.Reader
+	bodyFile        string
+	maxBufferedBody int64
+	needTrailers    bool
+	maxResponseSize int64
+	ctx             context.Context
+	timeout         time.Duration
+	timeoutFunc     TimeoutFunc
+	overallDeadline time.Duration
+	maxWait         time.Duration
+	callback        ExecCallback
+	pool            string
+	retryPolicy     RetryPolicy
+	backoff         Backoff
+	pinnedSourceID  int
+	pinFallback     bool
+	backupOnly      bool
+	backupFallback  bool
+	singleAttempt   bool
+	broadcastSub    bool
+	retryDistinct   bool
+	detectLoops     bool
+	session         *Session
+	tag             string
+	probe           bool
+	offlineOnCancel bool
+	retryStatus     map[int]struct{}
+	client          *HttpClient
 }
 
 // -----------------------------------------------------------------------------
@@ -41,7 +70,7 @@ func (c *HttpClient) NewRequest(ctx context.Context, url string) *Request {
 	req := Request{
 		ctx:     ctx,
 		client:  c,
-		timeout: defaultTimeout,
+		timeout: c.defaultTimeout,
 		method:  "GET",
 		url:     url,
 	}
@@ -63,11 +92,13 @@ func (req *Request) Headers(headers http.Header) *Request {
 // Body sets the body of a http client request
 func (req *Request) Body(body io.Reader) *Request {
 	req.body = body
+	req.bodyFile = ""
 	return req
 }
 
 // BodyBytes sets the body of a http client request
 func (req *Request) BodyBytes(body []byte) *Request {
+	req.bodyFile = ""
 	if body != nil {
 		req.body = bytes.NewReader(body)
 	} else {
@@ -76,19 +107,171 @@ func (req *Request) BodyBytes(body []byte) *Request {
 	return req
 }
 
+// BodyFile sets the body of a http client request to the content of the specified file. The file is opened again
+// on each attempt, so retries read it from disk instead of buffering it in memory.
+func (req *Request) BodyFile(path string) *Request {
+	req.body = nil
+	req.bodyFile = path
+	return req
+}
+
+// MaxBufferedBody allows body readers of types that cannot be replayed to be buffered in memory, up to the
+// specified size, so they can be sent again on retries. Zero disables buffering.
+func (req *Request) MaxBufferedBody(size int64) *Request {
+	req.maxBufferedBody = size
+	return req
+}
+
+// NeedTrailers makes the response body to be fully read, up to 32MB, before calling the execution callback, so the
+// trailers are available in the Trailer field of the response. The body is replaced with the buffered one.
+// NOTE: Without this option, trailers are only populated once the callback reads the whole body.
+func (req *Request) NeedTrailers(need bool) *Request {
+	req.needTrailers = need
+	return req
+}
+
+// MaxResponseBytes limits the size of the response body. Reading beyond the limit fails with ErrResponseTooLarge,
+// even if the callback streams the body. It also replaces the 32MB limit of Do and NeedTrailers. Zero means no
+// limit.
+func (req *Request) MaxResponseBytes(n int64) *Request {
+	req.maxResponseSize = n
+	return req
+}
+
 // Timeout sets the request timeout
 func (req *Request) Timeout(timeout time.Duration) *Request {
 	req.timeout = timeout
 	return req
 }
 
-// Callback sets the execution callback
+// TimeoutFunc sets a function that calculates the timeout of each attempt, for e.g., to shrink it as the overall
+// deadline approaches so retries do not exceed the time budget. A returned value of zero or less uses the timeout
+// set with Timeout.
+func (req *Request) TimeoutFunc(fn TimeoutFunc) *Request {
+	req.timeoutFunc = fn
+	return req
+}
+
+// OverallDeadline sets the maximum time the request can take across all attempts. Once exceeded, no more retries
+// are done and ErrTimeout is returned. Zero means no limit.
+func (req *Request) OverallDeadline(d time.Duration) *Request {
+	req.overallDeadline = d
+	return req
+}
+
+// MaxWait sets how long to wait for a server to become available, for e.g., when all of them reached their
+// MaxConcurrent limit, before failing. The time waited is available with Response.WaitTime. Zero, the default,
+// fails immediately.
+func (req *Request) MaxWait(d time.Duration) *Request {
+	req.maxWait = d
+	return req
+}
+
+// Pool sets the name of the source pool to use. Defaults to the pool used by AddSource.
+func (req *Request) Pool(pool string) *Request {
+	req.pool = pool
+	return req
+}
+
+// RetryPolicy sets the policy that decides if a finished attempt must be retried. Calling
+// Response.RetryOnNextServer on the callback always retries regardless of the policy.
+func (req *Request) RetryPolicy(p RetryPolicy) *Request {
+	req.retryPolicy = p
+	return req
+}
+
+// RetryOnStatus sets the list of response status codes that make the request to be retried on the next available
+// server, up to once per source, without counting them as a server failure. Redirects with these status codes, or
+// the ones set with SetUnhealthyStatus, are not followed, for e.g., to fail over when a backend redirects to a
+// maintenance page.
+func (req *Request) RetryOnStatus(codes ...int) *Request {
+	req.retryStatus = make(map[int]struct{}, len(codes))
+	for _, code := range codes {
+		req.retryStatus[code] = struct{}{}
+	}
+	return req
+}
+
+// WithBackoff sets the backoff that calculates the delay to wait between retries. If the retry policy or the
+// server, through the Retry-After header, request a longer delay, the longest one is used.
+func (req *Request) WithBackoff(b Backoff) *Request {
+	req.backoff = b
+	return req
+}
+
+// RetryDistinct makes retries to be sent to sources not tried yet by this request. Once all the sources of the pool
+// were tried, Exec returns an AttemptsError with the errors of all the attempts.
+func (req *Request) RetryDistinct(distinct bool) *Request {
+	req.retryDistinct = distinct
+	return req
+}
+
+// PinSource forces the request to be sent to the source with the given ID, bypassing the load balancing. The
+// request fails if the source is offline or does not belong to the request pool.
+func (req *Request) PinSource(id int) *Request {
+	req.pinnedSourceID = id
+	req.pinFallback = false
+	return req
+}
+
+// PreferSource sends the request to the source with the given ID if it is online. Else, or if the request is
+// retried, the next available server in the request pool is used.
+func (req *Request) PreferSource(id int) *Request {
+	req.pinnedSourceID = id
+	req.pinFallback = true
+	return req
+}
+
+// ForceBackup makes the request to be sent only to the backup sources of the request pool, even if there are primary
+// sources online, for e.g., to verify the failover path works during a drill. The request fails if no backup source
+// is available.
+func (req *Request) ForceBackup() *Request {
+	req.backupOnly = true
+	req.backupFallback = false
+	return req
+}
+
+// PreferBackup sends the request to the backup sources of the request pool, like ForceBackup, but uses the next
+// available server in the pool if no backup source is available.
+func (req *Request) PreferBackup() *Request {
+	req.backupOnly = true
+	req.backupFallback = true
+	return req
+}
+
+// Tag sets a caller-defined label of the request, for e.g., the logical operation name, used to key the request
+// counters of each source. See Source.TagStats. The tag is also available in the AttemptInfo.
+func (req *Request) Tag(tag string) *Request {
+	req.tag = tag
+	return req
+}
+
+// Probe marks the request as a health probe or warmup request, so it is not accounted in the source stats, the
+// circuit breaker, the adaptive weights and the retry budget, and its retries are not limited by the budget. Offline
+// sources are still skipped and the result can still put the
+// source online or offline, for e.g., calling Response.SetOffline from the callback.
+func (req *Request) Probe(probe bool) *Request {
+	req.probe = probe
+	return req
+}
+
+// OfflineOnCancel sets if the source must be considered offline when the request context is canceled while the
+// attempt is in progress, for e.g., if the caller cancels requests taking too long. By default, cancellations are
+// not accounted as a server failure.
+func (req *Request) OfflineOnCancel(offline bool) *Request {
+	req.offlineOnCancel = offline
+	return req
+}
+
+// Callback sets the execution callback. If not set, Exec only returns the error of the request, if any, for e.g., for
+// fire-and-forget notifications.
 func (req *Request) Callback(cb ExecCallback) *Request {
 	req.callback = cb
 	return req
 }
 
-// Exec runs the http client request
+// Exec runs the http client request. The status codes set with SetUnhealthyStatus still put the source offline
+// without a callback, but, as usual, they are not considered an error.
 func (req *Request) Exec() error {
 	if len(req.method) == 0 {
 		return errors.New("invalid method")
@@ -99,8 +282,122 @@ func (req *Request) Exec() error {
 	if req.timeout < 0 {
 		return errors.New("invalid timeout")
 	}
+	if req.maxBufferedBody < 0 {
+		return errors.New("invalid max buffered body size")
+	}
+	if req.overallDeadline < 0 {
+		return errors.New("invalid overall deadline")
+	}
+	if req.maxWait < 0 {
+		return errors.New("invalid max wait")
+	}
+	if req.maxResponseSize < 0 {
+		return errors.New("invalid max response size")
+	}
 	if req.callback == nil {
-		return errors.New("invalid callback")
+		req.callback = defaultCallback
+	}
+	if req.pinnedSourceID != 0 {
+		// NOTE: The source must also belong to the request pool, else its balancer would be bypassed
+		if req.pinnedSourceID < 0 || req.pinnedSourceID > req.client.SourcesCount() ||
+			req.client.sources[req.pinnedSourceID-1].pool != req.pool {
+			return errors.New("invalid source id")
+		}
 	}
 	return req.client.exec(req)
 }
+
+// ExecAsync runs the http client request, like Exec, in a new goroutine and returns a channel that receives the
+// final error, nil on success, and is closed afterwards. The callback is called from that goroutine and the request
+// is aborted if its context is canceled. The request must not be modified until the error is received.
+// NOTE: Panics inside the callback crash the program unless SetRecoverCallbackPanics was enabled.
+func (req *Request) ExecAsync() <-chan error {
+	ch := make(chan error, 1)
+	go func() {
+		defer close(ch)
+
+		ch <- req.Exec()
+	}()
+	return ch
+}
+
+// defaultCallback is used when no callback was set, the response body is discarded
+func defaultCallback(_ context.Context, res Response) error {
+	return res.Err()
+}
+
+// attemptTimeout returns the timeout of the specified attempt
+func (req *Request) attemptTimeout(ctx context.Context, attempt int) time.Duration {
+	if req.timeoutFunc != nil {
+		remaining := time.Duration(0)
+		if deadline, ok := ctx.Deadline(); ok {
+			remaining = time.Until(deadline)
+			if remaining <= 0 {
+				// NOTE: Keep it distinguishable from no deadline
+				remaining = time.Nanosecond
+			}
+		}
+		if timeout := req.timeoutFunc(attempt, remaining); timeout > 0 {
+			return timeout
+		}
+	}
+	return req.timeout
+}
+
+// bufferedResponseLimit returns the maximum size of the response bodies buffered in memory
+func (req *Request) bufferedResponseLimit() int64 {
+	if req.maxResponseSize > 0 {
+		return req.maxResponseSize
+	}
+	return defaultMaxDoResponseBody
+}
+
+// Do runs the http client request and returns the response body, so no callback is needed for the simple cases.
+// Failed attempts, including status codes set with SetUnhealthyStatus, are retried on the next available server up
+// to once per source. The body of the returned response is replaced with the buffered one. Bodies larger than 32MB,
+// or the size set with MaxResponseBytes, are rejected with ErrResponseTooLarge.
+func (req *Request) Do() ([]byte, *http.Response, error) {
+	var body []byte
+	var httpRes *http.Response
+
+	maxAttempts := req.client.poolSourcesCount(req.pool)
+
+	req.callback = func(ctx context.Context, res Response) error {
+		body = nil
+		httpRes = nil
+
+		if res.Err() != nil || req.client.isUnhealthyStatus(res.StatusCode) {
+			// Retry on the next server if we still have sources to try
+			if res.RetryCount()+1 < maxAttempts {
+				res.RetryOnNextServer()
+				return nil
+			}
+			if res.Err() != nil {
+				return res.Err()
+			}
+		}
+
+		// Buffer the body because it will be closed when the callback returns
+		b, err := res.readBody(req.bufferedResponseLimit())
+		if err != nil {
+			return err
+		}
+		body = b
+		httpRes = res.Response
+
+		// Done
+		return nil
+	}
+
+	err := req.Exec()
+	if err != nil {
+		return nil, nil, err
+	}
+	if httpRes == nil {
+		return nil, nil, req.client.newError(nil, errNoResponse, req.url, 0)
+	}
+
+	// NOTE: Replace the body once Exec drained and closed the original one
+	httpRes.Body = io.NopCloser(bytes.NewReader(body))
+	return body, httpRes, nil
+}
@@ -4,7 +4,11 @@ package httpclient
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"time"
 )
 
 // -----------------------------------------------------------------------------
@@ -21,8 +25,12 @@ type Response struct {
 	fullUrl         string
 	source          *Source
 	retryCount      int
+	retryAfter      time.Duration
+	waitTime        time.Duration
+	fromCache       bool
 	err             error
 	upstreamOffline *bool
+	offlineFor      *time.Duration
 	retry           *bool
 }
 
@@ -43,11 +51,30 @@ func (res *Response) RetryCount() int {
 	return res.retryCount
 }
 
+// RetryAfter returns the delay requested by the server through the Retry-After header or zero if not present.
+// When the status code is 429 or 503 and the request is retried, the next attempt waits for this delay.
+func (res *Response) RetryAfter() time.Duration {
+	return res.retryAfter
+}
+
+// WaitTime returns how long the attempt waited for an available server before being sent. It does not include the
+// delays between retries.
+func (res *Response) WaitTime() time.Duration {
+	return res.waitTime
+}
+
 // SetOffline indicates the accessed server must be considered to be offline.
 func (res *Response) SetOffline() {
 	*res.upstreamOffline = true
 }
 
+// SetOfflineFor indicates the accessed server must be considered to be offline for, at least, the specified
+// duration, for e.g., the one returned by RetryAfter.
+func (res *Response) SetOfflineFor(d time.Duration) {
+	*res.upstreamOffline = true
+	*res.offlineFor = d
+}
+
 // RetryOnNextServer indicates the request must be retried on the next available server.
 func (res *Response) RetryOnNextServer() {
 	*res.retry = true
@@ -58,7 +85,108 @@ func (res *Response) SourceID() int {
 	return res.source.ID()
 }
 
+// SourceIsBackup returns true if the request was served by a backup source, which usually means all primary
+// sources are offline.
+func (res *Response) SourceIsBackup() bool {
+	return res.source.IsBackup()
+}
+
 // SourceBaseURL returns the base URL to use.
 func (res *Response) SourceBaseURL() string {
 	return res.source.baseURL
 }
+
+// CopyTo streams the response body to the given writer. Use it inside the callback, before the body is closed, to
+// avoid buffering large downloads in memory.
+func (res *Response) CopyTo(w io.Writer) (int64, error) {
+	if res.Response == nil || res.Body == nil {
+		return 0, nil
+	}
+	return io.Copy(w, res.Body)
+}
+
+// DecodeJSON decodes the JSON response body into v. It returns ErrEmptyBody if the body is empty, for e.g., on 204
+// No Content responses, leaving v untouched, so callers can treat it as a successful no-op. Errors reading the body
+// and decoding it are returned as different Error messages. If the request failed, its error is returned instead.
+func (res *Response) DecodeJSON(v interface{}) error {
+	if res.Response == nil {
+		if res.err != nil {
+			return res.err
+		}
+		return &Error{
+			message: errNoResponse,
+			url:     res.fullUrl,
+		}
+	}
+	if res.Body == nil {
+		return ErrEmptyBody
+	}
+
+	err := json.NewDecoder(res.Body).Decode(v)
+	if err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+
+		if err == io.EOF {
+			return ErrEmptyBody
+		}
+		message := errUnableToReadResponseBody
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || err == io.ErrUnexpectedEOF {
+			message = errUnableToDecodeResponse
+		}
+		return &Error{
+			message:    message,
+			url:        res.fullUrl,
+			statusCode: res.StatusCode,
+			err:        err,
+		}
+	}
+
+	// Done
+	return nil
+}
+
+// limitedReadCloser fails with ErrResponseTooLarge if more than the allowed bytes are read
+type limitedReadCloser struct {
+	rc        io.ReadCloser
+	remaining int64
+}
+
+func (l *limitedReadCloser) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, ErrResponseTooLarge
+	}
+
+	// Read one extra byte to detect oversized bodies
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.rc.Read(p)
+	if int64(n) > l.remaining {
+		n = int(l.remaining)
+		l.remaining = -1
+		return n, ErrResponseTooLarge
+	}
+	l.remaining -= int64(n)
+	return n, err
+}
+
+func (l *limitedReadCloser) Close() error {
+	return l.rc.Close()
+}
+
+func (res *Response) readBody(limit int64) ([]byte, error) {
+	if res.Response == nil || res.Body == nil {
+		return nil, nil
+	}
+
+	// Read one extra byte to detect oversized bodies
+	b, err := io.ReadAll(io.LimitReader(res.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > limit {
+		return nil, ErrResponseTooLarge
+	}
+	return b, nil
+}
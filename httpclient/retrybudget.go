@@ -0,0 +1,158 @@
+// See the LICENSE file for license details.
+
+package httpclient
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+const (
+	retryBudgetBucketsCount = 10
+)
+
+// -----------------------------------------------------------------------------
+
+var ErrRetryBudgetExhausted = errors.New("retry budget exhausted")
+
+// -----------------------------------------------------------------------------
+
+// RetryBudgetOptions specifies how many retries the client can do, in relation to the amount of requests, so
+// retries don't multiply the load on degraded backends.
+type RetryBudgetOptions struct {
+	// Ratio sets the amount of retries allowed per request in the window, for e.g., 0.1 allows one retry every 10
+	// requests.
+	Ratio float64
+
+	// Window sets the sliding time window where requests and retries are accounted.
+	Window time.Duration
+
+	// MinRetries sets the amount of retries always allowed in the window, so clients with low traffic can retry.
+	MinRetries int
+}
+
+// RetryBudgetState contains the state of the retry budget.
+type RetryBudgetState struct {
+	// Requests and retries done in the current window
+	Requests int
+	Retries  int
+
+	// Maximum amount of retries allowed in the current window
+	MaxRetries int
+
+	// Indicates if retries are currently being throttled
+	Exhausted bool
+}
+
+type retryBudget struct {
+	mtx     sync.Mutex
+	opts    RetryBudgetOptions
+	buckets [retryBudgetBucketsCount]retryBudgetBucket
+}
+
+type retryBudgetBucket struct {
+	start    time.Time
+	requests int
+	retries  int
+}
+
+// -----------------------------------------------------------------------------
+
+// SetRetryBudget limits the retries done by all requests. Once the budget is exhausted, retries requested by the
+// callback or the retry policies are not honored, RequestRetryThrottledEvent is raised, and the request returns the
+// error of the last attempt. If the callback asked for the retry without returning an error, an Error wrapping
+// ErrRetryBudgetExhausted, with the status code of the last attempt, is returned instead. Pass nil to disable it.
+func (c *HttpClient) SetRetryBudget(opts *RetryBudgetOptions) error {
+	if opts == nil {
+		c.retryBudget = nil
+		return nil
+	}
+
+	if opts.Ratio < 0 || opts.Window <= 0 || opts.MinRetries < 0 {
+		return errors.New("invalid parameter")
+	}
+	c.retryBudget = &retryBudget{
+		mtx:  sync.Mutex{},
+		opts: *opts,
+	}
+
+	// Done
+	return nil
+}
+
+// RetryBudgetState returns the state of the retry budget. It returns false if no budget was set.
+func (c *HttpClient) RetryBudgetState() (RetryBudgetState, bool) {
+	if c.retryBudget == nil {
+		return RetryBudgetState{}, false
+	}
+	return c.retryBudget.state(time.Now()), true
+}
+
+// -----------------------------------------------------------------------------
+
+// recordRequest accounts a new request in the window
+func (rb *retryBudget) recordRequest() {
+	now := time.Now()
+
+	rb.mtx.Lock()
+	rb.bucket(now).requests += 1
+	rb.mtx.Unlock()
+}
+
+// allowRetry returns true, and accounts it, if the budget allows another retry
+func (rb *retryBudget) allowRetry() bool {
+	now := time.Now()
+
+	rb.mtx.Lock()
+	defer rb.mtx.Unlock()
+
+	if rb.stateLocked(now).Exhausted {
+		return false
+	}
+	rb.bucket(now).retries += 1
+	return true
+}
+
+func (rb *retryBudget) state(now time.Time) RetryBudgetState {
+	rb.mtx.Lock()
+	defer rb.mtx.Unlock()
+
+	return rb.stateLocked(now)
+}
+
+// NOTE: The budget lock must be held
+func (rb *retryBudget) stateLocked(now time.Time) RetryBudgetState {
+	state := RetryBudgetState{}
+	for idx := range rb.buckets {
+		if now.Sub(rb.buckets[idx].start) < rb.opts.Window {
+			state.Requests += rb.buckets[idx].requests
+			state.Retries += rb.buckets[idx].retries
+		}
+	}
+	state.MaxRetries = int(float64(state.Requests) * rb.opts.Ratio)
+	if state.MaxRetries < rb.opts.MinRetries {
+		state.MaxRetries = rb.opts.MinRetries
+	}
+	state.Exhausted = state.Retries >= state.MaxRetries
+	return state
+}
+
+// bucket returns the bucket of the given time, resetting it if it belongs to an old window
+// NOTE: The budget lock must be held
+func (rb *retryBudget) bucket(now time.Time) *retryBudgetBucket {
+	bucketSize := rb.opts.Window / retryBudgetBucketsCount
+	if bucketSize <= 0 {
+		bucketSize = 1
+	}
+	start := now.Truncate(bucketSize)
+	bucket := &rb.buckets[(start.UnixNano()/int64(bucketSize))%retryBudgetBucketsCount]
+	if !bucket.start.Equal(start) {
+		*bucket = retryBudgetBucket{
+			start: start,
+		}
+	}
+	return bucket
+}
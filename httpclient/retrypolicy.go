@@ -0,0 +1,205 @@
+// See the LICENSE file for license details.
+
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+const (
+	retryClassNetwork = -(iota + 1)
+	retryClassTimeout
+	retryClassClientError
+	retryClassServerError
+	retryClassOther
+)
+
+// -----------------------------------------------------------------------------
+
+// RetryPolicy decides if a finished attempt must be retried on the next available server. It is consulted only if
+// the callback did not call Response.RetryOnNextServer.
+type RetryPolicy interface {
+	// ShouldRetry receives the zero-based attempt number, the response, if any, and the error returned by the
+	// callback. It returns if the request must be retried and the delay to wait before the next attempt.
+	// NOTE: The response body is already closed when the policy is consulted.
+	ShouldRetry(attempt int, res *http.Response, err error) (retry bool, delay time.Duration)
+}
+
+type noRetryPolicy struct {
+}
+
+type retryNPolicy struct {
+	maxRetries int
+}
+
+type retryOn5xxPolicy struct {
+	maxRetries int
+	baseDelay  time.Duration
+}
+
+// ClassRetryLimits specifies how many times a request can be retried for each class of failure. Zero, the default,
+// means the class is not retried.
+type ClassRetryLimits struct {
+	// Network sets the retries of the attempts that failed to complete because of a network error, for e.g., a
+	// refused connection.
+	Network int
+
+	// Timeout sets the retries of the attempts that timed out, including slow response bodies.
+	Timeout int
+
+	// ClientError and ServerError set the retries of the 4xx and 5xx responses.
+	ClientError int
+	ServerError int
+
+	// Other sets the retries of the rest of the responses the callback returned an error for.
+	Other int
+
+	// Status sets the retries of specific status codes, for e.g., 429, overriding ClientError and ServerError.
+	Status map[int]int
+}
+
+type classRetryPolicy struct {
+	limits ClassRetryLimits
+}
+
+type classRetryState struct {
+	limits *ClassRetryLimits
+	counts map[int]int
+}
+
+// requestScopedPolicy is implemented by the retry policies that need a separate state for each request
+type requestScopedPolicy interface {
+	forRequest() RetryPolicy
+}
+
+type forcedRetriesCtxKey struct{}
+
+// -----------------------------------------------------------------------------
+
+// NoRetry returns a retry policy that never retries.
+func NoRetry() RetryPolicy {
+	return &noRetryPolicy{}
+}
+
+// RetryN returns a retry policy that retries failed attempts, up to maxRetries times, without delay.
+func RetryN(maxRetries int) RetryPolicy {
+	return &retryNPolicy{
+		maxRetries: maxRetries,
+	}
+}
+
+// RetryOn5xx returns a retry policy that retries failed attempts and 5xx responses, up to maxRetries times. The
+// delay between attempts starts at baseDelay and doubles on each retry.
+func RetryOn5xx(maxRetries int, baseDelay time.Duration) RetryPolicy {
+	return &retryOn5xxPolicy{
+		maxRetries: maxRetries,
+		baseDelay:  baseDelay,
+	}
+}
+
+// RetryByClass returns a retry policy that limits the retries of each request by the class of the failure, for e.g.,
+// to retry up to 3 times on network errors but never on 4xx responses. Each class has its own count, so the total
+// retries can be higher than any of the limits. Canceled requests are never retried.
+func RetryByClass(limits ClassRetryLimits) RetryPolicy {
+	p := classRetryPolicy{
+		limits: limits,
+	}
+	p.limits.Status = make(map[int]int, len(limits.Status))
+	for statusCode, limit := range limits.Status {
+		p.limits.Status[statusCode] = limit
+	}
+	return &p
+}
+
+// WithForcedRetries returns a copy of the context that forces the retry decision of the first attempts of the
+// requests executed with it, in order, overriding the callback, the retry status codes and the retry policy. Once
+// the decisions are consumed, the usual rules apply. Meant for tests, it allows to deterministically exercise the
+// retry loop, backoff, budgets and distinct source tracking without a flaky upstream.
+func WithForcedRetries(ctx context.Context, decisions ...bool) context.Context {
+	d := make([]bool, len(decisions))
+	copy(d, decisions)
+	return context.WithValue(ctx, forcedRetriesCtxKey{}, d)
+}
+
+// -----------------------------------------------------------------------------
+
+func forcedRetriesFromContext(ctx context.Context) []bool {
+	decisions, _ := ctx.Value(forcedRetriesCtxKey{}).([]bool)
+	return decisions
+}
+
+func (p *noRetryPolicy) ShouldRetry(_ int, _ *http.Response, _ error) (bool, time.Duration) {
+	return false, 0
+}
+
+func (p *retryNPolicy) ShouldRetry(attempt int, _ *http.Response, err error) (bool, time.Duration) {
+	return err != nil && attempt < p.maxRetries, 0
+}
+
+func (p *retryOn5xxPolicy) ShouldRetry(attempt int, res *http.Response, err error) (bool, time.Duration) {
+	if attempt >= p.maxRetries {
+		return false, 0
+	}
+	if err == nil && (res == nil || res.StatusCode < 500) {
+		return false, 0
+	}
+	return true, p.baseDelay << uint(attempt)
+}
+
+// ShouldRetry is used if the policy is consulted outside a request. As the retries of each class are not known, it
+// compares the limit of the class with the attempt number.
+func (p *classRetryPolicy) ShouldRetry(attempt int, res *http.Response, err error) (bool, time.Duration) {
+	class, limit := p.limits.classify(res, err)
+	return class != 0 && attempt < limit, 0
+}
+
+func (p *classRetryPolicy) forRequest() RetryPolicy {
+	return &classRetryState{
+		limits: &p.limits,
+		counts: make(map[int]int),
+	}
+}
+
+func (s *classRetryState) ShouldRetry(_ int, res *http.Response, err error) (bool, time.Duration) {
+	class, limit := s.limits.classify(res, err)
+	if class == 0 || s.counts[class] >= limit {
+		return false, 0
+	}
+	s.counts[class] += 1
+	return true, 0
+}
+
+// classify returns the class of the failure, zero if none, and its retry limit. Specific status codes are
+// identified by themselves.
+func (l *ClassRetryLimits) classify(res *http.Response, err error) (int, int) {
+	if errors.Is(err, ErrCanceled) {
+		return 0, 0
+	}
+	if errors.Is(err, ErrTimeout) {
+		return retryClassTimeout, l.Timeout
+	}
+	if res != nil {
+		if limit, ok := l.Status[res.StatusCode]; ok {
+			return res.StatusCode, limit
+		}
+		if res.StatusCode >= 500 {
+			return retryClassServerError, l.ServerError
+		}
+		if res.StatusCode >= 400 {
+			return retryClassClientError, l.ClientError
+		}
+		if err != nil {
+			return retryClassOther, l.Other
+		}
+		return 0, 0
+	}
+	if err != nil {
+		return retryClassNetwork, l.Network
+	}
+	return 0, 0
+}
@@ -0,0 +1,59 @@
+// See the LICENSE file for license details.
+
+package httpclient
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// -----------------------------------------------------------------------------
+
+type roundTripper struct {
+	client *HttpClient
+}
+
+// -----------------------------------------------------------------------------
+
+// RoundTripper returns an http.RoundTripper that load-balances the requests across the sources of the default pool,
+// so the client can be used as the transport of an http.Client or of libraries expecting one.
+//
+// The scheme, host and user info of the request url are ignored. The path and the raw query are appended to the base
+// url of the selected source, for e.g., a request to "http://api/v1/items?page=2" is sent to
+// "http://10.0.0.1:8080/v1/items?page=2". The request headers are sent as is, merged with the client and source
+// ones, and the context of the request is honored.
+//
+// Because the RoundTripper contract has no callback, failed attempts and the status codes set with
+// SetUnhealthyStatus are retried on the next available server, like in Request.Do. Request and response bodies are
+// buffered in memory, so they can be replayed, and responses larger than 32MB are rejected with ErrResponseTooLarge.
+func (c *HttpClient) RoundTripper() http.RoundTripper {
+	return &roundTripper{
+		client: c,
+	}
+}
+
+// RoundTrip executes a single http transaction on one of the sources.
+func (rt *roundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	req := rt.client.NewRequest(r.Context(), r.URL.RequestURI()).
+		Method(r.Method).
+		Headers(r.Header)
+
+	// Buffer the body so it can be sent again on retries
+	if r.Body != nil && r.Body != http.NoBody {
+		body, err := io.ReadAll(r.Body)
+		_ = r.Body.Close()
+		if err != nil {
+			return nil, rt.client.newError(err, errUnableToReadBody, r.URL.String(), 0)
+		}
+		req.Body(bytes.NewReader(body))
+	}
+
+	_, res, err := req.Do()
+	if err != nil {
+		return nil, err
+	}
+
+	// Done
+	return res, nil
+}
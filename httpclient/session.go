@@ -0,0 +1,62 @@
+// See the LICENSE file for license details.
+
+package httpclient
+
+import (
+	"context"
+	"sync"
+)
+
+// -----------------------------------------------------------------------------
+
+// Session groups requests of the same logical client so they stick to the source that last served them
+// successfully. Once that source fails or goes offline, the next request is load-balanced as usual and the session
+// sticks to the new source.
+type Session struct {
+	client  *HttpClient
+	mtx     sync.Mutex
+	sources map[string]int // NOTE: Source ID by pool
+}
+
+// -----------------------------------------------------------------------------
+
+// NewSession creates a new sticky session. Sessions are safe for concurrent use.
+func (c *HttpClient) NewSession() *Session {
+	s := Session{
+		client:  c,
+		mtx:     sync.Mutex{},
+		sources: make(map[string]int),
+	}
+	return &s
+}
+
+// NewRequest creates a new http client request that belongs to the session.
+func (s *Session) NewRequest(ctx context.Context, url string) *Request {
+	req := s.client.NewRequest(ctx, url)
+	req.session = s
+	return req
+}
+
+// SourceID returns the ID of the source the session is stuck to in the specified pool, or zero if none.
+func (s *Session) SourceID(pool string) int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.sources[pool]
+}
+
+// Reset makes the session forget its sources.
+func (s *Session) Reset() {
+	s.mtx.Lock()
+	s.sources = make(map[string]int)
+	s.mtx.Unlock()
+}
+
+func (s *Session) update(src *Source, success bool) {
+	s.mtx.Lock()
+	if success {
+		s.sources[src.pool] = src.id
+	} else if s.sources[src.pool] == src.id {
+		delete(s.sources, src.pool)
+	}
+	s.mtx.Unlock()
+}
@@ -3,8 +3,14 @@
 package httpclient
 
 import (
+	"context"
 	"net/http"
+	"net/url"
+	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/mxmauro/go-loadbalancer/v2"
 )
 
 // -----------------------------------------------------------------------------
@@ -13,12 +19,54 @@ import (
 type Source struct {
 	id        int // NOTE: The IDs starts from 1
 	baseURL   string
-	header    http.Header
+	headerMtx sync.RWMutex
+	header    http.Header // NOTE: Never modified in place, replaced with an updated copy on changes
 	isBackup  bool
+	pool      string
+	opts      loadbalancer.ServerOptions
 	isOnline  int32
+	inFlight  int32
+	confirmed int32
 	lastError atomic.Value
+	srv       *loadbalancer.Server
+
+	errHistoryMtx  sync.Mutex
+	errHistory     []ErrorRecord
+	errHistoryNext int
+
+	proxyMtx       sync.Mutex
+	proxyURL       *url.URL
+	proxyTransport *http.Transport
+	proxyBase      *http.Transport // NOTE: The client transport the proxy one was derived from
+
+	tagStats  tagStatsMap
+	connStats *connStats
+	adaptive  adaptiveWeightState
+}
+
+// ErrorRecord contains an error occurred in a source and when it happened.
+type ErrorRecord struct {
+	Err       error
+	Timestamp time.Time
+}
+
+// AttemptInfo contains details about the current request attempt. It is stored in the context passed to the
+// execution callback and to the underlying http request.
+type AttemptInfo struct {
+	Source     *Source
+	RetryCount int
+	StartTime  time.Time
+	Tag        string
 }
 
+type attemptInfoCtxKey struct{}
+
+// -----------------------------------------------------------------------------
+
+const (
+	maxErrorHistory = 16
+)
+
 // Hack-hack to avoid panics on atomic.Value
 type packedError struct {
 	err error
@@ -26,13 +74,30 @@ type packedError struct {
 
 // -----------------------------------------------------------------------------
 
-func newSource(id int, baseURL string, headers http.Header, isBackup bool) *Source {
+func newSource(id int, baseURL string, headers http.Header, opts loadbalancer.ServerOptions, pool string) *Source {
 	src := Source{
 		id:        id,
 		baseURL:   baseURL,
+		headerMtx: sync.RWMutex{},
 		header:    headers.Clone(),
-		isBackup:  isBackup,
+		isBackup:  opts.IsBackup,
+		pool:      pool,
+		opts:      opts,
 		lastError: atomic.Value{},
+
+		errHistoryMtx: sync.Mutex{},
+		errHistory:    make([]ErrorRecord, 0, maxErrorHistory),
+
+		proxyMtx: sync.Mutex{},
+
+		tagStats: tagStatsMap{
+			mtx:   sync.Mutex{},
+			stats: make(map[string]*TagStats),
+		},
+		connStats: &connStats{},
+		adaptive: adaptiveWeightState{
+			mtx: sync.Mutex{},
+		},
 	}
 	atomic.StoreInt32(&src.isOnline, 1)
 	src.setLastError(nil)
@@ -50,22 +115,146 @@ func (src *Source) BaseURL() string {
 	return src.baseURL
 }
 
+// Header returns a copy of the headers added to the requests sent to this source.
+func (src *Source) Header() http.Header {
+	return src.headers().Clone()
+}
+
+// SetHeader sets the value of a header added to the requests sent to this source, for e.g., to rotate an API key,
+// without affecting the requests in progress.
+func (src *Source) SetHeader(key string, value string) {
+	src.headerMtx.Lock()
+	header := src.header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set(key, value)
+	src.header = header
+	src.headerMtx.Unlock()
+}
+
+// DelHeader removes a header added to the requests sent to this source.
+func (src *Source) DelHeader(key string) {
+	src.headerMtx.Lock()
+	header := src.header.Clone()
+	header.Del(key)
+	src.header = header
+	src.headerMtx.Unlock()
+}
+
 // IsBackup returns if the source is primary or backup.
 func (src *Source) IsBackup() bool {
 	return src.isBackup
 }
 
+// Pool returns the name of the pool the source belongs to.
+func (src *Source) Pool() string {
+	return src.pool
+}
+
 // IsOnline returns if the source is online.
 func (src *Source) IsOnline() bool {
 	return atomic.LoadInt32(&src.isOnline) != 0
 }
 
+// InFlight returns the number of requests in progress on this source.
+func (src *Source) InFlight() int {
+	return int(atomic.LoadInt32(&src.inFlight))
+}
+
+// ErrorRate returns the ratio, from 0 to 1, of failed requests of this source accounted in the TagStats.
+func (src *Source) ErrorRate() float64 {
+	succeeded := uint64(0)
+	failed := uint64(0)
+	for _, ts := range src.TagStats() {
+		succeeded += ts.Succeeded
+		failed += ts.Failed
+	}
+	if succeeded+failed == 0 {
+		return 0
+	}
+	return float64(failed) / float64(succeeded+failed)
+}
+
 // Err returns the last error occurred in the source.
 func (src *Source) Err() error {
 	perr := src.lastError.Load().(packedError)
 	return perr.err
 }
 
+// ErrorHistory returns the most recent errors occurred in the source, oldest first. Up to 16 errors are kept.
+func (src *Source) ErrorHistory() []ErrorRecord {
+	src.errHistoryMtx.Lock()
+	defer src.errHistoryMtx.Unlock()
+
+	history := make([]ErrorRecord, 0, len(src.errHistory))
+	if len(src.errHistory) == maxErrorHistory {
+		history = append(history, src.errHistory[src.errHistoryNext:]...)
+		history = append(history, src.errHistory[:src.errHistoryNext]...)
+	} else {
+		history = append(history, src.errHistory...)
+	}
+	return history
+}
+
+// ResetErrorHistory removes all the errors from the history of the source.
+func (src *Source) ResetErrorHistory() {
+	src.errHistoryMtx.Lock()
+	src.errHistory = src.errHistory[:0]
+	src.errHistoryNext = 0
+	src.errHistoryMtx.Unlock()
+}
+
+// SourceFromContext returns the source being accessed by the current request attempt or nil if not present.
+func SourceFromContext(ctx context.Context) *Source {
+	info := AttemptInfoFromContext(ctx)
+	if info == nil {
+		return nil
+	}
+	return info.Source
+}
+
+// AttemptInfoFromContext returns the details of the current request attempt or nil if not present.
+func AttemptInfoFromContext(ctx context.Context) *AttemptInfo {
+	info, _ := ctx.Value(attemptInfoCtxKey{}).(*AttemptInfo)
+	return info
+}
+
+func contextWithAttemptInfo(ctx context.Context, info *AttemptInfo) context.Context {
+	return context.WithValue(ctx, attemptInfoCtxKey{}, info)
+}
+
+// headers returns the current source headers. They must not be modified.
+func (src *Source) headers() http.Header {
+	src.headerMtx.RLock()
+	header := src.header
+	src.headerMtx.RUnlock()
+	return header
+}
+
+func (src *Source) state() SourceState {
+	ttfb, avgTTFB := src.TTFB()
+	wait, avgWait := src.WaitTime()
+	return SourceState{
+		BaseURL:   src.BaseURL(),
+		IsOnline:  src.IsOnline(),
+		LastError: src.Err(),
+		Errors:    src.ErrorHistory(),
+		IsBackup:  src.IsBackup(),
+		Pool:      src.Pool(),
+
+		IsConfirmed: atomic.LoadInt32(&src.confirmed) != 0,
+		TagStats:    src.TagStats(),
+		ConnStats:   src.ConnStats(),
+		TTFB:        ttfb,
+		AvgTTFB:     avgTTFB,
+		WaitTime:    wait,
+		AvgWaitTime: avgWait,
+		Weight:      src.srv.Weight(),
+		InFlight:    src.InFlight(),
+	}
+}
+
 func (src *Source) setOnlineStatus(online bool) {
 	if online {
 		atomic.StoreInt32(&src.isOnline, 1)
@@ -78,4 +267,21 @@ func (src *Source) setLastError(err error) {
 	src.lastError.Store(packedError{
 		err: err,
 	})
+
+	// Record errors in the history ring
+	if err != nil {
+		rec := ErrorRecord{
+			Err:       err,
+			Timestamp: time.Now(),
+		}
+
+		src.errHistoryMtx.Lock()
+		if len(src.errHistory) < maxErrorHistory {
+			src.errHistory = append(src.errHistory, rec)
+		} else {
+			src.errHistory[src.errHistoryNext] = rec
+		}
+		src.errHistoryNext = (src.errHistoryNext + 1) % maxErrorHistory
+		src.errHistoryMtx.Unlock()
+	}
 }
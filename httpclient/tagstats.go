@@ -0,0 +1,73 @@
+// See the LICENSE file for license details.
+
+package httpclient
+
+import (
+	"sync"
+)
+
+// -----------------------------------------------------------------------------
+
+// TagStats contains the request counters of a source for a given request tag.
+type TagStats struct {
+	Succeeded uint64
+	Failed    uint64
+	Retried   uint64 // NOTE: Attempts abandoned to retry on another source
+}
+
+type tagStatsMap struct {
+	mtx   sync.Mutex
+	stats map[string]*TagStats
+}
+
+// -----------------------------------------------------------------------------
+
+const (
+	tagStatSucceeded = iota
+	tagStatFailed
+	tagStatRetried
+)
+
+// -----------------------------------------------------------------------------
+
+// TagStats returns the request counters of the source keyed by the tag set with Request.Tag. Untagged requests are
+// accounted under the empty tag.
+func (src *Source) TagStats() map[string]TagStats {
+	src.tagStats.mtx.Lock()
+	defer src.tagStats.mtx.Unlock()
+
+	stats := make(map[string]TagStats, len(src.tagStats.stats))
+	for tag, ts := range src.tagStats.stats {
+		stats[tag] = *ts
+	}
+	return stats
+}
+
+// ResetTagStats clears the per tag request counters of all sources.
+func (c *HttpClient) ResetTagStats() {
+	for _, src := range c.sources {
+		src.tagStats.mtx.Lock()
+		src.tagStats.stats = make(map[string]*TagStats)
+		src.tagStats.mtx.Unlock()
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+func (src *Source) recordTagStat(tag string, stat int) {
+	src.tagStats.mtx.Lock()
+	ts, ok := src.tagStats.stats[tag]
+	if !ok {
+		ts = &TagStats{}
+		src.tagStats.stats[tag] = ts
+	}
+	switch stat {
+	case tagStatSucceeded:
+		ts.Succeeded += 1
+	case tagStatFailed:
+		ts.Failed += 1
+	case tagStatRetried:
+		ts.Retried += 1
+	}
+	src.tagStats.mtx.Unlock()
+}
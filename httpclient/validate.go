@@ -0,0 +1,117 @@
+// See the LICENSE file for license details.
+
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+
+// ValidationError is the error returned by Validate. It contains all the problems found in the configuration.
+type ValidationError struct {
+	Errors []error
+}
+
+// -----------------------------------------------------------------------------
+
+var ErrInvalidConfig = errors.New("invalid configuration")
+
+// -----------------------------------------------------------------------------
+
+// Validate checks the configuration of all the sources, for e.g., at startup before serving traffic. It verifies
+// the base urls can be parsed, that no pool contains the same server twice, even if written differently, and that
+// server names are unique within each pool since they identify the servers in the health store. If
+// reachabilityCheck is true, the sources are also probed like Warmup does. All the problems found are returned
+// together in a ValidationError.
+func (c *HttpClient) Validate(ctx context.Context, reachabilityCheck bool) error {
+	errs := make([]error, 0)
+
+	if len(c.sources) == 0 {
+		errs = append(errs, errors.New("no sources"))
+	}
+
+	seenURLs := make(map[string]int)
+	seenNames := make(map[string]int)
+	for _, src := range c.sources {
+		// Check the base url
+		u, err := url.Parse(src.baseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Hostname()) == 0 {
+			errs = append(errs, fmt.Errorf("invalid base url [source=%v] [url=%v]", src.id, src.baseURL))
+		} else {
+			key := src.pool + " " + canonicalHostKey(u)
+			if otherID, ok := seenURLs[key]; ok {
+				errs = append(errs, fmt.Errorf(
+					"duplicate base url [source=%v] [url=%v] [duplicate_of=%v]", src.id, src.baseURL, otherID,
+				))
+			} else {
+				seenURLs[key] = src.id
+			}
+		}
+
+		// Check the server name
+		// NOTE: The same backend can be added to different pools, so names are only unique within each pool
+		if src.srv != nil {
+			name := src.srv.Name()
+			key := src.pool + " " + name
+			if otherID, ok := seenNames[key]; ok {
+				errs = append(errs, fmt.Errorf(
+					"duplicate server name [source=%v] [name=%v] [duplicate_of=%v]", src.id, name, otherID,
+				))
+			} else {
+				seenNames[key] = src.id
+			}
+		}
+	}
+
+	// Probe the sources, if requested
+	if reachabilityCheck && len(c.sources) > 0 {
+		warmupErrs := c.Warmup(ctx)
+		for _, src := range c.sources {
+			if err, ok := warmupErrs[src.id]; ok {
+				errs = append(errs, fmt.Errorf("unreachable source [source=%v] [err=%w]", src.id, err))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return &ValidationError{
+			Errors: errs,
+		}
+	}
+
+	// Done
+	return nil
+}
+
+func (e *ValidationError) Error() string {
+	s := ErrInvalidConfig.Error()
+	for _, err := range e.Errors {
+		s += " [err=" + err.Error() + "]"
+	}
+	return s
+}
+
+// Is makes errors.Is to match ErrInvalidConfig.
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrInvalidConfig
+}
+
+// -----------------------------------------------------------------------------
+
+// canonicalHostKey returns the scheme, host and port of the url, with the default port made explicit, so the same
+// server written differently gives the same key
+func canonicalHostKey(u *url.URL) string {
+	port := u.Port()
+	if len(port) == 0 {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return u.Scheme + "://" + strings.ToLower(u.Hostname()) + ":" + port
+}
@@ -0,0 +1,72 @@
+// See the LICENSE file for license details.
+
+package httpclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// -----------------------------------------------------------------------------
+
+// Warmup sends a HEAD request to the base url of every source, concurrently, to populate the transport's idle
+// connection pool and avoid paying the connection handshake latency on the first real requests. Any response,
+// regardless of the status code, is considered a success. It returns the errors of the unreachable sources keyed
+// by source ID.
+func (c *HttpClient) Warmup(ctx context.Context) map[int]error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	errs := make(map[int]error)
+	errsMtx := sync.Mutex{}
+
+	wg := sync.WaitGroup{}
+	for _, src := range c.sources {
+		wg.Add(1)
+		go func(src *Source) {
+			defer wg.Done()
+
+			err := c.warmupSource(ctx, src)
+			if err != nil {
+				errsMtx.Lock()
+				errs[src.ID()] = err
+				errsMtx.Unlock()
+			} else {
+				c.confirmSource(src)
+			}
+		}(src)
+	}
+	wg.Wait()
+
+	// Done
+	return errs
+}
+
+func (c *HttpClient) warmupSource(ctx context.Context, src *Source) error {
+	url, err := joinURL(src.baseURL, "", "/")
+	if err != nil {
+		return c.newError(err, errInvalidURL, src.baseURL, 0)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return c.newError(err, errUnableToExecuteRequest, url, 0)
+	}
+	httpReq.Header = c.sourceHeaders(src)
+
+	client := http.Client{
+		Transport: c.transportFor(src),
+	}
+	res, err := client.Do(httpReq)
+	if err != nil {
+		return c.newError(err, errUnableToExecuteRequest, url, 0)
+	}
+	_, _ = io.Copy(io.Discard, res.Body)
+	_ = res.Body.Close()
+
+	// Done
+	return nil
+}
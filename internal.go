@@ -5,10 +5,25 @@ package loadbalancer
 // -----------------------------------------------------------------------------
 
 func (lb *LoadBalancer) raiseEvent(eventType int, server *Server) {
+	lb.notifySubscribers()
+
 	lb.eventHandlerMtx.RLock()
+	defer lb.eventHandlerMtx.RUnlock()
+
 	if lb.eventHandler != nil {
+		// A buggy handler must not break the caller
+		defer func() {
+			_ = recover()
+		}()
+
 		lb.eventHandler(eventType, server)
 	}
-	lb.eventHandlerMtx.RUnlock()
 }
 
+
+func gcd(a int, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
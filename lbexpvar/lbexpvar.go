@@ -0,0 +1,50 @@
+// See the LICENSE file for license details.
+
+// Package lbexpvar publishes the load balancer state through the expvar package.
+//
+// It lives in a separate package because importing expvar registers the /debug/vars handler in the default http
+// serve mux, so applications not interested on it are not affected.
+package lbexpvar
+
+import (
+	"expvar"
+
+	"github.com/mxmauro/go-loadbalancer/v2"
+)
+
+// -----------------------------------------------------------------------------
+
+// Publish publishes the state of the given load balancer as an expvar variable with the specified name. The state
+// is read from a fresh snapshot each time the variable is accessed.
+// NOTE: Like expvar.Publish, it panics if the name is already in use.
+func Publish(lb *loadbalancer.LoadBalancer, name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return buildVars(lb.Snapshot())
+	}))
+}
+
+// -----------------------------------------------------------------------------
+
+func buildVars(snap loadbalancer.Snapshot) map[string]interface{} {
+	servers := make([]map[string]interface{}, 0, len(snap.Servers))
+	for _, ss := range snap.Servers {
+		servers = append(servers, map[string]interface{}{
+			"index":             ss.Index,
+			"backup":            ss.IsBackup,
+			"online":            ss.IsOnline,
+			"weight":            ss.Weight,
+			"configured_weight": ss.ConfiguredWeight,
+			"fail_counter":      ss.FailCounter,
+			"in_flight":         ss.InFlight,
+			"select_count":      ss.SelectCount,
+			"down_count":        ss.DownCount,
+			"flap_count":        ss.FlapCount,
+			"total_down_ms":     ss.TotalDownDuration.Milliseconds(),
+			"longest_down_ms":   ss.LongestDownDuration.Milliseconds(),
+		})
+	}
+	return map[string]interface{}{
+		"online_count": snap.PrimaryOnlineCount,
+		"servers":      servers,
+	}
+}
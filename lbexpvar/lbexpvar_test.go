@@ -0,0 +1,90 @@
+// See the LICENSE file for license details.
+
+package lbexpvar_test
+
+import (
+	"encoding/json"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/mxmauro/go-loadbalancer/v2"
+	"github.com/mxmauro/go-loadbalancer/v2/lbexpvar"
+	"github.com/stretchr/testify/require"
+)
+
+// -----------------------------------------------------------------------------
+
+type testVars struct {
+	OnlineCount int `json:"online_count"`
+	Servers     []struct {
+		Index            int  `json:"index"`
+		Backup           bool `json:"backup"`
+		Online           bool `json:"online"`
+		Weight           int  `json:"weight"`
+		ConfiguredWeight int  `json:"configured_weight"`
+		InFlight         int  `json:"in_flight"`
+		SelectCount      int  `json:"select_count"`
+		DownCount        int  `json:"down_count"`
+	} `json:"servers"`
+}
+
+// -----------------------------------------------------------------------------
+
+func TestPublish(t *testing.T) {
+	lb := loadbalancer.Create()
+	err := lb.Add(loadbalancer.ServerOptions{
+		Weight:      3,
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+	}, "server 1")
+	require.NoError(t, err)
+	err = lb.Add(loadbalancer.ServerOptions{
+		Weight:   1,
+		IsBackup: true,
+	}, "server 2")
+	require.NoError(t, err)
+
+	lbexpvar.Publish(lb, "test_lb")
+
+	// Select the primary server and then put it offline
+	srv := lb.Next()
+	require.NotNil(t, srv)
+	srv.BeginRequest()
+	err = srv.SetWeight(2)
+	require.NoError(t, err)
+	srv.SetOffline()
+
+	// The published variable must reflect the current state
+	v := expvar.Get("test_lb")
+	require.NotNil(t, v)
+
+	vars := testVars{}
+	err = json.Unmarshal([]byte(v.String()), &vars)
+	require.NoError(t, err)
+
+	require.Equal(t, 0, vars.OnlineCount)
+	require.Len(t, vars.Servers, 2)
+
+	require.False(t, vars.Servers[0].Backup)
+	require.False(t, vars.Servers[0].Online)
+	require.Equal(t, 2, vars.Servers[0].Weight)
+	require.Equal(t, 3, vars.Servers[0].ConfiguredWeight)
+	require.Equal(t, 1, vars.Servers[0].InFlight)
+	require.Equal(t, 1, vars.Servers[0].SelectCount)
+	require.Equal(t, 1, vars.Servers[0].DownCount)
+
+	require.True(t, vars.Servers[1].Backup)
+	require.True(t, vars.Servers[1].Online)
+	require.Equal(t, 1, vars.Servers[1].Weight)
+	require.Equal(t, 1, vars.Servers[1].ConfiguredWeight)
+
+	// And be updated on each access
+	srv.EndRequest()
+	srv.SetOnline()
+	err = json.Unmarshal([]byte(v.String()), &vars)
+	require.NoError(t, err)
+	require.Equal(t, 1, vars.OnlineCount)
+	require.True(t, vars.Servers[0].Online)
+	require.Equal(t, 0, vars.Servers[0].InFlight)
+}
@@ -4,6 +4,8 @@ package loadbalancer
 
 import (
 	"errors"
+	"math"
+	"math/rand"
 	"sync"
 	"time"
 )
@@ -14,10 +16,82 @@ import (
 type LoadBalancer struct {
 	mtx                sync.Mutex
 	primaryGroup       ServerGroup
+	tiers              []*ServerGroup // NOTE: Nil if all primary servers have the same priority
 	backupGroup        ServerGroup
 	primaryOnlineCount int
 	eventHandlerMtx    sync.RWMutex
 	eventHandler       EventHandler
+	strategy           Strategy
+	defaultStrategy    Strategy
+	comparator         Comparator
+	rnd                *rand.Rand
+	backupOverflow     bool
+	backupThreshold    float64
+	maxPromotions      int
+	backupDeactivation float64
+	backupActive       bool
+	waitersMtx         sync.Mutex
+	waiters            []*waiter
+	dispatching        bool
+	waitersWakeCh      chan struct{}
+	healthStore        HealthStore
+	healthSyncInterval time.Duration
+	healthSyncTime     time.Time
+	healthInterval     time.Duration
+	subsMtx            sync.Mutex
+	subscribers        []chan PoolHealth
+	publisher          *healthPublisher
+	subsWakeCh         chan struct{}
+	closed             bool
+}
+
+// Options specifies the load balancer settings.
+type Options struct {
+	// Strategy sets the server selection algorithm. Defaults to RoundRobinStrategy.
+	Strategy Strategy
+
+	// Comparator sets the function used by the ComparatorStrategy to pick a server.
+	Comparator Comparator
+
+	// Rand sets the random source used by the random selection strategies. If nil, a time-seeded source is used.
+	// Useful to get reproducible selections in tests.
+	// NOTE: The source is accessed while holding the load balancer lock because Next can be called concurrently, so
+	//       it must not be used elsewhere unless externally synchronized.
+	Rand *rand.Rand
+
+	// BackupOverflow makes backup servers also receive traffic when all online primary servers reached their
+	// MaxConcurrent limit. By default, backup servers are only used when all primary servers are offline.
+	BackupOverflow bool
+
+	// BackupActivationThreshold makes backup servers to receive part of the traffic when the weight of the online
+	// primary servers drops below this fraction, from 0 to 1, of the total primary weight. The share sent to the
+	// backups grows proportionally, from none at the threshold to all of it when no primary is online. For e.g., with
+	// 0.5 and only 30% of the primary weight online, 40% of the requests go to the backups. Zero keeps the default
+	// all-or-nothing behavior.
+	// NOTE: Peek and PeekN do not anticipate the requests sent to the backups because of this setting.
+	BackupActivationThreshold float64
+
+	// MaxRecoveryPromotions limits how many offline primary servers, whose FailTimeout expired, are put online again
+	// at once, so, after a total outage, the pool recovers gradually instead of sending a synchronized burst to all
+	// of them. The ones failing for longer are promoted first and the rest are promoted by the following Next calls
+	// once there are primary servers online. Zero, the default, promotes all of them at once.
+	// NOTE: Round-robin selection promotes the servers as it reaches them, so it is already gradual unless all the
+	//       primary servers are offline.
+	MaxRecoveryPromotions int
+
+	// BackupDeactivationThreshold keeps the backup servers serving all the traffic, after all the primary servers
+	// went offline, until the weight of the recovered primary servers reaches this fraction, from 0 to 1, of the total
+	// primary weight, so traffic does not snap back to the first recovered primary server and re-overload it. Zero
+	// switches back to the primary servers as soon as one is online, the default behavior.
+	BackupDeactivationThreshold float64
+
+	// HealthSummaryInterval makes the channels returned by Subscribe to also receive the health summary periodically
+	// and not only when a server goes offline or online. Zero disables the periodic updates.
+	HealthSummaryInterval time.Duration
+
+	// HealthStoreSyncInterval sets how often Next queries the health store, if any, for the servers put offline by
+	// other load balancers. Defaults to one second.
+	HealthStoreSyncInterval time.Duration
 }
 
 // EventHandler is a handler to call when a server is set offline or online.
@@ -30,24 +104,65 @@ const (
 	ServerDownEvent
 )
 
+const (
+	busyPollInterval = 10 * time.Millisecond
+
+	defaultHealthStoreSyncInterval = time.Second
+)
+
 // -----------------------------------------------------------------------------
 
 // Create creates a new load balancer manager
 func Create() *LoadBalancer {
+	return CreateWithOptions(Options{})
+}
+
+// CreateWithOptions creates a new load balancer manager with the specified options
+func CreateWithOptions(opts Options) *LoadBalancer {
+	rnd := opts.Rand
+	if rnd == nil {
+		rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	healthSyncInterval := opts.HealthStoreSyncInterval
+	if healthSyncInterval <= 0 {
+		healthSyncInterval = defaultHealthStoreSyncInterval
+	}
+
 	lb := LoadBalancer{
 		mtx: sync.Mutex{},
 		primaryGroup: ServerGroup{
-			srvList: make([]Server, 0),
+			srvList: make([]*Server, 0),
 		},
 		backupGroup: ServerGroup{
-			srvList: make([]Server, 0),
+			srvList: make([]*Server, 0),
 		},
-		eventHandlerMtx: sync.RWMutex{},
+		eventHandlerMtx:    sync.RWMutex{},
+		strategy:           opts.Strategy,
+		defaultStrategy:    opts.Strategy,
+		comparator:         opts.Comparator,
+		rnd:                rnd,
+		backupOverflow:     opts.BackupOverflow,
+		backupThreshold:    math.Max(0, math.Min(1, opts.BackupActivationThreshold)),
+		maxPromotions:      opts.MaxRecoveryPromotions,
+		backupDeactivation: math.Max(0, math.Min(1, opts.BackupDeactivationThreshold)),
+		waitersMtx:         sync.Mutex{},
+		waiters:            make([]*waiter, 0),
+		waitersWakeCh:      make(chan struct{}, 1),
+		healthSyncInterval: healthSyncInterval,
+		healthInterval:     opts.HealthSummaryInterval,
+		subsMtx:            sync.Mutex{},
+		subscribers:        make([]chan PoolHealth, 0),
+		subsWakeCh:         make(chan struct{}, 1),
 	}
 	return &lb
 }
 
-// SetEventHandler sets a new notification handler callback
+// SetEventHandler sets a new notification handler callback.
+//
+// The handler is called synchronously, after the internal lock is released, so it can safely call the load
+// balancer methods. Events caused by the same call are delivered in the order the state changes happened but
+// events caused by concurrent calls may be delivered concurrently. Panics inside the handler are recovered and
+// ignored. Keep handlers fast because they delay the caller.
 func (lb *LoadBalancer) SetEventHandler(handler EventHandler) {
 	lb.eventHandlerMtx.Lock()
 	lb.eventHandler = handler
@@ -57,21 +172,13 @@ func (lb *LoadBalancer) SetEventHandler(handler EventHandler) {
 // Add adds a new server to the list
 func (lb *LoadBalancer) Add(opts ServerOptions, userData interface{}) error {
 	// Check options
-	if opts.Weight < 0 {
-		return errors.New("invalid parameter")
-	}
-	if !opts.IsBackup {
-		if opts.MaxFails > 0 {
-			if opts.FailTimeout <= time.Duration(0) {
-				return errors.New("invalid parameter")
-			}
-		} else if opts.MaxFails < 0 {
-			return errors.New("invalid parameter")
-		}
+	err := opts.validate()
+	if err != nil {
+		return err
 	}
 
 	// Create new server
-	srv := Server{
+	srv := &Server{
 		lb:       lb,
 		opts:     opts,
 		userData: userData,
@@ -79,9 +186,14 @@ func (lb *LoadBalancer) Add(opts ServerOptions, userData interface{}) error {
 	if srv.opts.Weight == 0 {
 		srv.opts.Weight = 1
 	}
+	srv.configuredWeight = srv.opts.Weight
 	if opts.IsBackup || srv.opts.MaxFails == 0 {
 		srv.opts.MaxFails = 0
 		srv.opts.FailTimeout = time.Duration(0)
+		srv.opts.BreakerThreshold = 0
+	}
+	if srv.opts.BreakerThreshold > 0 && srv.opts.BreakerCooldown == 0 {
+		srv.opts.BreakerCooldown = srv.opts.FailTimeout
 	}
 
 	// Lock access
@@ -94,6 +206,7 @@ func (lb *LoadBalancer) Add(opts ServerOptions, userData interface{}) error {
 
 		// Add to the primary server list
 		lb.primaryGroup.srvList = append(lb.primaryGroup.srvList, srv)
+		lb.rebuildTiers()
 
 		// Assume the server is initially online
 		lb.primaryOnlineCount += 1
@@ -106,90 +219,137 @@ func (lb *LoadBalancer) Add(opts ServerOptions, userData interface{}) error {
 		lb.backupGroup.srvList = append(lb.backupGroup.srvList, srv)
 	}
 
+	// Let the subscribers know about the new server
+	lb.notifySubscribers()
+
 	// Done
 	return nil
 }
 
-// Next gets the next available server. It can return nil if no available server
-func (lb *LoadBalancer) Next() *Server {
-	var nextServer *Server
+// Servers returns the list of all servers, primary ones first followed by the backup servers
+func (lb *LoadBalancer) Servers() []*Server {
+	lb.mtx.Lock()
+	list := make([]*Server, 0, len(lb.primaryGroup.srvList)+len(lb.backupGroup.srvList))
+	list = append(list, lb.primaryGroup.srvList...)
+	list = append(list, lb.backupGroup.srvList...)
+	lb.mtx.Unlock()
+	return list
+}
 
-	now := time.Now()
+// SetTrafficSplit sets the weights of the given servers so each one receives the specified percentage of the
+// traffic. Percentages must sum 100 and are honored with a resolution of 0.01%. Servers not included in the map
+// keep their current weight.
+// NOTE: Primary and backup servers are selected independently, so only include servers of the same kind.
+func (lb *LoadBalancer) SetTrafficSplit(split map[*Server]float64) error {
+	// Check the split and convert percentages to hundredths
+	units := make(map[*Server]int, len(split))
+	total := 0.0
+	divisor := 0
+	for srv, percent := range split {
+		if srv == nil || srv.lb != lb || percent <= 0 || math.IsNaN(percent) {
+			return errors.New("invalid parameter")
+		}
+		total += percent
 
-	notifyUp := make([]*Server, 0) // NOTE: We would use defer, but they are executed LIFO
+		u := int(math.Round(percent * 100))
+		if u == 0 {
+			return errors.New("invalid parameter")
+		}
+		units[srv] = u
+		divisor = gcd(divisor, u)
+	}
+	if len(units) == 0 || math.Abs(total-100) > 0.01 {
+		return errors.New("invalid parameter")
+	}
 
 	// Lock access
 	lb.mtx.Lock()
 
-	// If all primary servers are offline, check if we can put someone up
-	if lb.primaryOnlineCount == 0 {
-		for idx := range lb.primaryGroup.srvList {
-			srv := &lb.primaryGroup.srvList[idx]
-
-			if now.After(srv.failTimestamp) {
-				// Put this server online again
-				srv.isDown = false
-				srv.failCounter = 0
-				lb.primaryOnlineCount += 1
-
-				notifyUp = append(notifyUp, srv)
-			}
-		}
+	// Set the new weights using the smallest integer ratio
+	for srv, u := range units {
+		srv.opts.Weight = u / divisor
+		srv.configuredWeight = srv.opts.Weight
 	}
 
-	// If there is at least one primary server online, find the next
-	if lb.primaryOnlineCount > 0 {
-		for {
-			srv := &lb.primaryGroup.srvList[lb.primaryGroup.currServerIdx]
+	// Unlock access
+	lb.mtx.Unlock()
 
-			if srv.isDown && now.After(srv.failTimestamp) {
-				// Set this server online again
-				srv.isDown = false
-				srv.lb.primaryOnlineCount += 1
+	// Done
+	return nil
+}
 
-				notifyUp = append(notifyUp, srv)
-			}
+// Next gets the next available server. It can return nil if no available server. Servers that reached their
+// MaxConcurrent limit are skipped.
+func (lb *LoadBalancer) Next() *Server {
+	return lb.next(false, false)
+}
 
-			if !srv.isDown && lb.primaryGroup.currServerWeight < srv.opts.Weight {
-				// Got a server!
-				lb.primaryGroup.currServerWeight += 1
+// Acquire gets the next available server, like Next, and atomically reserves a concurrency slot on it. The returned
+// release function must be called once the request ends. It can return a nil server if no available server.
+func (lb *LoadBalancer) Acquire() (*Server, func()) {
+	return lb.acquire(false)
+}
 
-				// Select this server
-				nextServer = srv
-				break
-			}
+// AcquireBackup works like Acquire but only selects among the backup servers, even if there are primary servers
+// online, for e.g., to verify the backups work without simulating a primary outage. It can return a nil server if
+// no backup server is available.
+func (lb *LoadBalancer) AcquireBackup() (*Server, func()) {
+	return lb.acquire(true)
+}
 
-			// Advance to next server
-			lb.primaryGroup.currServerIdx += 1
-			if lb.primaryGroup.currServerIdx >= len(lb.primaryGroup.srvList) {
-				lb.primaryGroup.currServerIdx = 0
-			}
+func (lb *LoadBalancer) acquire(backupOnly bool) (*Server, func()) {
+	srv := lb.next(true, backupOnly)
+	if srv == nil {
+		return nil, func() {}
+	}
 
-			lb.primaryGroup.currServerWeight = 0
-		}
+	once := sync.Once{}
+	return srv, func() {
+		once.Do(srv.EndRequest)
 	}
+}
 
-	// Look for backup servers if there is no primary available
-	if nextServer == nil && len(lb.backupGroup.srvList) > 0 {
-		for {
-			srv := &lb.backupGroup.srvList[lb.backupGroup.currServerIdx]
+func (lb *LoadBalancer) next(acquire bool, backupOnly bool) *Server {
+	var nextServer *Server
 
-			if lb.backupGroup.currServerWeight < srv.opts.Weight {
-				// Got a server!
-				lb.backupGroup.currServerWeight += 1
+	var notifyUp []*Server // NOTE: We would use defer, but they are executed LIFO
 
-				// Select this server
-				nextServer = srv
-				break
-			}
+	// Lock access
+	lb.mtx.Lock()
 
-			// Advance to next server
-			lb.backupGroup.currServerIdx += 1
-			if lb.backupGroup.currServerIdx >= len(lb.backupGroup.srvList) {
-				lb.backupGroup.currServerIdx = 0
+	// Apply the offline state shared by other load balancers, at most once per sync interval
+	// NOTE: The store is queried without holding the lock
+	if now := time.Now(); lb.healthStore != nil && now.Sub(lb.healthSyncTime) >= lb.healthSyncInterval {
+		lb.healthSyncTime = now
+		lb.mtx.Unlock()
+		for _, srv := range lb.syncHealthStore(now) {
+			lb.raiseEvent(ServerDownEvent, srv)
+		}
+		lb.mtx.Lock()
+	}
+
+	if backupOnly {
+		// Skip the primary servers
+		if len(lb.backupGroup.srvList) > 0 {
+			nextServer, notifyUp = lb.selectFromGroup(&lb.backupGroup, time.Now(), notifyUp)
+		}
+	} else {
+		// Fast path for the common single primary server case, no need to run the selection if it is available
+		if len(lb.primaryGroup.srvList) == 1 && !lb.backupActive {
+			if srv := lb.primaryGroup.srvList[0]; !srv.isDown && !srv.isSaturated() {
+				nextServer = srv
 			}
+		}
+		if nextServer == nil {
+			nextServer, notifyUp = lb.selectServer(time.Now(), notifyUp)
+		}
+	}
 
-			lb.backupGroup.currServerWeight = 0
+	// Track the selection and, if requested, reserve a slot while we still hold the lock
+	if nextServer != nil {
+		nextServer.selectCount += 1
+		if acquire {
+			nextServer.inFlight += 1
 		}
 	}
 
@@ -205,68 +365,200 @@ func (lb *LoadBalancer) Next() *Server {
 	return nextServer
 }
 
-// WaitNext returns a channel that is fulfilled with the next available server
-func (lb *LoadBalancer) WaitNext() (ch chan *Server) {
-	ch = make(chan *Server)
+// selectServer runs the full selection over the primary and backup groups
+// NOTE: The load balancer lock must be held
+func (lb *LoadBalancer) selectServer(now time.Time, notifyUp []*Server) (*Server, []*Server) {
+	var nextServer *Server
 
-	// Set up a goroutine that will be fulfilled when a server is available
-	go func() {
-		var srv *Server
+	// If all primary servers are offline, check if we can put someone up
+	if lb.primaryOnlineCount == 0 {
+		if lb.backupDeactivation > 0 && len(lb.backupGroup.srvList) > 0 {
+			lb.backupActive = true
+		}
+		notifyUp = lb.promotePrimaries(now, notifyUp)
+	} else if lb.backupActive {
+		// Keep recovering the primary servers while the backups are serving
+		notifyUp = lb.promoteExpired(&lb.primaryGroup, now, notifyUp)
+	}
 
-		for {
-			// Get an available server
-			srv = lb.Next()
-			if srv != nil {
-				// Got one
-				break
-			}
+	// Keep the backups serving after a failover until enough primary capacity is back
+	if lb.backupActive && lb.primaryOnlineCount > 0 {
+		if fraction, ok := lb.onlinePrimaryFraction(); !ok || fraction >= lb.backupDeactivation {
+			lb.backupActive = false
+		}
+	}
+
+	// Decide if this request goes to the backups because of the lost primary capacity
+	blendToBackup := lb.primaryOnlineCount > 0 && (lb.backupActive || lb.shouldBlendToBackup())
+
+	// If there is at least one primary server online, find the next
+	if lb.primaryOnlineCount > 0 && !blendToBackup {
+		nextServer, notifyUp = lb.selectPrimary(now, notifyUp)
+	}
+
+	// Look for backup servers if there is no primary available or, in overflow mode, if all of them are busy
+	if nextServer == nil && (lb.primaryOnlineCount == 0 || lb.backupOverflow || blendToBackup) &&
+		len(lb.backupGroup.srvList) > 0 {
+		nextServer, notifyUp = lb.selectFromGroup(&lb.backupGroup, now, notifyUp)
+	}
 
-			now := time.Now()
-			toWait := time.Duration(-1)
+	// Fall back to the primary servers if the backups are busy
+	if nextServer == nil && blendToBackup {
+		nextServer, notifyUp = lb.selectPrimary(now, notifyUp)
+	}
+
+	// Done
+	return nextServer, notifyUp
+}
+
+// shouldBlendToBackup randomly decides if the current request must be sent to the backups based on the weight of
+// the online primary servers and the activation threshold
+// NOTE: The load balancer lock must be held
+func (lb *LoadBalancer) shouldBlendToBackup() bool {
+	if lb.backupThreshold <= 0 || len(lb.backupGroup.srvList) == 0 {
+		return false
+	}
+
+	onlineFraction, ok := lb.onlinePrimaryFraction()
+	if !ok || onlineFraction >= lb.backupThreshold {
+		return false
+	}
+	return lb.rnd.Float64() < 1-onlineFraction/lb.backupThreshold
+}
+
+// onlinePrimaryFraction returns the fraction of the total primary weight that is online. It returns false if there
+// are no primary servers.
+// NOTE: The load balancer lock must be held
+func (lb *LoadBalancer) onlinePrimaryFraction() (float64, bool) {
+	totalWeight := 0
+	onlineWeight := 0
+	for _, srv := range lb.primaryGroup.srvList {
+		totalWeight += srv.opts.Weight
+		if !srv.isDown {
+			onlineWeight += srv.opts.Weight
+		}
+	}
+	if totalWeight == 0 {
+		return 0, false
+	}
+	return float64(onlineWeight) / float64(totalWeight), true
+}
+
+// Peek returns the server Next would return without advancing the selection or changing the state of any server.
+// It can return nil if no available server.
+// NOTE: Random strategies cannot anticipate selections, so the first eligible server is returned instead.
+func (lb *LoadBalancer) Peek() *Server {
+	list := lb.PeekN(1)
+	if len(list) == 0 {
+		return nil
+	}
+	return list[0]
+}
 
-			// Lock access
-			lb.mtx.Lock()
+// PeekN returns the next n servers Next would return, in order, assuming no server changes its online state in
+// the meantime. The selection state is not modified.
+func (lb *LoadBalancer) PeekN(n int) []*Server {
+	now := time.Now()
+
+	list := make([]*Server, 0, n)
+
+	// Lock access
+	lb.mtx.Lock()
 
-			// Exit if we don't have primary servers
-			if len(lb.primaryGroup.srvList) == 0 {
-				lb.mtx.Unlock()
+	// Work on copies of the group cursors
+	primaryGroup := lb.peekTier(now)
+	primaryCursor := primaryGroup.cursor()
+	backupCursor := lb.backupGroup.cursor()
+
+	// Backups are only used if no primary server is available or, in overflow mode, also if all of them are busy
+	useBackups := lb.backupOverflow
+	if !useBackups {
+		useBackups = true
+		for _, srv := range lb.primaryGroup.srvList {
+			if srv.isEligible(now) {
+				useBackups = false
 				break
 			}
+		}
+	}
 
-			// Get the server that will become online sooner
-			srvCount := len(lb.primaryGroup.srvList)
-			for idx := 0; idx < srvCount; idx++ {
-				srv = &lb.primaryGroup.srvList[idx]
-
-				// Only consider offline servers
-				if srv.isDown {
-					diff := srv.failTimestamp.Sub(now)
-					if diff <= 0 {
-						// This server will immediately become online
-						break
-					}
-
-					if toWait < 0 || diff < toWait {
-						toWait = diff
-					}
-				}
+	for len(list) < n {
+		srv := lb.peekFromGroup(primaryGroup, &primaryCursor, now)
+		if srv == nil {
+			if useBackups {
+				srv = lb.peekFromGroup(&lb.backupGroup, &backupCursor, now)
+			}
+			if srv == nil {
+				break
 			}
+		}
+		list = append(list, srv)
+	}
 
-			// Unlock access
-			lb.mtx.Unlock()
+	// Unlock access
+	lb.mtx.Unlock()
 
-			// Wait some time until a new server can become available
-			if toWait > 0 {
-				time.Sleep(toWait)
-			}
+	// Done
+	return list
+}
+
+// WaitNext returns a channel that is fulfilled with the next available server. The channel receives nil if the
+// load balancer has no servers at all.
+func (lb *LoadBalancer) WaitNext() (ch chan *Server) {
+	return lb.WaitNextTimeout(0)
+}
+
+// WaitNextTimeout returns a channel that is fulfilled with the next available server, like WaitNext, but it receives
+// nil if no server becomes available within the specified time. A zero or negative maxWait means no limit.
+//
+// Blocked callers are served in FIFO order, so a late caller cannot take a server before an earlier one.
+func (lb *LoadBalancer) WaitNextTimeout(maxWait time.Duration) chan *Server {
+	w := waiter{
+		ch: make(chan *Server, 1),
+	}
+	if maxWait > 0 {
+		w.deadline = time.Now().Add(maxWait)
+	}
+
+	// Queue the waiter and start the dispatcher if not running
+	lb.waitersMtx.Lock()
+	lb.waiters = append(lb.waiters, &w)
+	startDispatcher := !lb.dispatching
+	lb.dispatching = true
+	lb.waitersMtx.Unlock()
+
+	if startDispatcher {
+		go lb.dispatchWaiters()
+	} else {
+		// Wake up the dispatcher so it can check if the new waiter can be served
+		select {
+		case lb.waitersWakeCh <- struct{}{}:
+		default:
 		}
+	}
 
-		// Once we have a server, send through the channel
-		ch <- srv
-		close(ch)
-	}()
+	// Done
+	return w.ch
+}
+
+// Recover puts online again the servers whose offline period expired and raises the corresponding events.
+// Recovery normally happens lazily when selecting a server, so call it periodically to keep the servers state up to
+// date while there is no traffic.
+func (lb *LoadBalancer) Recover() {
+	now := time.Now()
+
+	// Lock access
+	lb.mtx.Lock()
 
-	return
+	notifyUp := lb.promoteExpired(&lb.primaryGroup, now, make([]*Server, 0))
+
+	// Unlock access
+	lb.mtx.Unlock()
+
+	// Call event callback
+	for _, srv := range notifyUp {
+		lb.raiseEvent(ServerUpEvent, srv)
+	}
 }
 
 // OnlineCount gets the total amount of online servers
@@ -279,3 +571,67 @@ func (lb *LoadBalancer) OnlineCount(includeBackup bool) int {
 	}
 	return count
 }
+
+// ForEachOnline calls fn for each online server, primary ones first followed by the backup servers, until it returns
+// false. It allows to build custom dispatchers, for e.g., for other protocols, on top of the balancer health tracking.
+// The list of online servers is taken while holding the lock but fn is called without it, so it can call the load
+// balancer and Server methods.
+func (lb *LoadBalancer) ForEachOnline(fn func(srv *Server) bool) {
+	lb.mtx.Lock()
+	online := make([]*Server, 0, len(lb.primaryGroup.srvList)+len(lb.backupGroup.srvList))
+	for _, srv := range lb.primaryGroup.srvList {
+		if !srv.isDown {
+			online = append(online, srv)
+		}
+	}
+	for _, srv := range lb.backupGroup.srvList {
+		if !srv.isDown {
+			online = append(online, srv)
+		}
+	}
+	lb.mtx.Unlock()
+
+	for _, srv := range online {
+		if !fn(srv) {
+			break
+		}
+	}
+}
+
+// AvailableCapacity returns the sum of the weights of the online primary servers or, if all of them are offline, the
+// sum of the weights of the backup servers, so weighted pools can be compared by the capacity they can serve.
+func (lb *LoadBalancer) AvailableCapacity() int {
+	lb.mtx.Lock()
+	defer lb.mtx.Unlock()
+
+	return lb.availableCapacity()
+}
+
+// NOTE: The load balancer lock must be held
+func (lb *LoadBalancer) availableCapacity() int {
+	capacity := 0
+	for _, srv := range lb.primaryGroup.srvList {
+		if !srv.isDown {
+			capacity += srv.opts.Weight
+		}
+	}
+	if lb.primaryOnlineCount == 0 {
+		for _, srv := range lb.backupGroup.srvList {
+			capacity += srv.opts.Weight
+		}
+	}
+	return capacity
+}
+
+// SetComparator sets the function used to pick a server and switches to the ComparatorStrategy. Pass nil to go back
+// to the strategy set in the options.
+func (lb *LoadBalancer) SetComparator(less Comparator) {
+	lb.mtx.Lock()
+	lb.comparator = less
+	if less != nil {
+		lb.strategy = ComparatorStrategy
+	} else {
+		lb.strategy = lb.defaultStrategy
+	}
+	lb.mtx.Unlock()
+}
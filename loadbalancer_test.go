@@ -3,6 +3,9 @@
 package loadbalancer
 
 import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -74,6 +77,896 @@ func TestBackup(t *testing.T) {
 	srv.SetOffline() // NOTE: This call will act as a NO-OP
 }
 
+func TestBackupWeights(t *testing.T) {
+	lb := createTestLoadBalancer(false)
+
+	_ = lb.Add(ServerOptions{
+		Weight:   3,
+		IsBackup: true,
+	}, "backup 1")
+	_ = lb.Add(ServerOptions{
+		Weight:   1,
+		IsBackup: true,
+	}, "backup 2")
+
+	// Put all primary servers offline
+	for idx := 0; idx < 6; idx++ {
+		srv := lb.Next()
+
+		srv.SetOffline()
+	}
+
+	// Failover traffic must follow the backup weights
+	counts := make(map[string]int)
+	for idx := 0; idx < 400; idx++ {
+		srvName, _ := lb.Next().UserData().(string)
+		counts[srvName] += 1
+	}
+	require.Equal(t, 300, counts["backup 1"])
+	require.Equal(t, 100, counts["backup 2"])
+}
+
+func TestBackupOverflow(t *testing.T) {
+	for _, overflow := range []bool{false, true} {
+		lb := CreateWithOptions(Options{
+			BackupOverflow: overflow,
+		})
+		_ = lb.Add(ServerOptions{
+			MaxConcurrent: 1,
+		}, serverOneName)
+		_ = lb.Add(ServerOptions{
+			IsBackup: true,
+		}, backupServerName)
+
+		// Keep the primary server busy
+		srv := lb.Next()
+		srvName, _ := srv.UserData().(string)
+		require.Equal(t, serverOneName, srvName)
+		srv.BeginRequest()
+
+		// Backup must only be used in overflow mode
+		srv2 := lb.Next()
+		if overflow {
+			srvName, _ = srv2.UserData().(string)
+			require.Equal(t, backupServerName, srvName)
+		} else {
+			require.Equal(t, (*Server)(nil), srv2)
+		}
+
+		// Once the primary server is released, it must be selected again
+		srv.EndRequest()
+		srvName, _ = lb.Next().UserData().(string)
+		require.Equal(t, serverOneName, srvName)
+	}
+}
+
+func TestSetOfflineFor(t *testing.T) {
+	lb := createTestLoadBalancer(false)
+
+	// Server 2 has a fail timeout of one second, keep it offline longer
+	servers := lb.Servers()
+	servers[1].SetOfflineFor(time.Hour)
+	require.Equal(t, 1, lb.OnlineCount(false))
+
+	// Put server 1 offline too, no server must become available after its regular fail timeout
+	for idx := 0; idx < 3; idx++ {
+		servers[0].SetOffline()
+	}
+	time.Sleep(1100 * time.Millisecond)
+	require.Equal(t, (*Server)(nil), lb.Next())
+}
+
+func TestAddFailure(t *testing.T) {
+	lb := createTestLoadBalancer(false)
+	srv := lb.Servers()[0]
+
+	// Five half failures are needed to reach MaxFails
+	for idx := 0; idx < 5; idx++ {
+		require.Equal(t, 2, lb.OnlineCount(false))
+		srv.AddFailure(0.5)
+	}
+	require.Equal(t, 2, lb.OnlineCount(false))
+	srv.AddFailure(0.5)
+	require.Equal(t, 1, lb.OnlineCount(false))
+	require.Equal(t, 3.0, lb.Snapshot().Servers[0].FailCounter)
+}
+
+func TestRecover(t *testing.T) {
+	lb := createTestLoadBalancer(false)
+
+	upEvents := 0
+	lb.SetEventHandler(func(eventType int, server *Server) {
+		if eventType == ServerUpEvent {
+			upEvents += 1
+		}
+	})
+
+	lb.Servers()[0].SetOfflineFor(50 * time.Millisecond)
+	require.Equal(t, 1, lb.OnlineCount(false))
+
+	// Nothing to recover yet
+	lb.Recover()
+	require.Equal(t, 0, upEvents)
+
+	time.Sleep(100 * time.Millisecond)
+	lb.Recover()
+	require.Equal(t, 1, upEvents)
+	require.Equal(t, 2, lb.OnlineCount(false))
+
+	// A recovered server must go offline again if it keeps failing
+	lb.Servers()[0].AddFailure(3)
+	require.Equal(t, 1, lb.OnlineCount(false))
+}
+
+func TestWindowedFailures(t *testing.T) {
+	lb := Create()
+	_ = lb.Add(ServerOptions{
+		MaxFails:    2,
+		FailTimeout: 30 * time.Millisecond,
+	}, serverOneName)
+	srv := lb.Servers()[0]
+
+	// Failures in different periods are not accumulated
+	srv.SetOffline()
+	time.Sleep(50 * time.Millisecond)
+	srv.SetOffline()
+	require.Equal(t, 1, lb.OnlineCount(false))
+
+	srv.SetOffline()
+	require.Equal(t, 0, lb.OnlineCount(false))
+}
+
+func TestConsecutiveFailures(t *testing.T) {
+	lb := Create()
+	_ = lb.Add(ServerOptions{
+		MaxFails:    2,
+		FailTimeout: 30 * time.Millisecond,
+		FailureMode: ConsecutiveFailures,
+	}, serverOneName)
+	srv := lb.Servers()[0]
+
+	// A success resets the counter
+	srv.SetOffline()
+	srv.SetOnline()
+	srv.SetOffline()
+	require.Equal(t, 1, lb.OnlineCount(false))
+
+	// But the time elapsed between failures does not
+	time.Sleep(50 * time.Millisecond)
+	srv.SetOffline()
+	require.Equal(t, 0, lb.OnlineCount(false))
+}
+
+func TestSlidingRateFailures(t *testing.T) {
+	lb := Create()
+	_ = lb.Add(ServerOptions{
+		MaxFails:      2,
+		FailTimeout:   time.Minute,
+		FailureMode:   SlidingRateFailures,
+		FailureWindow: 4,
+	}, serverOneName)
+	srv := lb.Servers()[0]
+
+	// The first failure leaves the window before the second one arrives
+	srv.SetOffline()
+	srv.SetOnline()
+	srv.SetOnline()
+	srv.SetOnline()
+	srv.SetOffline()
+	require.Equal(t, 1, lb.OnlineCount(false))
+
+	// Two failures among the last four requests
+	srv.SetOnline()
+	srv.SetOffline()
+	require.Equal(t, 0, lb.OnlineCount(false))
+
+	// The window must be set
+	err := lb.Add(ServerOptions{
+		MaxFails:    2,
+		FailTimeout: time.Minute,
+		FailureMode: SlidingRateFailures,
+	}, serverTwoName)
+	require.Error(t, err)
+}
+
+func TestPriorityTiers(t *testing.T) {
+	lb := Create()
+	for idx := 1; idx <= 3; idx++ {
+		_ = lb.Add(ServerOptions{
+			MaxFails:    1,
+			FailTimeout: time.Minute,
+			Priority:    (idx - 1) / 2,
+		}, fmt.Sprintf("server %v", idx))
+	}
+	_ = lb.Add(ServerOptions{
+		IsBackup: true,
+	}, backupServerName)
+
+	nextNames := func(count int) map[string]int {
+		names := make(map[string]int)
+		for idx := 0; idx < count; idx++ {
+			names[lb.Next().UserData().(string)] += 1
+		}
+		return names
+	}
+
+	// Only the first tier is used while it is online
+	require.Equal(t, map[string]int{"server 1": 2, "server 2": 2}, nextNames(4))
+	require.Equal(t, "server 1", lb.Peek().UserData().(string))
+
+	// Then the second one
+	lb.Servers()[0].SetOffline()
+	require.Equal(t, map[string]int{"server 2": 2}, nextNames(2))
+	lb.Servers()[1].SetOfflineFor(50 * time.Millisecond)
+	require.Equal(t, "server 3", lb.Peek().UserData().(string))
+	require.Equal(t, map[string]int{"server 3": 2}, nextNames(2))
+
+	// And the backups at last
+	lb.Servers()[2].SetOffline()
+	require.Equal(t, map[string]int{backupServerName: 2}, nextNames(2))
+
+	// A recovered server of the first tier is preferred again
+	time.Sleep(80 * time.Millisecond)
+	require.Equal(t, map[string]int{"server 2": 2}, nextNames(2))
+}
+
+func TestRecoveryOrder(t *testing.T) {
+	lb := Create()
+	for idx := 1; idx <= 3; idx++ {
+		_ = lb.Add(ServerOptions{
+			MaxFails:    1,
+			FailTimeout: time.Minute,
+		}, fmt.Sprintf("server %v", idx))
+	}
+
+	upOrder := make([]string, 0)
+	lb.SetEventHandler(func(eventType int, server *Server) {
+		if eventType == ServerUpEvent {
+			upOrder = append(upOrder, server.UserData().(string))
+		}
+	})
+
+	// Put all servers offline, the last one failing first
+	lb.Servers()[0].SetOfflineFor(90 * time.Millisecond)
+	lb.Servers()[1].SetOfflineFor(70 * time.Millisecond)
+	lb.Servers()[2].SetOfflineFor(50 * time.Millisecond)
+	require.Nil(t, lb.Next())
+
+	// The oldest failure must be probed first
+	time.Sleep(120 * time.Millisecond)
+	srvName, _ := lb.Next().UserData().(string)
+	require.Equal(t, "server 3", srvName)
+	require.Equal(t, []string{"server 3", "server 2", "server 1"}, upOrder)
+}
+
+func TestMaxRecoveryPromotions(t *testing.T) {
+	lb := CreateWithOptions(Options{
+		MaxRecoveryPromotions: 1,
+	})
+	for idx := 1; idx <= 3; idx++ {
+		_ = lb.Add(ServerOptions{
+			MaxFails:    1,
+			FailTimeout: time.Minute,
+		}, fmt.Sprintf("server %v", idx))
+	}
+
+	// Put all servers offline and wait until they can be recovered
+	lb.Servers()[0].SetOfflineFor(50 * time.Millisecond)
+	lb.Servers()[1].SetOfflineFor(70 * time.Millisecond)
+	lb.Servers()[2].SetOfflineFor(30 * time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+
+	// Only the oldest failure is promoted
+	srvName, _ := lb.Next().UserData().(string)
+	require.Equal(t, "server 3", srvName)
+	snap := lb.Snapshot()
+	require.Equal(t, 1, snap.PrimaryOnlineCount)
+	require.Equal(t, 2, snap.PendingRecoveryCount)
+
+	// The rest are promoted by the following calls
+	for i := 0; i < 2; i++ {
+		require.NotNil(t, lb.Next())
+	}
+	snap = lb.Snapshot()
+	require.Equal(t, 3, snap.PrimaryOnlineCount)
+	require.Equal(t, 0, snap.PendingRecoveryCount)
+
+	// And they can go offline again
+	lb.Servers()[0].SetOffline()
+	lb.Servers()[1].SetOffline()
+	require.Equal(t, 1, lb.OnlineCount(false))
+}
+
+func TestDowntimeStats(t *testing.T) {
+	lb := createTestLoadBalancer(false)
+	srv := lb.Servers()[0]
+
+	// Go offline and recover
+	srv.SetOfflineFor(30 * time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	lb.Recover()
+
+	// Fail again right after recovering
+	srv.SetOfflineFor(time.Minute)
+
+	ss := lb.Snapshot().Servers[0]
+	require.Equal(t, uint64(2), ss.DownCount)
+	require.Equal(t, uint64(1), ss.FlapCount)
+	require.GreaterOrEqual(t, ss.LastDownDuration, 30*time.Millisecond)
+	require.Equal(t, ss.LastDownDuration, ss.TotalDownDuration)
+
+	// The ongoing outage is accounted once the server is online again
+	srv.SetOnline()
+	ss = lb.Snapshot().Servers[0]
+	require.Greater(t, ss.TotalDownDuration, ss.LastDownDuration)
+
+	lb.ResetStats()
+	ss = lb.Snapshot().Servers[0]
+	require.Equal(t, uint64(0), ss.DownCount)
+	require.Equal(t, time.Duration(0), ss.TotalDownDuration)
+}
+
+func TestBreakerCooldown(t *testing.T) {
+	lb := Create()
+	_ = lb.Add(ServerOptions{
+		MaxFails:         1,
+		FailTimeout:      10 * time.Second,
+		BreakerThreshold: 2,
+		BreakerCooldown:  30 * time.Second,
+	}, serverOneName)
+	_ = lb.Add(ServerOptions{}, serverTwoName)
+	srv := lb.Servers()[0]
+
+	// A passive failure puts the server offline for FailTimeout
+	srv.SetOffline()
+	recoveryTime := lb.Snapshot().Servers[0].RecoveryTime
+	require.WithinDuration(t, time.Now().Add(10*time.Second), recoveryTime, time.Second)
+
+	// A second consecutive failure trips the breaker and extends the recovery time
+	srv.SetOffline()
+	recoveryTime = lb.Snapshot().Servers[0].RecoveryTime
+	require.WithinDuration(t, time.Now().Add(30*time.Second), recoveryTime, time.Second)
+
+	// A success resets the consecutive failures
+	srv.SetOnline()
+	srv.SetOffline()
+	recoveryTime = lb.Snapshot().Servers[0].RecoveryTime
+	require.WithinDuration(t, time.Now().Add(10*time.Second), recoveryTime, time.Second)
+
+	require.Error(t, lb.Add(ServerOptions{
+		BreakerCooldown: -1,
+	}, serverOneName))
+}
+
+func TestExportImportState(t *testing.T) {
+	create := func() *LoadBalancer {
+		lb := Create()
+		for idx := 1; idx <= 3; idx++ {
+			_ = lb.Add(ServerOptions{
+				Name:        fmt.Sprintf("server-%v", idx),
+				MaxFails:    2,
+				FailTimeout: time.Minute,
+			}, fmt.Sprintf("server %v", idx))
+		}
+		return lb
+	}
+
+	// Put the first server offline and account one failure on the second
+	lb := create()
+	lb.Servers()[0].SetOffline()
+	lb.Servers()[0].SetOffline()
+	lb.Servers()[1].SetOffline()
+	recoveryTime := lb.Snapshot().Servers[0].RecoveryTime
+
+	// Restore the state on a fresh load balancer
+	restored := create()
+	downEvents := 0
+	restored.SetEventHandler(func(eventType int, server *Server) {
+		if eventType == ServerDownEvent {
+			downEvents += 1
+		}
+	})
+	require.NoError(t, restored.ImportState(lb.ExportState()))
+	require.Equal(t, 1, downEvents)
+
+	snap := restored.Snapshot()
+	require.Equal(t, 2, snap.PrimaryOnlineCount)
+	require.False(t, snap.Servers[0].IsOnline)
+	require.True(t, recoveryTime.Equal(snap.Servers[0].RecoveryTime))
+	require.Equal(t, float64(1), snap.Servers[1].FailCounter)
+	require.Equal(t, float64(0), snap.Servers[2].FailCounter)
+
+	// A single failure must be enough to put the second server offline now
+	restored.Servers()[1].SetOffline()
+	require.Equal(t, 1, restored.OnlineCount(false))
+
+	require.Error(t, restored.ImportState([]byte("invalid")))
+}
+
+func TestBackupActivationThreshold(t *testing.T) {
+	lb := CreateWithOptions(Options{
+		Rand:                      rand.New(rand.NewSource(1)),
+		BackupActivationThreshold: 0.5,
+	})
+	for idx := 1; idx <= 4; idx++ {
+		_ = lb.Add(ServerOptions{
+			MaxFails:    1,
+			FailTimeout: time.Minute,
+		}, fmt.Sprintf("server %v", idx))
+	}
+	_ = lb.Add(ServerOptions{
+		IsBackup: true,
+	}, backupServerName)
+
+	countBackups := func() int {
+		count := 0
+		for idx := 0; idx < 1000; idx++ {
+			if lb.Next().UserData().(string) == backupServerName {
+				count += 1
+			}
+		}
+		return count
+	}
+
+	// Half of the primary weight online, backups not used yet
+	lb.Servers()[0].SetOffline()
+	lb.Servers()[1].SetOffline()
+	require.Equal(t, 0, countBackups())
+
+	// A quarter online, half of the traffic goes to the backups
+	lb.Servers()[2].SetOffline()
+	count := countBackups()
+	require.Greater(t, count, 400)
+	require.Less(t, count, 600)
+}
+
+func TestSingleServerFailover(t *testing.T) {
+	lb := Create()
+	_ = lb.Add(ServerOptions{
+		MaxFails:    1,
+		FailTimeout: 50 * time.Millisecond,
+	}, serverOneName)
+	_ = lb.Add(ServerOptions{
+		IsBackup: true,
+	}, backupServerName)
+
+	srvName, _ := lb.Next().UserData().(string)
+	require.Equal(t, serverOneName, srvName)
+
+	// The backup must be used while the single primary server is offline
+	lb.Servers()[0].SetOffline()
+	srvName, _ = lb.Next().UserData().(string)
+	require.Equal(t, backupServerName, srvName)
+
+	// And the primary one again once it recovers
+	time.Sleep(100 * time.Millisecond)
+	srvName, _ = lb.Next().UserData().(string)
+	require.Equal(t, serverOneName, srvName)
+}
+
+func TestBackupDeactivationThreshold(t *testing.T) {
+	lb := CreateWithOptions(Options{
+		BackupDeactivationThreshold: 0.75,
+	})
+	for idx := 1; idx <= 4; idx++ {
+		_ = lb.Add(ServerOptions{
+			MaxFails:    1,
+			FailTimeout: time.Minute,
+		}, fmt.Sprintf("server %v", idx))
+	}
+	_ = lb.Add(ServerOptions{
+		IsBackup: true,
+	}, backupServerName)
+
+	// Fail over to the backups
+	lb.Servers()[0].SetOfflineFor(50 * time.Millisecond)
+	lb.Servers()[1].SetOfflineFor(50 * time.Millisecond)
+	lb.Servers()[2].SetOfflineFor(150 * time.Millisecond)
+	lb.Servers()[3].SetOfflineFor(150 * time.Millisecond)
+	require.Equal(t, backupServerName, lb.Next().UserData().(string))
+
+	// Half of the primary weight recovered, the backups keep serving
+	time.Sleep(80 * time.Millisecond)
+	require.Equal(t, backupServerName, lb.Next().UserData().(string))
+	require.Equal(t, 2, lb.OnlineCount(false))
+
+	// Enough primary weight is back
+	time.Sleep(100 * time.Millisecond)
+	require.NotEqual(t, backupServerName, lb.Next().UserData().(string))
+	require.Equal(t, 4, lb.OnlineCount(false))
+
+	// The recovered primary servers must go offline again if they keep failing
+	for _, srv := range lb.Servers()[:4] {
+		srv.SetOffline()
+	}
+	require.Equal(t, 0, lb.OnlineCount(false))
+	require.Equal(t, backupServerName, lb.Next().UserData().(string))
+}
+
+func TestAcquireBackup(t *testing.T) {
+	lb := createTestLoadBalancer(false)
+
+	// No backups
+	srv, release := lb.AcquireBackup()
+	require.Nil(t, srv)
+	release()
+
+	lb = createTestLoadBalancer(true)
+
+	// The backup is selected while the primary servers are online
+	srv, release = lb.AcquireBackup()
+	require.NotNil(t, srv)
+	require.Equal(t, backupServerName, srv.UserData().(string))
+	require.Equal(t, 1, srv.InFlight())
+	release()
+	require.Equal(t, 0, srv.InFlight())
+
+	// And it does not alter the regular selection
+	srv = lb.Next()
+	require.NotNil(t, srv)
+	require.NotEqual(t, backupServerName, srv.UserData().(string))
+}
+
+func TestAvailableCapacity(t *testing.T) {
+	lb := Create()
+	_ = lb.Add(ServerOptions{
+		Weight:      10,
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+	}, serverOneName)
+	_ = lb.Add(ServerOptions{
+		Weight:      3,
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+	}, serverTwoName)
+	_ = lb.Add(ServerOptions{
+		Weight:   2,
+		IsBackup: true,
+	}, backupServerName)
+
+	require.Equal(t, 13, lb.AvailableCapacity())
+
+	lb.Servers()[0].SetOffline()
+	require.Equal(t, 3, lb.AvailableCapacity())
+
+	// Backups are accounted once all primary servers are offline
+	lb.Servers()[1].SetOffline()
+	require.Equal(t, 2, lb.AvailableCapacity())
+}
+
+func TestSubscribe(t *testing.T) {
+	lb := createTestLoadBalancer(false)
+
+	// The current health is delivered right away
+	ch := lb.Subscribe()
+	health := <-ch
+	require.Equal(t, 2, health.OnlineCount)
+	require.Empty(t, health.Down)
+	require.Equal(t, serverOneCount+serverTwoCount, health.Capacity)
+
+	// State changes are pushed
+	srv := lb.Servers()[0]
+	srv.SetOfflineFor(time.Minute)
+
+	select {
+	case health = <-ch:
+	case <-time.After(time.Second):
+		require.FailNow(t, "health summary not received")
+	}
+	require.Equal(t, 1, health.OnlineCount)
+	require.Equal(t, []*Server{srv}, health.Down)
+	require.Equal(t, serverTwoCount, health.Capacity)
+
+	// Unsubscribing closes the channel
+	other := lb.Subscribe()
+	<-other
+	lb.Unsubscribe(ch)
+	_, ok := <-ch
+	require.False(t, ok)
+
+	// Closing the load balancer closes the rest
+	lb.Close()
+	_, ok = <-other
+	require.False(t, ok)
+
+	ch = lb.Subscribe()
+	<-ch
+	_, ok = <-ch
+	require.False(t, ok)
+}
+
+func TestSubscribeInterval(t *testing.T) {
+	lb := createTestLoadBalancerWithOptions(Options{
+		HealthSummaryInterval: 10 * time.Millisecond,
+	}, false)
+	defer lb.Close()
+
+	ch := lb.Subscribe()
+	last := <-ch
+
+	// Summaries are also sent periodically, without state changes
+	for idx := 0; idx < 3; idx++ {
+		select {
+		case health := <-ch:
+			require.False(t, health.Time.Before(last.Time))
+			last = health
+		case <-time.After(time.Second):
+			require.FailNow(t, "health summary not received")
+		}
+	}
+}
+
+func TestForEachOnline(t *testing.T) {
+	lb := createTestLoadBalancer(true)
+	lb.Servers()[0].SetOfflineFor(time.Minute)
+
+	names := make([]string, 0)
+	lb.ForEachOnline(func(srv *Server) bool {
+		names = append(names, srv.UserData().(string))
+		return true
+	})
+	require.Equal(t, []string{serverTwoName, backupServerName}, names)
+
+	// Stop on request
+	count := 0
+	lb.ForEachOnline(func(srv *Server) bool {
+		count += 1
+		return false
+	})
+	require.Equal(t, 1, count)
+}
+
+func TestComparatorStrategy(t *testing.T) {
+	lb := CreateWithOptions(Options{
+		Strategy: ComparatorStrategy,
+		Comparator: func(a, b *ServerSnapshot) bool {
+			return a.Server.UserData().(int) < b.Server.UserData().(int)
+		},
+	})
+	for _, cost := range []int{30, 10, 20} {
+		_ = lb.Add(ServerOptions{
+			MaxFails:    1,
+			FailTimeout: time.Minute,
+		}, cost)
+	}
+
+	// The cheapest server must always be selected
+	for idx := 0; idx < 3; idx++ {
+		require.Equal(t, 10, lb.Next().UserData().(int))
+	}
+	require.Equal(t, 10, lb.Peek().UserData().(int))
+
+	lb.Servers()[1].SetOffline()
+	require.Equal(t, 20, lb.Next().UserData().(int))
+
+	// Prefer the most expensive server now
+	lb.SetComparator(func(a, b *ServerSnapshot) bool {
+		return a.Server.UserData().(int) > b.Server.UserData().(int)
+	})
+	require.Equal(t, 30, lb.Next().UserData().(int))
+}
+
+func TestComparatorRecovery(t *testing.T) {
+	lb := createTestLoadBalancerWithOptions(Options{
+		Strategy: ComparatorStrategy,
+		Comparator: func(a, b *ServerSnapshot) bool {
+			return a.InFlight < b.InFlight
+		},
+	}, false)
+	requireFailsAfterRecovery(t, lb)
+}
+
+func TestParseServerOptions(t *testing.T) {
+	opts, err := ParseServerOptions("weight=3;max_fails=2;fail_timeout=10s;backup=false")
+	require.NoError(t, err)
+	require.Equal(t, ServerOptions{
+		Weight:      3,
+		MaxFails:    2,
+		FailTimeout: 10 * time.Second,
+	}, opts)
+
+	opts, err = ParseServerOptions("max_fails=2;fail_timeout=1m;failure_mode=sliding_rate;failure_window=10")
+	require.NoError(t, err)
+	require.Equal(t, SlidingRateFailures, opts.FailureMode)
+	require.Equal(t, 10, opts.FailureWindow)
+
+	opts, err = ParseServerOptions("name=cache&weight=1&backup=true")
+	require.NoError(t, err)
+	require.Equal(t, "cache", opts.Name)
+	require.True(t, opts.IsBackup)
+
+	// Unknown keys, malformed values and invalid combinations are rejected
+	_, err = ParseServerOptions("weight=3;color=red")
+	require.Error(t, err)
+	_, err = ParseServerOptions("fail_timeout=soon")
+	require.Error(t, err)
+	_, err = ParseServerOptions("weight")
+	require.Error(t, err)
+	_, err = ParseServerOptions("max_fails=2")
+	require.Error(t, err)
+	_, err = ParseServerOptions("weight=-1")
+	require.Error(t, err)
+}
+
+func TestWaitNextSaturatedExpiredServer(t *testing.T) {
+	lb := CreateWithOptions(Options{
+		HealthStoreSyncInterval: time.Nanosecond,
+	})
+	for _, name := range []string{serverOneName, serverTwoName} {
+		_ = lb.Add(ServerOptions{
+			Name:          name,
+			MaxFails:      1,
+			FailTimeout:   10 * time.Millisecond,
+			MaxConcurrent: 1,
+		}, name)
+	}
+
+	// Count the selection passes through the health store queries
+	store := &countingHealthStore{
+		HealthStore: NewMemoryHealthStore(),
+	}
+	lb.SetHealthStore(store)
+
+	// Saturate both servers and put the second one offline until its FailTimeout expires
+	servers := lb.Servers()
+	servers[0].BeginRequest()
+	servers[1].BeginRequest()
+	servers[1].SetOffline()
+	time.Sleep(20 * time.Millisecond)
+	atomic.StoreInt64(&store.queries, 0)
+
+	// The dispatcher must poll instead of spinning
+	require.Nil(t, <-lb.WaitNextTimeout(200*time.Millisecond))
+	require.Less(t, atomic.LoadInt64(&store.queries), int64(200))
+}
+
+func TestHealthStore(t *testing.T) {
+	store := NewMemoryHealthStore()
+
+	// Create two load balancers sharing the same server
+	lbs := make([]*LoadBalancer, 0)
+	for idx := 0; idx < 2; idx++ {
+		lb := Create()
+		lb.SetHealthStore(store)
+		_ = lb.Add(ServerOptions{
+			Name:        "shared",
+			MaxFails:    1,
+			FailTimeout: time.Minute,
+		}, serverOneName)
+		_ = lb.Add(ServerOptions{}, serverTwoName)
+		lbs = append(lbs, lb)
+	}
+
+	downEvents := 0
+	lbs[1].SetEventHandler(func(eventType int, server *Server) {
+		if eventType == ServerDownEvent {
+			downEvents += 1
+		}
+	})
+
+	// A failure detected by the first load balancer must be seen by the second one
+	lbs[0].Servers()[0].SetOffline()
+	for idx := 0; idx < 3; idx++ {
+		srvName, _ := lbs[1].Next().UserData().(string)
+		require.Equal(t, serverTwoName, srvName)
+	}
+	require.Equal(t, 1, downEvents)
+
+	// And the recovery too
+	lbs[0].Servers()[0].SetOnline()
+	isDown, _ := store.IsDown("shared")
+	require.False(t, isDown)
+}
+
+func TestHealthStoreSyncInterval(t *testing.T) {
+	lb := CreateWithOptions(Options{
+		HealthStoreSyncInterval: time.Hour,
+	})
+	_ = lb.Add(ServerOptions{
+		Name:        "shared",
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+	}, serverOneName)
+	_ = lb.Add(ServerOptions{}, serverTwoName)
+
+	store := &countingHealthStore{
+		HealthStore: NewMemoryHealthStore(),
+	}
+	lb.SetHealthStore(store)
+
+	// The store must be queried only once per interval
+	for idx := 0; idx < 10; idx++ {
+		require.NotNil(t, lb.Next())
+	}
+	require.Equal(t, int64(1), atomic.LoadInt64(&store.queries))
+
+	// Until the next query, servers put offline by other load balancers are still selected
+	store.MarkDown("shared", time.Now().Add(time.Minute))
+	srvName, _ := lb.Next().UserData().(string)
+	require.Equal(t, serverOneName, srvName)
+
+	// Setting the store again queries it right away
+	lb.SetHealthStore(store)
+	for idx := 0; idx < 3; idx++ {
+		srvName, _ = lb.Next().UserData().(string)
+		require.Equal(t, serverTwoName, srvName)
+	}
+	require.Equal(t, int64(2), atomic.LoadInt64(&store.queries))
+}
+
+func TestAcquire(t *testing.T) {
+	lb := Create()
+	_ = lb.Add(ServerOptions{
+		MaxConcurrent: 2,
+	}, serverOneName)
+
+	// Reserve all slots
+	srv1, release1 := lb.Acquire()
+	srv2, release2 := lb.Acquire()
+	require.NotNil(t, srv1)
+	require.NotNil(t, srv2)
+	require.Equal(t, 2, srv1.InFlight())
+
+	srv3, _ := lb.Acquire()
+	require.Equal(t, (*Server)(nil), srv3)
+
+	// Releasing twice must have no effect
+	release1()
+	release1()
+	require.Equal(t, 1, srv1.InFlight())
+
+	srv3, release3 := lb.Acquire()
+	require.NotNil(t, srv3)
+
+	release2()
+	release3()
+	require.Equal(t, 0, srv1.InFlight())
+}
+
+func TestWeightedLeastConnections(t *testing.T) {
+	lb := CreateWithOptions(Options{
+		Strategy: WeightedLeastConnectionsStrategy,
+	})
+	_ = lb.Add(ServerOptions{
+		Weight: 3,
+	}, serverOneName)
+	_ = lb.Add(ServerOptions{
+		Weight: 1,
+	}, serverTwoName)
+
+	// Keep requests in progress
+	releases := make(map[string][]func())
+	acquire := func(count int) {
+		for idx := 0; idx < count; idx++ {
+			srv, release := lb.Acquire()
+			require.NotNil(t, srv)
+			srvName, _ := srv.UserData().(string)
+			releases[srvName] = append(releases[srvName], release)
+		}
+	}
+	acquire(40)
+
+	// The weight-3 server must carry 3 times the load
+	servers := lb.Servers()
+	require.Equal(t, 30, servers[0].InFlight())
+	require.Equal(t, 10, servers[1].InFlight())
+
+	// Finished requests on the heavy server must be replaced there
+	for _, release := range releases[serverOneName][:9] {
+		release()
+	}
+	acquire(9)
+	require.Equal(t, 30, servers[0].InFlight())
+	require.Equal(t, 10, servers[1].InFlight())
+}
+
+func TestWeightedLeastConnectionsRecovery(t *testing.T) {
+	lb := createTestLoadBalancerWithOptions(Options{
+		Strategy: WeightedLeastConnectionsStrategy,
+	}, false)
+	requireFailsAfterRecovery(t, lb)
+}
+
 func TestWait(t *testing.T) {
 	lb := createTestLoadBalancer(false)
 
@@ -96,11 +989,254 @@ func TestWait(t *testing.T) {
 	require.Equal(t, srvName, serverTwoName)
 }
 
+func TestWaitBackupOnly(t *testing.T) {
+	lb := Create()
+	_ = lb.Add(ServerOptions{
+		IsBackup:      true,
+		MaxConcurrent: 1,
+	}, serverOneName)
+
+	// A backup server must be returned if no primary exists
+	srv := <-lb.WaitNext()
+	require.NotNil(t, srv)
+
+	// Wait until the busy backup server is released
+	srv, release := lb.Acquire()
+	require.NotNil(t, srv)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		release()
+	}()
+	srv = <-lb.WaitNextTimeout(5 * time.Second)
+	require.NotNil(t, srv)
+
+	// Give up if it never becomes available
+	srv, _ = lb.Acquire()
+	require.NotNil(t, srv)
+	start := time.Now()
+	srv = <-lb.WaitNextTimeout(100 * time.Millisecond)
+	require.Equal(t, (*Server)(nil), srv)
+	require.Less(t, time.Since(start), time.Second)
+}
+
+func TestWaitFIFO(t *testing.T) {
+	lb := Create()
+	_ = lb.Add(ServerOptions{
+		MaxConcurrent: 1,
+	}, serverOneName)
+
+	_, release := lb.Acquire()
+
+	// Queue some waiters
+	chs := make([]chan *Server, 0)
+	for idx := 0; idx < 3; idx++ {
+		chs = append(chs, lb.WaitNextTimeout(5*time.Second))
+		time.Sleep(20 * time.Millisecond)
+	}
+	release()
+
+	// Once the last waiter is served, the previous ones must be already served
+	srv := <-chs[2]
+	require.NotNil(t, srv)
+	for idx := 0; idx < 2; idx++ {
+		select {
+		case srv = <-chs[idx]:
+			require.NotNil(t, srv)
+		default:
+			require.Fail(t, "waiters not served in order")
+		}
+	}
+}
+
+func TestWaitNoServers(t *testing.T) {
+	lb := Create()
+
+	srv := <-lb.WaitNext()
+	require.Equal(t, (*Server)(nil), srv)
+}
+
+func TestPanickingEventHandler(t *testing.T) {
+	lb := createTestLoadBalancer(false)
+
+	events := 0
+	lb.SetEventHandler(func(eventType int, server *Server) {
+		events += 1
+		panic("buggy handler")
+	})
+
+	// Put the first server offline, the handler panic must not propagate
+	srv := lb.Next()
+	for idx := 0; idx < 3; idx++ {
+		srv.SetOffline()
+	}
+	require.Equal(t, 1, events)
+	require.Equal(t, 1, lb.OnlineCount(false))
+}
+
+func TestSnapshot(t *testing.T) {
+	lb := createTestLoadBalancer(true)
+
+	for idx := 0; idx < serverTotalCount; idx++ {
+		_ = lb.Next()
+	}
+	lb.Servers()[1].SetOfflineFor(time.Minute)
+
+	snap := lb.Snapshot()
+	require.Equal(t, 1, snap.PrimaryOnlineCount)
+	require.Len(t, snap.Servers, 3)
+	require.Equal(t, uint64(serverOneCount), snap.Servers[0].SelectCount)
+	require.Equal(t, uint64(serverTwoCount), snap.Servers[1].SelectCount)
+	require.False(t, snap.Servers[1].IsOnline)
+	require.False(t, snap.Servers[1].RecoveryTime.IsZero())
+	require.True(t, snap.Servers[2].IsBackup)
+}
+
+func TestSnapshotWeights(t *testing.T) {
+	lb := createTestLoadBalancer(false)
+	srv := lb.Servers()[0]
+
+	snap := lb.Snapshot()
+	require.Equal(t, serverOneCount, snap.Servers[0].Weight)
+	require.Equal(t, serverOneCount, snap.Servers[0].ConfiguredWeight)
+
+	// Runtime changes only alter the effective weight
+	require.NoError(t, srv.SetWeight(1))
+	snap = lb.Snapshot()
+	require.Equal(t, 1, snap.Servers[0].Weight)
+	require.Equal(t, serverOneCount, snap.Servers[0].ConfiguredWeight)
+
+	// A new traffic split is a new configuration
+	err := lb.SetTrafficSplit(map[*Server]float64{
+		srv:             75,
+		lb.Servers()[1]: 25,
+	})
+	require.NoError(t, err)
+	snap = lb.Snapshot()
+	require.Equal(t, 3, snap.Servers[0].Weight)
+	require.Equal(t, 3, snap.Servers[0].ConfiguredWeight)
+}
+
+func TestFairness(t *testing.T) {
+	lb := createTestLoadBalancer(false)
+
+	for idx := 0; idx < 10*serverTotalCount; idx++ {
+		_ = lb.Next()
+	}
+
+	fairness := lb.Fairness()
+	require.Len(t, fairness, 2)
+	require.InDelta(t, float64(serverOneCount)/serverTotalCount, fairness[0].ExpectedFraction, 1e-9)
+	require.InDelta(t, fairness[0].ExpectedFraction, fairness[0].RealizedFraction, 1e-9)
+	require.InDelta(t, 0, fairness[1].Deviation, 1e-9)
+
+	// Traffic sent while the second server is offline must appear as a deviation
+	lb.Servers()[1].SetOfflineFor(time.Minute)
+	for idx := 0; idx < serverTotalCount; idx++ {
+		_ = lb.Next()
+	}
+	fairness = lb.Fairness()
+	require.Greater(t, fairness[0].Deviation, 0.0)
+	require.Less(t, fairness[1].Deviation, 0.0)
+
+	// Reset the counters
+	lb.ResetStats()
+	fairness = lb.Fairness()
+	require.Equal(t, 0.0, fairness[0].RealizedFraction)
+	require.Equal(t, uint64(0), lb.Snapshot().Servers[0].SelectCount)
+}
+
+func TestPeek(t *testing.T) {
+	lb := createTestLoadBalancer(false)
+
+	// Preview the selections and check they match the real ones
+	preview := lb.PeekN(serverTotalCount * 2)
+	require.Len(t, preview, serverTotalCount*2)
+	require.Equal(t, preview[0], lb.Peek())
+
+	for idx := 0; idx < serverTotalCount*2; idx++ {
+		require.Equal(t, preview[idx], lb.Next())
+	}
+}
+
+func TestTrafficSplit(t *testing.T) {
+	lb := createTestLoadBalancer(false)
+
+	servers := lb.Servers()
+	require.Len(t, servers, 2)
+
+	// Send 5% of the traffic to the second server
+	err := lb.SetTrafficSplit(map[*Server]float64{
+		servers[0]: 95,
+		servers[1]: 5,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 19, servers[0].Weight())
+	require.Equal(t, 1, servers[1].Weight())
+
+	counts := make(map[string]int)
+	for idx := 0; idx < 200; idx++ {
+		srvName, _ := lb.Next().UserData().(string)
+		counts[srvName] += 1
+	}
+	require.Equal(t, 190, counts[serverOneName])
+	require.Equal(t, 10, counts[serverTwoName])
+
+	// Percentages must sum 100
+	err = lb.SetTrafficSplit(map[*Server]float64{
+		servers[0]: 50,
+		servers[1]: 10,
+	})
+	require.Error(t, err)
+}
+
+func TestWeightedRandomSeeded(t *testing.T) {
+	// Two load balancers with the same seed must do the same selections
+	lb1 := createTestLoadBalancerWithOptions(Options{
+		Strategy: WeightedRandomStrategy,
+		Rand:     rand.New(rand.NewSource(42)),
+	}, false)
+	lb2 := createTestLoadBalancerWithOptions(Options{
+		Strategy: WeightedRandomStrategy,
+		Rand:     rand.New(rand.NewSource(42)),
+	}, false)
+
+	counts := make(map[string]int)
+	for idx := 0; idx < serverTotalCount*1000; idx++ {
+		srvName1, _ := lb1.Next().UserData().(string)
+		srvName2, _ := lb2.Next().UserData().(string)
+		require.Equal(t, srvName1, srvName2)
+
+		counts[srvName1] += 1
+	}
+
+	// And respect the weights
+	require.InDelta(t, serverOneCount*1000, counts[serverOneName], 300)
+	require.InDelta(t, serverTwoCount*1000, counts[serverTwoName], 300)
+}
+
+func TestRandomRecovery(t *testing.T) {
+	lb := createTestLoadBalancerWithOptions(Options{
+		Strategy: RandomStrategy,
+	}, false)
+	requireFailsAfterRecovery(t, lb)
+}
+
+func TestWeightedRandomRecovery(t *testing.T) {
+	lb := createTestLoadBalancerWithOptions(Options{
+		Strategy: WeightedRandomStrategy,
+	}, false)
+	requireFailsAfterRecovery(t, lb)
+}
+
 // -----------------------------------------------------------------------------
 // Private functions
 
 func createTestLoadBalancer(addBackup bool) *LoadBalancer {
-	lb := Create()
+	return createTestLoadBalancerWithOptions(Options{}, addBackup)
+}
+
+func createTestLoadBalancerWithOptions(opts Options, addBackup bool) *LoadBalancer {
+	lb := CreateWithOptions(opts)
 
 	_ = lb.Add(ServerOptions{
 		Weight:      serverOneCount,
@@ -122,3 +1258,56 @@ func createTestLoadBalancer(addBackup bool) *LoadBalancer {
 
 	return lb
 }
+
+// requireFailsAfterRecovery checks the first server, once recovered by the selection, can go offline again
+func requireFailsAfterRecovery(t *testing.T, lb *LoadBalancer) {
+	srv := lb.Servers()[0]
+	onlineCount := lb.OnlineCount(false)
+
+	srv.SetOfflineFor(20 * time.Millisecond)
+	require.Equal(t, onlineCount-1, lb.OnlineCount(false))
+	time.Sleep(40 * time.Millisecond)
+
+	require.NotNil(t, lb.Next())
+	require.Equal(t, onlineCount, lb.OnlineCount(false))
+
+	srv.AddFailure(float64(srv.opts.MaxFails))
+	require.Equal(t, onlineCount-1, lb.OnlineCount(false))
+}
+
+func BenchmarkNextSingleServer(b *testing.B) {
+	lb := Create()
+	_ = lb.Add(ServerOptions{
+		MaxFails:    1,
+		FailTimeout: time.Second,
+	}, serverOneName)
+	_ = lb.Add(ServerOptions{
+		IsBackup: true,
+	}, backupServerName)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for idx := 0; idx < b.N; idx++ {
+		_ = lb.Next()
+	}
+}
+
+func BenchmarkNextMultipleServers(b *testing.B) {
+	lb := createTestLoadBalancer(true)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for idx := 0; idx < b.N; idx++ {
+		_ = lb.Next()
+	}
+}
+
+type countingHealthStore struct {
+	HealthStore
+	queries int64
+}
+
+func (s *countingHealthStore) IsDown(name string) (bool, time.Time) {
+	atomic.AddInt64(&s.queries, 1)
+	return s.HealthStore.IsDown(name)
+}
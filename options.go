@@ -0,0 +1,115 @@
+// See the LICENSE file for license details.
+
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+// ParseServerOptions parses server options from a string like "weight=3;max_fails=2;fail_timeout=10s;backup=false",
+// for e.g., read from a configuration file. Options can be separated by semicolons or ampersands, like in a url
+// query. Supported keys are name, weight, max_fails, fail_timeout, max_concurrent, breaker_threshold,
+// breaker_cooldown, failure_mode (windowed, consecutive or sliding_rate), failure_window, priority and backup.
+// Durations use the time.ParseDuration format. The result is validated with the same checks done by Add.
+func ParseServerOptions(s string) (ServerOptions, error) {
+	var opts ServerOptions
+	var err error
+
+	for _, item := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ';' || r == '&'
+	}) {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+
+		key, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return ServerOptions{}, fmt.Errorf("invalid server option [option=%v]", item)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "name":
+			opts.Name = value
+		case "weight":
+			opts.Weight, err = strconv.Atoi(value)
+		case "max_fails":
+			opts.MaxFails, err = strconv.Atoi(value)
+		case "fail_timeout":
+			opts.FailTimeout, err = time.ParseDuration(value)
+		case "max_concurrent":
+			opts.MaxConcurrent, err = strconv.Atoi(value)
+		case "breaker_threshold":
+			opts.BreakerThreshold, err = strconv.Atoi(value)
+		case "breaker_cooldown":
+			opts.BreakerCooldown, err = time.ParseDuration(value)
+		case "failure_mode":
+			opts.FailureMode, err = parseFailureMode(value)
+		case "failure_window":
+			opts.FailureWindow, err = strconv.Atoi(value)
+		case "priority":
+			opts.Priority, err = strconv.Atoi(value)
+		case "backup":
+			opts.IsBackup, err = strconv.ParseBool(value)
+		default:
+			return ServerOptions{}, fmt.Errorf("unknown server option [option=%v]", key)
+		}
+		if err != nil {
+			return ServerOptions{}, fmt.Errorf("invalid server option value [option=%v] [err=%v]", key, err)
+		}
+	}
+
+	// Validate the result
+	err = opts.validate()
+	if err != nil {
+		return ServerOptions{}, err
+	}
+
+	// Done
+	return opts, nil
+}
+
+// -----------------------------------------------------------------------------
+
+func parseFailureMode(s string) (FailureMode, error) {
+	switch strings.ToLower(s) {
+	case "windowed":
+		return WindowedFailures, nil
+	case "consecutive":
+		return ConsecutiveFailures, nil
+	case "sliding_rate":
+		return SlidingRateFailures, nil
+	}
+	return WindowedFailures, errors.New("unknown failure mode")
+}
+
+func (opts *ServerOptions) validate() error {
+	if opts.Weight < 0 || opts.MaxConcurrent < 0 || opts.Priority < 0 ||
+		opts.BreakerThreshold < 0 || opts.BreakerCooldown < 0 {
+		return errors.New("invalid parameter")
+	}
+	if opts.FailureMode < WindowedFailures || opts.FailureMode > SlidingRateFailures || opts.FailureWindow < 0 {
+		return errors.New("invalid parameter")
+	}
+	if !opts.IsBackup {
+		if opts.MaxFails > 0 {
+			if opts.FailTimeout <= time.Duration(0) {
+				return errors.New("invalid parameter")
+			}
+			if opts.FailureMode == SlidingRateFailures && opts.FailureWindow < opts.MaxFails {
+				return errors.New("invalid parameter")
+			}
+		} else if opts.MaxFails < 0 {
+			return errors.New("invalid parameter")
+		}
+	}
+	return nil
+}
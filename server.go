@@ -3,6 +3,7 @@
 package loadbalancer
 
 import (
+	"errors"
 	"time"
 )
 
@@ -14,22 +15,36 @@ type Server struct {
 	opts        ServerOptions
 	index       int
 	isDown      bool
-	failCounter int
+	failCounter float64
 	// NOTE: failTimestamp has two uses:
 	//       1. Marks the timestamp of the first access failure
 	//       2. Marks the timestamp to put it again online when down
 	failTimestamp time.Time
 	userData      interface{}
+	inFlight      int
+	selectCount   uint64
+	downtime      downtimeStats
+	// NOTE: Unlike failCounter, consecutive failures are only reset by a success and not by the FailTimeout
+	consecutiveFails int
+	// NOTE: Outcomes of the last requests in SlidingRateFailures mode, allocated on first use
+	failWindow     []float64
+	failWindowNext int
+	// NOTE: Weight set in the options or by SetTrafficSplit. The one in opts is the effective weight, which can be
+	//       changed at runtime with SetWeight, for e.g., by adaptive weighting.
+	configuredWeight int
 }
 
 // ServerOptions specifies the weight, fail timeout and other options of a server.
 type ServerOptions struct {
+	// Name is an optional stable identifier of the server, used, for e.g., to share its state through a HealthStore.
+	Name string
+
 	// Weight
 	Weight int
 
 	// Maximum amount of unsuccessful attempts to reach the server that must happen in the time frame specified by the
 	// FailTimeout parameter before setting it offline. The FailTimeout must be also specified. A value of zero
-	// means the server will never go offline.
+	// means the server will never go offline. See FailureMode for other ways to account the failures.
 	MaxFails int
 
 	// Fail timeout sets the time period where MaxFails unsuccessful attempts must happen in order to set a server
@@ -37,17 +52,51 @@ type ServerOptions struct {
 	// online again.
 	FailTimeout time.Duration
 
-	// Indicates if this server must be used as a backup fail over. Backup servers never goes offline.
+	// Maximum amount of concurrent requests the server can handle, tracked with BeginRequest and EndRequest. Once
+	// reached, the server is not selected until a request ends. A value of zero means no limit.
+	MaxConcurrent int
+
+	// BreakerThreshold sets the amount of consecutive failures, without a success in between, that trip the server
+	// circuit breaker. A value of zero disables it. Requires MaxFails to be set.
+	//
+	// Passive failures put the server offline for FailTimeout once MaxFails is reached. The breaker counts the
+	// failures across those periods, so a server that keeps failing each time it is put online again, is kept
+	// offline for BreakerCooldown instead. If both apply, the longest recovery time wins.
+	BreakerThreshold int
+
+	// BreakerCooldown sets how long the server is kept offline once the breaker trips. Defaults to FailTimeout.
+	BreakerCooldown time.Duration
+
+	// FailureMode sets how failures are accounted towards MaxFails. Defaults to WindowedFailures. In all the modes,
+	// FailTimeout sets how long the server stays offline.
+	FailureMode FailureMode
+
+	// FailureWindow sets the amount of recent requests considered by the SlidingRateFailures mode. It must be set,
+	// and not lower than MaxFails, if that mode is used.
+	FailureWindow int
+
+	// Priority sets the tier of a primary server. Lower values are preferred, so servers with a higher priority value
+	// are only used when all the servers with lower values are offline. Backup servers are still used when all the
+	// primary servers are offline. Defaults to zero, so all of them belong to the same tier.
+	Priority int
+
+	// Indicates if this server must be used as a backup fail over. Backup servers never goes offline. The weight of
+	// backup servers shapes how the failover traffic is distributed among them.
 	IsBackup bool
 }
 
 // ServerGroup is a group of servers. Used to classify and track primary and backup servers.
 type ServerGroup struct {
-	srvList          []Server
+	srvList          []*Server
 	currServerIdx    int
 	currServerWeight int
 }
 
+type groupCursor struct {
+	serverIdx    int
+	serverWeight int
+}
+
 // -----------------------------------------------------------------------------
 
 // UserData returns the server user data
@@ -55,6 +104,70 @@ func (srv *Server) UserData() interface{} {
 	return srv.userData
 }
 
+// Name returns the server name
+func (srv *Server) Name() string {
+	return srv.opts.Name
+}
+
+// Weight returns the current server weight
+func (srv *Server) Weight() int {
+	srv.lb.mtx.Lock()
+	weight := srv.opts.Weight
+	srv.lb.mtx.Unlock()
+	return weight
+}
+
+// ConfiguredWeight returns the weight the server was added with or the one set by SetTrafficSplit, ignoring the
+// changes made by SetWeight
+func (srv *Server) ConfiguredWeight() int {
+	srv.lb.mtx.Lock()
+	weight := srv.configuredWeight
+	srv.lb.mtx.Unlock()
+	return weight
+}
+
+// SetWeight changes the server weight. Zero sets the default weight of 1. The configured weight, reported by
+// Snapshot, is kept.
+func (srv *Server) SetWeight(weight int) error {
+	if weight < 0 {
+		return errors.New("invalid parameter")
+	}
+	if weight == 0 {
+		weight = 1
+	}
+
+	srv.lb.mtx.Lock()
+	srv.opts.Weight = weight
+	srv.lb.mtx.Unlock()
+
+	// Done
+	return nil
+}
+
+// BeginRequest increments the number of requests in progress on this server. Must be balanced with EndRequest.
+func (srv *Server) BeginRequest() {
+	srv.lb.mtx.Lock()
+	srv.inFlight += 1
+	srv.lb.mtx.Unlock()
+}
+
+// EndRequest decrements the number of requests in progress on this server.
+func (srv *Server) EndRequest() {
+	srv.lb.mtx.Lock()
+	if srv.inFlight > 0 {
+		srv.inFlight -= 1
+	}
+	srv.lb.mtx.Unlock()
+}
+
+// InFlight returns the number of requests in progress on this server.
+func (srv *Server) InFlight() int {
+	srv.lb.mtx.Lock()
+	inFlight := srv.inFlight
+	srv.lb.mtx.Unlock()
+	return inFlight
+}
+
 // SetOnline marks a server as available
 func (srv *Server) SetOnline() {
 	// We only can change the online/offline status on primary servers
@@ -67,13 +180,18 @@ func (srv *Server) SetOnline() {
 	// Lock access
 	srv.lb.mtx.Lock()
 
-	// Reset the failure counter
-	srv.failCounter = 0
+	// Reset the failure counters or, in sliding rate mode, account the success in the window
+	if srv.opts.FailureMode == SlidingRateFailures && !srv.isDown {
+		srv.recordOutcome(0)
+	} else {
+		srv.failCounter = 0
+		srv.resetFailWindow()
+	}
+	srv.consecutiveFails = 0
 
 	// If the server was marked as down, put it online again
 	if srv.isDown {
-		srv.isDown = false
-		srv.lb.primaryOnlineCount += 1
+		srv.markUp(time.Now())
 
 		notifyUp = true
 	}
@@ -83,54 +201,150 @@ func (srv *Server) SetOnline() {
 
 	// Call event callback
 	if notifyUp {
+		srv.publishHealth(time.Now())
 		srv.lb.raiseEvent(ServerUpEvent, srv)
 	}
 }
 
 // SetOffline marks a server as unavailable
 func (srv *Server) SetOffline() {
+	srv.AddFailure(1)
+}
+
+// AddFailure accounts an unsuccessful attempt to reach the server with the specified weight towards MaxFails, so
+// less meaningful failures, like timeouts on a flaky network, can count as a fraction of a failure. The server is
+// put offline once the accumulated weight reaches MaxFails within the FailTimeout period. A weight of 1 is the
+// same as calling SetOffline.
+func (srv *Server) AddFailure(weight float64) {
 	// We only can change the online/offline status on primary servers
-	if srv.opts.MaxFails == 0 || srv.opts.IsBackup {
+	if srv.opts.MaxFails == 0 || srv.opts.IsBackup || !(weight > 0) {
 		return
 	}
 
 	notifyDown := false
+	tripped := false
+
+	now := time.Now()
 
 	// Lock access
 	srv.lb.mtx.Lock()
 
 	// If server is up
-	if !srv.isDown && srv.failCounter < srv.opts.MaxFails {
-		now := time.Now()
+	maxFails := float64(srv.opts.MaxFails)
+	if !srv.isDown && srv.failCounter < maxFails {
+		switch srv.opts.FailureMode {
+		case ConsecutiveFailures:
+			// Failures accumulate until a success resets them
+			srv.failCounter += weight
 
-		// Increment the failure counter
-		srv.failCounter += 1
+		case SlidingRateFailures:
+			// Account the failure among the last requests
+			srv.recordOutcome(weight)
 
-		if srv.failCounter == 1 {
-			// If it is the first failure, set the fail timestamp limit
-			srv.failTimestamp = now.Add(srv.opts.FailTimeout)
-
-		} else {
+		default:
+			if srv.failCounter == 0 {
+				// If it is the first failure, set the fail timestamp limit
+				srv.failTimestamp = now.Add(srv.opts.FailTimeout)
 
-			// If this failure passed after the fail timeout, reset the counter
-			if now.After(srv.failTimestamp) {
-				srv.failCounter = 1
+			} else if now.After(srv.failTimestamp) {
+				// If this failure passed after the fail timeout, start a new period
+				srv.failCounter = 0
+				srv.failTimestamp = now.Add(srv.opts.FailTimeout)
 			}
+
+			// Increment the failure counter
+			srv.failCounter += weight
 		}
 
 		// If we reach to the maximum failure count, put this server offline
-		if srv.failCounter == srv.opts.MaxFails {
-			srv.isDown = true
+		if srv.failCounter >= maxFails {
+			srv.failCounter = maxFails
 			srv.failTimestamp = now.Add(srv.opts.FailTimeout)
-			srv.lb.primaryOnlineCount -= 1
+			srv.markDown(now)
 
 			notifyDown = true
 		}
 	}
 
+	// Trip the breaker on too many consecutive failures
+	if srv.opts.BreakerThreshold > 0 {
+		srv.consecutiveFails += 1
+		if srv.consecutiveFails >= srv.opts.BreakerThreshold {
+			srv.consecutiveFails = 0
+
+			breakerTimestamp := now.Add(srv.opts.BreakerCooldown)
+			if !srv.isDown {
+				srv.failCounter = maxFails
+				srv.failTimestamp = breakerTimestamp
+				srv.markDown(now)
+
+				notifyDown = true
+			} else if breakerTimestamp.After(srv.failTimestamp) {
+				srv.failTimestamp = breakerTimestamp
+			}
+			tripped = true
+		}
+	}
+
+	recoveryTimestamp := srv.failTimestamp
+
+	// Unlock access
+	srv.lb.mtx.Unlock()
+
+	// Share the new recovery time
+	if notifyDown || tripped {
+		srv.publishHealth(recoveryTimestamp)
+	}
+
+	// Call event callback
+	if notifyDown {
+		srv.lb.raiseEvent(ServerDownEvent, srv)
+	}
+}
+
+// SetOfflineFor marks a server as unavailable for, at least, the specified duration regardless of the configured
+// MaxFails and FailTimeout, for e.g., when the server advertised a long outage. If the server is already offline,
+// the recovery time is only extended.
+func (srv *Server) SetOfflineFor(d time.Duration) {
+	// We only can change the online/offline status on primary servers
+	if srv.opts.MaxFails == 0 || srv.opts.IsBackup {
+		return
+	}
+	if d <= 0 {
+		srv.SetOffline()
+		return
+	}
+
+	notifyDown := false
+	extended := false
+
+	// Lock access
+	srv.lb.mtx.Lock()
+
+	now := time.Now()
+	recoveryTimestamp := now.Add(d)
+	if !srv.isDown {
+		// Put this server offline
+		srv.failCounter = float64(srv.opts.MaxFails)
+		srv.failTimestamp = recoveryTimestamp
+		srv.markDown(now)
+
+		notifyDown = true
+	} else if recoveryTimestamp.After(srv.failTimestamp) {
+		// Extend the recovery time
+		srv.failTimestamp = recoveryTimestamp
+
+		extended = true
+	}
+
 	// Unlock access
 	srv.lb.mtx.Unlock()
 
+	// Share the new recovery time
+	if notifyDown || extended {
+		srv.publishHealth(recoveryTimestamp)
+	}
+
 	// Call event callback
 	if notifyDown {
 		srv.lb.raiseEvent(ServerDownEvent, srv)
@@ -0,0 +1,114 @@
+// See the LICENSE file for license details.
+
+package loadbalancer
+
+import (
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+// Snapshot contains the state of the load balancer servers at a given time.
+type Snapshot struct {
+	// Number of online primary servers
+	PrimaryOnlineCount int
+
+	// Number of offline primary servers whose FailTimeout expired but were not put online yet because of the
+	// MaxRecoveryPromotions limit or because they were not reached by the selection
+	PendingRecoveryCount int
+
+	// Servers, primary ones first followed by the backup servers
+	Servers []ServerSnapshot
+}
+
+// ServerSnapshot contains the state of a server at a given time.
+type ServerSnapshot struct {
+	Server   *Server
+	Name     string
+	Index    int
+	IsBackup bool
+	IsOnline bool
+	Weight   int
+
+	// Weight set in the options or with SetTrafficSplit. It differs from the effective Weight used by the selection
+	// if it was changed with SetWeight, for e.g., by adaptive weighting.
+	ConfiguredWeight int
+
+	// Accumulated weight of the failures accounted towards MaxFails
+	FailCounter float64
+
+	// Time when an offline server will be considered online again. Zero if online.
+	RecoveryTime time.Time
+
+	// Number of requests in progress
+	InFlight int
+
+	// Number of times the server was selected since the last ResetStats call
+	SelectCount uint64
+
+	// Number of times the server went offline and, of them, the ones that happened within a FailTimeout period
+	// after recovering (flaps), since the last ResetStats call
+	DownCount uint64
+	FlapCount uint64
+
+	// Time the server stayed offline the last time, the longest time, and the total, since the last ResetStats
+	// call. An ongoing outage is not accounted until the server is online again.
+	LastDownDuration    time.Duration
+	LongestDownDuration time.Duration
+	TotalDownDuration   time.Duration
+}
+
+// -----------------------------------------------------------------------------
+
+// Snapshot returns a consistent view of the state of all servers.
+func (lb *LoadBalancer) Snapshot() Snapshot {
+	lb.mtx.Lock()
+	defer lb.mtx.Unlock()
+
+	snap := Snapshot{
+		PrimaryOnlineCount: lb.primaryOnlineCount,
+		Servers:            make([]ServerSnapshot, 0, len(lb.primaryGroup.srvList)+len(lb.backupGroup.srvList)),
+	}
+	now := time.Now()
+	for _, srv := range lb.primaryGroup.srvList {
+		snap.Servers = append(snap.Servers, srv.snapshot())
+		if srv.isDown && now.After(srv.failTimestamp) {
+			snap.PendingRecoveryCount += 1
+		}
+	}
+	for _, srv := range lb.backupGroup.srvList {
+		snap.Servers = append(snap.Servers, srv.snapshot())
+	}
+
+	// Done
+	return snap
+}
+
+// -----------------------------------------------------------------------------
+
+// NOTE: The load balancer lock must be held
+func (srv *Server) snapshot() ServerSnapshot {
+	ss := ServerSnapshot{
+		Server:      srv,
+		Name:        srv.opts.Name,
+		Index:       srv.index,
+		IsBackup:    srv.opts.IsBackup,
+		IsOnline:    !srv.isDown,
+		Weight:      srv.opts.Weight,
+		FailCounter: srv.failCounter,
+		InFlight:    srv.inFlight,
+		SelectCount: srv.selectCount,
+
+		ConfiguredWeight: srv.configuredWeight,
+
+		DownCount:           srv.downtime.downCount,
+		FlapCount:           srv.downtime.flapCount,
+		LastDownDuration:    srv.downtime.lastDown,
+		LongestDownDuration: srv.downtime.longestDown,
+		TotalDownDuration:   srv.downtime.totalDown,
+	}
+	if srv.isDown {
+		ss.RecoveryTime = srv.failTimestamp
+	}
+	return ss
+}
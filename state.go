@@ -0,0 +1,134 @@
+// See the LICENSE file for license details.
+
+package loadbalancer
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+type balancerState struct {
+	Servers []serverState `json:"servers"`
+}
+
+type serverState struct {
+	Name             string    `json:"name"`
+	IsDown           bool      `json:"down"`
+	FailCounter      float64   `json:"failCounter"`
+	FailTimestamp    time.Time `json:"failTimestamp"`
+	ConsecutiveFails int       `json:"consecutiveFails,omitempty"`
+}
+
+// -----------------------------------------------------------------------------
+
+// ExportState returns, encoded as JSON, the online/offline state and failure counters of the named primary servers
+// so it can be restored with ImportState, for e.g., after a restart, instead of assuming all servers are online.
+// Servers without a name are not exported.
+func (lb *LoadBalancer) ExportState() []byte {
+	lb.mtx.Lock()
+	state := balancerState{
+		Servers: make([]serverState, 0, len(lb.primaryGroup.srvList)),
+	}
+	for _, srv := range lb.primaryGroup.srvList {
+		if len(srv.opts.Name) > 0 && srv.opts.MaxFails > 0 {
+			state.Servers = append(state.Servers, serverState{
+				Name:             srv.opts.Name,
+				IsDown:           srv.isDown,
+				FailCounter:      srv.failCounter,
+				FailTimestamp:    srv.failTimestamp,
+				ConsecutiveFails: srv.consecutiveFails,
+			})
+		}
+	}
+	lb.mtx.Unlock()
+
+	// NOTE: Marshalling this structure cannot fail
+	b, _ := json.Marshal(state)
+	return b
+}
+
+// ImportState restores the state exported with ExportState. Servers are matched by name and unknown ones are
+// ignored. Offline servers whose recovery time already passed are restored as online.
+func (lb *LoadBalancer) ImportState(data []byte) error {
+	var state balancerState
+
+	err := json.Unmarshal(data, &state)
+	if err != nil {
+		return errors.New("invalid state")
+	}
+
+	now := time.Now()
+
+	notifyUp := make([]*Server, 0)
+	notifyDown := make([]*Server, 0)
+
+	// Lock access
+	lb.mtx.Lock()
+
+	for _, ss := range state.Servers {
+		srv := lb.primaryGroup.findByName(ss.Name)
+		if srv == nil || srv.opts.MaxFails == 0 || ss.FailCounter < 0 {
+			continue
+		}
+
+		maxFails := float64(srv.opts.MaxFails)
+		srv.consecutiveFails = ss.ConsecutiveFails
+
+		if ss.IsDown && now.Before(ss.FailTimestamp) {
+			// Restore the outage
+			srv.failCounter = maxFails
+			srv.failTimestamp = ss.FailTimestamp
+			if !srv.isDown {
+				srv.markDown(now)
+
+				notifyDown = append(notifyDown, srv)
+			}
+			continue
+		}
+
+		if srv.isDown {
+			srv.markUp(now)
+
+			notifyUp = append(notifyUp, srv)
+		}
+
+		// Restore the failures of the current period, if still active
+		srv.failCounter = 0
+		if !ss.IsDown && ss.FailCounter > 0 && now.Before(ss.FailTimestamp) {
+			srv.failCounter = ss.FailCounter
+			if srv.failCounter >= maxFails {
+				srv.failCounter = maxFails - 1
+			}
+			srv.failTimestamp = ss.FailTimestamp
+		}
+	}
+
+	// Unlock access
+	lb.mtx.Unlock()
+
+	// Call event callback
+	for _, srv := range notifyDown {
+		lb.raiseEvent(ServerDownEvent, srv)
+	}
+	for _, srv := range notifyUp {
+		lb.raiseEvent(ServerUpEvent, srv)
+	}
+
+	// Done
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+// NOTE: The load balancer lock must be held
+func (group *ServerGroup) findByName(name string) *Server {
+	for _, srv := range group.srvList {
+		if srv.opts.Name == name {
+			return srv
+		}
+	}
+	return nil
+}
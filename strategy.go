@@ -0,0 +1,323 @@
+// See the LICENSE file for license details.
+
+package loadbalancer
+
+import (
+	"sort"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+// Strategy specifies the algorithm used to select the next server within a group.
+type Strategy int
+
+// Comparator reports whether server a must be preferred over server b. It receives the state of the servers at
+// the time of the selection. It is called while holding the load balancer lock, so it must not call the load
+// balancer nor the Server methods. UserData can be safely accessed.
+type Comparator func(a, b *ServerSnapshot) bool
+
+// -----------------------------------------------------------------------------
+
+const (
+	// RoundRobinStrategy selects servers in order, sending each one as many consecutive requests as its weight.
+	RoundRobinStrategy Strategy = iota
+
+	// RandomStrategy selects an online server at random ignoring weights.
+	RandomStrategy
+
+	// WeightedRandomStrategy selects an online server at random with a probability proportional to its weight.
+	WeightedRandomStrategy
+
+	// WeightedLeastConnectionsStrategy selects the online server with the lowest ratio between its in-flight
+	// requests and its weight. Ties are resolved in round-robin order. In-flight requests are only tracked when
+	// servers are acquired with Acquire or BeginRequest/EndRequest are called.
+	WeightedLeastConnectionsStrategy
+
+	// ComparatorStrategy selects the online server preferred by the Comparator, for e.g., the one with the lowest
+	// observed error rate or latency. Ties are resolved in round-robin order. Without a comparator, it behaves like
+	// RoundRobinStrategy.
+	ComparatorStrategy
+)
+
+// -----------------------------------------------------------------------------
+
+func (lb *LoadBalancer) selectFromGroup(group *ServerGroup, now time.Time, notifyUp []*Server) (*Server, []*Server) {
+	switch lb.strategy {
+	case RandomStrategy:
+		notifyUp = lb.promoteExpired(group, now, notifyUp)
+		return lb.selectRandom(group, false), notifyUp
+
+	case WeightedRandomStrategy:
+		notifyUp = lb.promoteExpired(group, now, notifyUp)
+		return lb.selectRandom(group, true), notifyUp
+
+	case WeightedLeastConnectionsStrategy:
+		notifyUp = lb.promoteExpired(group, now, notifyUp)
+		idx := group.leastLoaded(group.currServerIdx, now)
+		if idx < 0 {
+			return nil, notifyUp
+		}
+		group.currServerIdx = (idx + 1) % len(group.srvList)
+		return group.srvList[idx], notifyUp
+
+	case ComparatorStrategy:
+		if lb.comparator != nil {
+			notifyUp = lb.promoteExpired(group, now, notifyUp)
+			idx := group.preferred(group.currServerIdx, now, lb.comparator)
+			if idx < 0 {
+				return nil, notifyUp
+			}
+			group.currServerIdx = (idx + 1) % len(group.srvList)
+			return group.srvList[idx], notifyUp
+		}
+	}
+	return lb.selectRoundRobin(group, now, notifyUp)
+}
+
+func (lb *LoadBalancer) selectRoundRobin(group *ServerGroup, now time.Time, notifyUp []*Server) (*Server, []*Server) {
+	// Ensure at least one server can be selected, so we don't loop forever
+	if !group.hasSelectable(now) {
+		return nil, notifyUp
+	}
+
+	for {
+		srv := group.srvList[group.currServerIdx]
+
+		if srv.isDown && now.After(srv.failTimestamp) {
+			// Set this server online again
+			srv.markUp(now)
+
+			notifyUp = append(notifyUp, srv)
+		}
+
+		if !srv.isDown && !srv.isSaturated() && group.currServerWeight < srv.opts.Weight {
+			// Got a server!
+			group.currServerWeight += 1
+
+			// Select this server
+			return srv, notifyUp
+		}
+
+		// Advance to next server
+		group.currServerIdx += 1
+		if group.currServerIdx >= len(group.srvList) {
+			group.currServerIdx = 0
+		}
+
+		group.currServerWeight = 0
+	}
+}
+
+func (lb *LoadBalancer) selectRandom(group *ServerGroup, weighted bool) *Server {
+	// Calculate the sum of the weights of the online servers
+	totalWeight := 0
+	for _, srv := range group.srvList {
+		if !srv.isDown && !srv.isSaturated() {
+			totalWeight += srv.selectionWeight(weighted)
+		}
+	}
+	if totalWeight == 0 {
+		return nil
+	}
+
+	// Pick one
+	r := lb.rnd.Intn(totalWeight)
+	for _, srv := range group.srvList {
+		if !srv.isDown && !srv.isSaturated() {
+			w := srv.selectionWeight(weighted)
+			if r < w {
+				return srv
+			}
+			r -= w
+		}
+	}
+
+	// Should not happen
+	return nil
+}
+
+func (lb *LoadBalancer) peekFromGroup(group *ServerGroup, cursor *groupCursor, now time.Time) *Server {
+	// Check if at least one server can be selected
+	var firstSelectable *Server
+	for _, srv := range group.srvList {
+		if srv.isSelectable(now) {
+			firstSelectable = srv
+			break
+		}
+	}
+	if firstSelectable == nil {
+		return nil
+	}
+	switch lb.strategy {
+	case RandomStrategy, WeightedRandomStrategy:
+		return firstSelectable
+
+	case WeightedLeastConnectionsStrategy:
+		idx := group.leastLoaded(cursor.serverIdx, now)
+		cursor.serverIdx = (idx + 1) % len(group.srvList)
+		return group.srvList[idx]
+
+	case ComparatorStrategy:
+		if lb.comparator != nil {
+			idx := group.preferred(cursor.serverIdx, now, lb.comparator)
+			cursor.serverIdx = (idx + 1) % len(group.srvList)
+			return group.srvList[idx]
+		}
+	}
+
+	// Simulate the round-robin selection on the cursor copy
+	for {
+		srv := group.srvList[cursor.serverIdx]
+
+		if srv.isSelectable(now) && cursor.serverWeight < srv.opts.Weight {
+			cursor.serverWeight += 1
+			return srv
+		}
+
+		cursor.serverIdx += 1
+		if cursor.serverIdx >= len(group.srvList) {
+			cursor.serverIdx = 0
+		}
+		cursor.serverWeight = 0
+	}
+}
+
+// leastLoaded returns the index of the selectable server with the lowest in-flight to weight ratio, starting the
+// search at the given index, or -1 if none
+func (group *ServerGroup) leastLoaded(startIdx int, now time.Time) int {
+	bestIdx := -1
+	srvCount := len(group.srvList)
+	for i := 0; i < srvCount; i++ {
+		idx := (startIdx + i) % srvCount
+		srv := group.srvList[idx]
+		if !srv.isSelectable(now) {
+			continue
+		}
+
+		// Compare inFlight/weight ratios without divisions
+		if bestIdx < 0 {
+			bestIdx = idx
+		} else {
+			best := group.srvList[bestIdx]
+			if srv.inFlight*best.opts.Weight < best.inFlight*srv.opts.Weight {
+				bestIdx = idx
+			}
+		}
+	}
+	return bestIdx
+}
+
+// preferred returns the index of the selectable server preferred by the comparator, starting the search at the
+// given index, or -1 if none
+func (group *ServerGroup) preferred(startIdx int, now time.Time, less Comparator) int {
+	bestIdx := -1
+	var best ServerSnapshot
+
+	srvCount := len(group.srvList)
+	for i := 0; i < srvCount; i++ {
+		idx := (startIdx + i) % srvCount
+		srv := group.srvList[idx]
+		if !srv.isSelectable(now) {
+			continue
+		}
+
+		ss := srv.snapshot()
+		if bestIdx < 0 || less(&ss, &best) {
+			bestIdx = idx
+			best = ss
+		}
+	}
+	return bestIdx
+}
+
+func (lb *LoadBalancer) promoteExpired(group *ServerGroup, now time.Time, notifyUp []*Server) []*Server {
+	promoted := 0
+	for _, srv := range group.srvList {
+		if lb.maxPromotions > 0 && promoted >= lb.maxPromotions {
+			break
+		}
+		if srv.isDown && now.After(srv.failTimestamp) {
+			promoted += 1
+
+			// Set this server online again
+			srv.markUp(now)
+
+			notifyUp = append(notifyUp, srv)
+		}
+	}
+	return notifyUp
+}
+
+// promoteOldestFailed puts online the expired servers of a group, when all of them are offline, ordered by their
+// failure timestamp, and moves the selection cursor to the oldest one so it is probed first instead of always
+// probing the one with the lowest index. No more than the configured maximum promotions are put online.
+func (lb *LoadBalancer) promoteOldestFailed(group *ServerGroup, now time.Time, notifyUp []*Server) []*Server {
+	expired := make([]int, 0)
+	for idx, srv := range group.srvList {
+		if now.After(srv.failTimestamp) {
+			expired = append(expired, idx)
+		}
+	}
+	if len(expired) == 0 {
+		return notifyUp
+	}
+	sort.SliceStable(expired, func(i, j int) bool {
+		return group.srvList[expired[i]].failTimestamp.Before(group.srvList[expired[j]].failTimestamp)
+	})
+	if lb.maxPromotions > 0 && len(expired) > lb.maxPromotions {
+		expired = expired[:lb.maxPromotions]
+	}
+
+	for _, idx := range expired {
+		srv := group.srvList[idx]
+
+		// Put this server online again
+		srv.markUp(now)
+
+		notifyUp = append(notifyUp, srv)
+	}
+
+	group.currServerIdx = expired[0]
+	group.currServerWeight = 0
+
+	// Done
+	return notifyUp
+}
+
+func (srv *Server) selectionWeight(weighted bool) int {
+	if weighted {
+		return srv.opts.Weight
+	}
+	return 1
+}
+
+func (group *ServerGroup) cursor() groupCursor {
+	return groupCursor{
+		serverIdx:    group.currServerIdx,
+		serverWeight: group.currServerWeight,
+	}
+}
+
+func (group *ServerGroup) hasSelectable(now time.Time) bool {
+	for _, srv := range group.srvList {
+		if srv.isSelectable(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// isEligible returns true if the server is online or would be put online when reached
+func (srv *Server) isEligible(now time.Time) bool {
+	return !srv.isDown || now.After(srv.failTimestamp)
+}
+
+// isSelectable returns true if the server is eligible and has room for another concurrent request
+func (srv *Server) isSelectable(now time.Time) bool {
+	return srv.isEligible(now) && !srv.isSaturated()
+}
+
+func (srv *Server) isSaturated() bool {
+	return srv.opts.MaxConcurrent > 0 && srv.inFlight >= srv.opts.MaxConcurrent
+}
@@ -0,0 +1,174 @@
+// See the LICENSE file for license details.
+
+package loadbalancer
+
+import (
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+// PoolHealth contains a summary of the health of the load balancer servers.
+type PoolHealth struct {
+	// Time when the summary was taken
+	Time time.Time
+
+	// Number of online primary servers
+	OnlineCount int
+
+	// Offline primary servers
+	Down []*Server
+
+	// Capacity the load balancer can serve, as returned by AvailableCapacity
+	Capacity int
+}
+
+type healthPublisher struct {
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// -----------------------------------------------------------------------------
+
+// Subscribe returns a channel that receives a summary of the health of the servers each time a server goes offline
+// or online, and periodically if HealthSummaryInterval was set. The current health is delivered right away.
+// Updates are coalesced, so a slow receiver only gets the latest one, and sending them never blocks the load
+// balancer. Each call returns a new channel that is closed by Unsubscribe or Close.
+func (lb *LoadBalancer) Subscribe() <-chan PoolHealth {
+	ch := make(chan PoolHealth, 1)
+	ch <- lb.poolHealth()
+
+	lb.subsMtx.Lock()
+	defer lb.subsMtx.Unlock()
+
+	if lb.closed {
+		close(ch)
+		return ch
+	}
+	lb.subscribers = append(lb.subscribers, ch)
+
+	// Start delivering the updates with the first subscriber
+	if lb.publisher == nil {
+		lb.publisher = &healthPublisher{
+			stopCh: make(chan struct{}),
+			doneCh: make(chan struct{}),
+		}
+		go lb.runPublisher(lb.publisher)
+	}
+
+	// Done
+	return ch
+}
+
+// Unsubscribe stops the updates sent to a channel returned by Subscribe and closes it.
+func (lb *LoadBalancer) Unsubscribe(ch <-chan PoolHealth) {
+	lb.subsMtx.Lock()
+	for idx, sub := range lb.subscribers {
+		if sub == ch {
+			lb.subscribers = append(lb.subscribers[:idx], lb.subscribers[idx+1:]...)
+			close(sub)
+			break
+		}
+	}
+	var p *healthPublisher
+	if len(lb.subscribers) == 0 {
+		p = lb.publisher
+		lb.publisher = nil
+	}
+	lb.subsMtx.Unlock()
+
+	// Stop delivering the updates with the last subscriber
+	p.stop()
+}
+
+// Close closes the channels returned by Subscribe and stops delivering the updates. The load balancer can still be
+// used but new subscriptions are closed immediately.
+func (lb *LoadBalancer) Close() {
+	lb.subsMtx.Lock()
+	lb.closed = true
+	for _, sub := range lb.subscribers {
+		close(sub)
+	}
+	lb.subscribers = nil
+	p := lb.publisher
+	lb.publisher = nil
+	lb.subsMtx.Unlock()
+
+	p.stop()
+}
+
+// -----------------------------------------------------------------------------
+
+// runPublisher sends the health summary to the subscribers until stopped
+func (lb *LoadBalancer) runPublisher(p *healthPublisher) {
+	defer close(p.doneCh)
+
+	var tickCh <-chan time.Time
+	if lb.healthInterval > 0 {
+		ticker := time.NewTicker(lb.healthInterval)
+		defer ticker.Stop()
+		tickCh = ticker.C
+	}
+
+	for {
+		select {
+		case <-lb.subsWakeCh:
+		case <-tickCh:
+		case <-p.stopCh:
+			return
+		}
+
+		health := lb.poolHealth()
+
+		lb.subsMtx.Lock()
+		for _, sub := range lb.subscribers {
+			// Replace the pending summary, if any, with the new one
+			select {
+			case sub <- health:
+			default:
+				select {
+				case <-sub:
+				default:
+				}
+				select {
+				case sub <- health:
+				default:
+				}
+			}
+		}
+		lb.subsMtx.Unlock()
+	}
+}
+
+// notifySubscribers wakes up the publisher, if any, to send the new health summary
+func (lb *LoadBalancer) notifySubscribers() {
+	select {
+	case lb.subsWakeCh <- struct{}{}:
+	default:
+	}
+}
+
+func (lb *LoadBalancer) poolHealth() PoolHealth {
+	lb.mtx.Lock()
+	defer lb.mtx.Unlock()
+
+	health := PoolHealth{
+		Time:        time.Now(),
+		OnlineCount: lb.primaryOnlineCount,
+		Down:        make([]*Server, 0),
+		Capacity:    lb.availableCapacity(),
+	}
+	for _, srv := range lb.primaryGroup.srvList {
+		if srv.isDown {
+			health.Down = append(health.Down, srv)
+		}
+	}
+	return health
+}
+
+func (p *healthPublisher) stop() {
+	if p != nil {
+		close(p.stopCh)
+		<-p.doneCh
+	}
+}
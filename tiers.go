@@ -0,0 +1,102 @@
+// See the LICENSE file for license details.
+
+package loadbalancer
+
+import (
+	"sort"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+// rebuildTiers groups the primary servers by priority, lowest first. If all of them share the same priority, no
+// tiers are used and the primary group is balanced as a whole.
+// NOTE: The load balancer lock must be held
+func (lb *LoadBalancer) rebuildTiers() {
+	srvList := make([]*Server, len(lb.primaryGroup.srvList))
+	copy(srvList, lb.primaryGroup.srvList)
+	sort.SliceStable(srvList, func(i, j int) bool {
+		return srvList[i].opts.Priority < srvList[j].opts.Priority
+	})
+
+	if len(srvList) == 0 || srvList[0].opts.Priority == srvList[len(srvList)-1].opts.Priority {
+		lb.tiers = nil
+		return
+	}
+
+	lb.tiers = make([]*ServerGroup, 0)
+	for idx, srv := range srvList {
+		if idx == 0 || srv.opts.Priority != srvList[idx-1].opts.Priority {
+			lb.tiers = append(lb.tiers, &ServerGroup{
+				srvList: make([]*Server, 0),
+			})
+		}
+		tier := lb.tiers[len(lb.tiers)-1]
+		tier.srvList = append(tier.srvList, srv)
+	}
+}
+
+// selectPrimary selects the next primary server from the first tier with online servers. Lower priority tiers are
+// only used if the higher priority ones are busy in backup overflow mode.
+// NOTE: The load balancer lock must be held
+func (lb *LoadBalancer) selectPrimary(now time.Time, notifyUp []*Server) (*Server, []*Server) {
+	if lb.tiers == nil {
+		return lb.selectFromGroup(&lb.primaryGroup, now, notifyUp)
+	}
+
+	for _, tier := range lb.tiers {
+		// Try to recover the tier if all of its servers are offline
+		if !tier.hasOnline() {
+			notifyUp = lb.promoteOldestFailed(tier, now, notifyUp)
+			if !tier.hasOnline() {
+				continue
+			}
+		}
+
+		var srv *Server
+		srv, notifyUp = lb.selectFromGroup(tier, now, notifyUp)
+		if srv != nil || !lb.backupOverflow {
+			return srv, notifyUp
+		}
+	}
+	return nil, notifyUp
+}
+
+// promotePrimaries tries to put online the primary servers, when all of them are offline, starting with the
+// highest priority tier
+// NOTE: The load balancer lock must be held
+func (lb *LoadBalancer) promotePrimaries(now time.Time, notifyUp []*Server) []*Server {
+	if lb.tiers == nil {
+		return lb.promoteOldestFailed(&lb.primaryGroup, now, notifyUp)
+	}
+
+	for _, tier := range lb.tiers {
+		notifyUp = lb.promoteOldestFailed(tier, now, notifyUp)
+		if lb.primaryOnlineCount > 0 {
+			break
+		}
+	}
+	return notifyUp
+}
+
+// peekTier returns the group of primary servers Next would select from
+// NOTE: The load balancer lock must be held
+func (lb *LoadBalancer) peekTier(now time.Time) *ServerGroup {
+	for _, tier := range lb.tiers {
+		for _, srv := range tier.srvList {
+			if srv.isEligible(now) {
+				return tier
+			}
+		}
+	}
+	return &lb.primaryGroup
+}
+
+func (group *ServerGroup) hasOnline() bool {
+	for _, srv := range group.srvList {
+		if !srv.isDown {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+// See the LICENSE file for license details.
+
+package loadbalancer
+
+import (
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+type waiter struct {
+	ch       chan *Server
+	deadline time.Time
+}
+
+// -----------------------------------------------------------------------------
+
+// dispatchWaiters hands out the available servers to the queued waiters in FIFO order until the queue is empty
+func (lb *LoadBalancer) dispatchWaiters() {
+	for {
+		// Serve the waiters, in order, while there are available servers
+		for {
+			lb.waitersMtx.Lock()
+			if len(lb.waiters) == 0 {
+				lb.waitersMtx.Unlock()
+				break
+			}
+			lb.waitersMtx.Unlock()
+
+			srv := lb.Next()
+			if srv == nil {
+				break
+			}
+
+			// NOTE: Only the dispatcher removes waiters, so the head is still the same one
+			lb.waitersMtx.Lock()
+			w := lb.waiters[0]
+			lb.waiters = lb.waiters[1:]
+			lb.waitersMtx.Unlock()
+
+			w.fulfill(srv)
+		}
+
+		// Calculate how much to wait until a server can become available
+		now := time.Now()
+		toWait, hasServers := lb.availabilityWait(now)
+
+		lb.waitersMtx.Lock()
+
+		// Release the waiters that reached their deadline or all of them if there are no servers at all
+		pending := lb.waiters[:0]
+		for _, w := range lb.waiters {
+			if !hasServers || (!w.deadline.IsZero() && !now.Before(w.deadline)) {
+				w.fulfill(nil)
+				continue
+			}
+			if !w.deadline.IsZero() {
+				if remaining := w.deadline.Sub(now); toWait < 0 || remaining < toWait {
+					toWait = remaining
+				}
+			}
+			pending = append(pending, w)
+		}
+		lb.waiters = pending
+
+		// Stop if nobody is waiting
+		if len(lb.waiters) == 0 {
+			lb.dispatching = false
+			lb.waitersMtx.Unlock()
+			return
+		}
+
+		lb.waitersMtx.Unlock()
+
+		// Wait some time until a new server can become available or a new waiter arrives
+		if toWait > 0 {
+			timer := time.NewTimer(toWait)
+			select {
+			case <-timer.C:
+			case <-lb.waitersWakeCh:
+				timer.Stop()
+			}
+		}
+	}
+}
+
+// availabilityWait returns how much to wait until a server can become available and if there are servers at all
+func (lb *LoadBalancer) availabilityWait(now time.Time) (time.Duration, bool) {
+	toWait := time.Duration(-1)
+
+	// Lock access
+	lb.mtx.Lock()
+	defer lb.mtx.Unlock()
+
+	// Exit if we don't have servers at all
+	if len(lb.primaryGroup.srvList) == 0 && len(lb.backupGroup.srvList) == 0 {
+		return 0, false
+	}
+
+	// Get the server that will become online sooner
+	anyDown := false
+	for _, srv := range lb.primaryGroup.srvList {
+		// Only consider offline servers
+		if srv.isDown {
+			anyDown = true
+
+			diff := srv.failTimestamp.Sub(now)
+			if diff <= 0 {
+				// This server can already be put online but the selection did not, so it is busy, poll until one
+				// request ends instead of retrying immediately
+				diff = busyPollInterval
+			}
+
+			if toWait < 0 || diff < toWait {
+				toWait = diff
+			}
+		}
+	}
+
+	// If no server is offline or we have backups, the available ones are busy, so poll until one request ends
+	if (!anyDown || len(lb.backupGroup.srvList) > 0) && (toWait < 0 || toWait > busyPollInterval) {
+		toWait = busyPollInterval
+	}
+
+	// Done
+	return toWait, true
+}
+
+func (w *waiter) fulfill(srv *Server) {
+	w.ch <- srv
+	close(w.ch)
+}